@@ -2,10 +2,12 @@ package controllers
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"strconv"
 
+	"github.com/febzey/ForestBot-Mainframe/keyservice"
 	"github.com/febzey/ForestBot-Mainframe/utils"
 )
 
@@ -14,12 +16,21 @@ type NewApiKeyRequest struct {
 	Permissions  struct {
 		Write bool `json:"write"`
 		Read  bool `json:"read"`
+		Admin bool `json:"admin"`
 	} `json:"Permissions"`
 	RateLimit string `json:"rateLimit"`
 
 	// bot-client
 	// client
 	TokenType string `json:"tokentype"`
+
+	// minecraft servers the key may be used for,
+	// empty means every server. Write keys need exactly one.
+	Servers []string `json:"servers"`
+
+	// fine grained scopes, example: ["minecraft:chat:write"]
+	// empty means the scopes equivalent to Permissions.
+	Scopes []string `json:"scopes"`
 }
 
 func (c *Controller) PostNewApiKey(w http.ResponseWriter, r *http.Request) {
@@ -39,13 +50,29 @@ func (c *Controller) PostNewApiKey(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	plainTextKey, err := c.KeyService.NewApiKey(req.Permissions.Write, req.Permissions.Read, req.ContactEmail, rateLimit, req.TokenType)
+	permissions := keyservice.APIPermissions{
+		Read:  req.Permissions.Read,
+		Write: req.Permissions.Write,
+		Admin: req.Permissions.Admin,
+	}
+
+	scopes, err := keyservice.ParseScopes(req.Scopes)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	plainTextKey, err := c.KeyService.NewApiKey(permissions, req.ContactEmail, rateLimit, req.TokenType, req.Servers, scopes)
+	if errors.Is(err, keyservice.ErrWriteKeyServerScope) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	c.Logger.Success(fmt.Sprintf("Created and saved new API Key for email: %s, Read: %t, Write: %t ", req.ContactEmail, req.Permissions.Read, req.Permissions.Write))
+	c.Logger.Success(fmt.Sprintf("Created and saved new API Key for email: %s, Read: %t, Write: %t, Admin: %t, Servers: %v, Scopes: %v", req.ContactEmail, req.Permissions.Read, req.Permissions.Write, req.Permissions.Admin, req.Servers, req.Scopes))
 
 	w.Header().Set("Content-Type", "application/json")
 
@@ -0,0 +1,200 @@
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/febzey/ForestBot-Mainframe/keyservice"
+	"github.com/febzey/ForestBot-Mainframe/middleware"
+	"github.com/febzey/ForestBot-Mainframe/utils"
+)
+
+/******
+
+Admin endpoints for managing api keys after they are created.
+Keys are referenced by their encrypted value (the "Key" field returned by /key/list).
+Also the session endpoint, where any key can be traded for a short lived session token.
+
+******/
+
+// METHOD: GET
+// PATH: /key/list
+// QUERIES: owner (optional)
+// DESCRIPTION: Lists every key, or every key for an owner email.
+func (c *Controller) GetApiKeys(w http.ResponseWriter, r *http.Request) {
+	owner := r.URL.Query().Get("owner")
+
+	keys, err := c.KeyService.ListKeys(owner)
+	if err != nil {
+		c.Logger.Error(err.Error())
+		http.Error(w, "Internal Database Error.", http.StatusInternalServerError)
+		return
+	}
+
+	utils.RespondWithJSON(w, http.StatusOK, keys)
+}
+
+// METHOD: GET
+// PATH: /key/usage
+// QUERIES: owner (optional)
+// DESCRIPTION: Usage for every key, last used time, events written and read, and open websocket connections.
+func (c *Controller) GetApiKeyUsage(w http.ResponseWriter, r *http.Request) {
+	owner := r.URL.Query().Get("owner")
+
+	reports, err := c.KeyService.UsageReport(owner)
+	if err != nil {
+		c.Logger.Error(err.Error())
+		http.Error(w, "Internal Database Error.", http.StatusInternalServerError)
+		return
+	}
+
+	utils.RespondWithJSON(w, http.StatusOK, reports)
+}
+
+// METHOD: DELETE
+// PATH: /key/revoke
+// QUERIES: key
+// DESCRIPTION: Revokes a key, any websocket client using it is disconnected.
+func (c *Controller) DeleteApiKey(w http.ResponseWriter, r *http.Request) {
+	key := r.URL.Query().Get("key")
+
+	if key == "" {
+		http.Error(w, "Invalid 'key' parameter required", http.StatusBadRequest)
+		return
+	}
+
+	if err := c.KeyService.RevokeKey(key); err != nil {
+		c.respondWithKeyError(w, err)
+		return
+	}
+
+	c.Logger.Success(fmt.Sprintf("Revoked API Key: %s", key))
+
+	utils.RespondWithJSON(w, http.StatusOK, key)
+}
+
+// METHOD: POST
+// PATH: /key/rotate
+// QUERIES: key
+// DESCRIPTION: Gives a key a new secret, keeping its owner and permissions.
+// The new plaintext key is returned, this is the only time it is shown.
+func (c *Controller) PostRotateApiKey(w http.ResponseWriter, r *http.Request) {
+	key := r.URL.Query().Get("key")
+
+	if key == "" {
+		http.Error(w, "Invalid 'key' parameter required", http.StatusBadRequest)
+		return
+	}
+
+	plainTextKey, encryptedKey, err := c.KeyService.RotateKey(key)
+	if err != nil {
+		c.respondWithKeyError(w, err)
+		return
+	}
+
+	c.Logger.Success(fmt.Sprintf("Rotated API Key: %s -> %s", key, encryptedKey))
+
+	utils.RespondWithJSON(w, http.StatusOK, map[string]string{"key": plainTextKey, "id": encryptedKey})
+}
+
+type ApiKeyExpiryRequest struct {
+	Key string `json:"key"`
+
+	//millisecond timestamp, 0 removes the expiry.
+	ExpiresAt int64 `json:"expiresAt"`
+}
+
+// METHOD: POST
+// PATH: /key/expire
+// BODY: {"key": "encrypted key", "expiresAt": 1700000000000}
+// DESCRIPTION: Sets when a key stops working.
+func (c *Controller) PostApiKeyExpiry(w http.ResponseWriter, r *http.Request) {
+	var req ApiKeyExpiryRequest
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON format", http.StatusBadRequest)
+		return
+	}
+
+	if req.Key == "" || req.ExpiresAt < 0 {
+		http.Error(w, "Invalid 'key' and 'expiresAt' required", http.StatusBadRequest)
+		return
+	}
+
+	if err := c.KeyService.SetKeyExpiry(req.Key, req.ExpiresAt); err != nil {
+		c.respondWithKeyError(w, err)
+		return
+	}
+
+	utils.RespondWithJSON(w, http.StatusOK, req)
+}
+
+// Sending back the right status for errors from the key service.
+func (c *Controller) respondWithKeyError(w http.ResponseWriter, err error) {
+	if errors.Is(err, keyservice.ErrKeyNotFound) {
+		http.Error(w, "Key not found", http.StatusNotFound)
+		return
+	}
+
+	c.Logger.Error(err.Error())
+	http.Error(w, "Internal Database Error.", http.StatusInternalServerError)
+}
+
+type SessionTokenRequest struct {
+	//narrows the token to some of the key's scopes, empty means all of them.
+	Scopes []string `json:"scopes"`
+
+	//how long the token lives in seconds, capped at SESSION_TOKEN_TTL_SECONDS.
+	TTL int `json:"ttl"`
+}
+
+type SessionTokenResponse struct {
+	Token string `json:"token"`
+
+	//millisecond timestamp.
+	ExpiresAt int64 `json:"expiresAt"`
+}
+
+// METHOD: POST
+// PATH: /key/session
+// BODY: {"scopes": ["events:read"], "ttl": 900} (both optional)
+// DESCRIPTION: Trades the api key used for this request for a short lived session token.
+// The token works anywhere an api key does, so browsers never need to hold the real key.
+func (c *Controller) PostSessionToken(w http.ResponseWriter, r *http.Request) {
+	key, ok := middleware.APIKeyFromRequest(r)
+	if !ok {
+		http.Error(w, "Missing api key", http.StatusUnauthorized)
+		return
+	}
+
+	var req SessionTokenRequest
+
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON format", http.StatusBadRequest)
+			return
+		}
+	}
+
+	scopes, err := keyservice.ParseScopes(req.Scopes)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	token, expiresAt, err := c.KeyService.IssueSessionToken(key, scopes, time.Duration(req.TTL)*time.Second)
+	if err != nil {
+		if errors.Is(err, keyservice.ErrSessionTokensDisabled) {
+			http.Error(w, "Session tokens are not enabled on this server", http.StatusServiceUnavailable)
+			return
+		}
+
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	utils.RespondWithJSON(w, http.StatusOK, SessionTokenResponse{Token: token, ExpiresAt: expiresAt})
+}
@@ -8,8 +8,11 @@ import (
 	"github.com/febzey/ForestBot-Mainframe/database"
 	"github.com/febzey/ForestBot-Mainframe/keyservice"
 	"github.com/febzey/ForestBot-Mainframe/logger"
+	"github.com/febzey/ForestBot-Mainframe/middleware"
+	"github.com/febzey/ForestBot-Mainframe/presence"
 	"github.com/febzey/ForestBot-Mainframe/types"
 	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
 )
 
 var (
@@ -29,7 +32,13 @@ type Route struct {
 	//The handler function to use for the route.
 	HandlerFunc http.HandlerFunc
 
-	isProtected bool
+	//The scope an api key needs to use this route.
+	//Routes without a scope are public, routes with a scope need
+	//an api key in the x-api-key header.
+	scope keyservice.Scope
+
+	//Routes that need a valid api key, but no specific scope.
+	requireKey bool
 }
 
 // Main controller that basically wraps our entire program, all api routes.
@@ -52,10 +61,12 @@ type Controller struct {
 	//string will be action type for the event.
 	Handlers map[string]Handler
 
-	//Player list for each server connected
-	//key would be the name of server
-	//Array is player
-	PlayerLists map[string][]types.Player
+	//Who is online on each server connected, safe to use from any go routine.
+	Presence *presence.Service
+
+	//Player lists for servers whose bot disconnected, key is the lowercase server name.
+	//only used while holding the mutex.
+	stalePlayerLists map[string]*stalePlayerList
 
 	//Caching images for playerlist / tablist
 	ImageCache types.ImageCache
@@ -63,26 +74,82 @@ type Controller struct {
 	//Key service for authentication
 	KeyService *keyservice.APIKeyService
 
+	//Settings for our websocket server
+	Config WebsocketConfig
+
+	//Counters for outbound websocket messages.
+	egressStats *EgressStats
+
+	//Recent broadcasts for each mc server, for clients resuming after a reconnect.
+	history *eventHistory
+
+	//Write events saved recently, so retries are not saved twice.
+	dedupe *eventDeduper
+
+	//The active and standby bot clients for each mc server.
+	//only used while holding the mutex.
+	bots *botRegistry
+
+	//queries clients can run with the query action, key is the query name.
+	queries map[string]queryHandler
+
+	//limits how many queries run at the same time.
+	querySlots chan struct{}
+
+	//bot sessions waiting to be saved, in order.
+	botSessions chan botSessionEvent
+
+	//commands sent to bots that are waiting for a result.
+	commands *commandTracker
+
+	//limits how many discord messages each guild sends to minecraft servers.
+	discordBridgeLimiter *keyservice.RateLimiter
+
+	//upgrades http requests to websockets.
+	upgrader websocket.Upgrader
+
 	//a mutex to keep our Controller in sync.
 	Mutex *sync.Mutex
 }
 
-// ! TODO Add a private key protection for our protected routes, return aunthorization error if not authorized.
-
 func NewController(db *database.Database, logger *logger.Logger, keyService *keyservice.APIKeyService) *Controller {
-	return &Controller{
+	config := LoadWebsocketConfig()
+
+	c := &Controller{
 		Database:    db,
 		Logger:      logger,
 		MessageChan: make(chan MessageChannel),
 		Clients:     make(map[string]*WebsocketClient),
 		Handlers:    make(map[string]Handler),
-		PlayerLists: make(map[string][]types.Player),
+		Presence:    presence.NewService(),
+
+		stalePlayerLists: make(map[string]*stalePlayerList),
 		ImageCache: types.ImageCache{
 			HeadImages: make(map[string]image.Image),
 		},
 		KeyService: keyService,
+		Config:     config,
 		Mutex:      &sync.Mutex{},
+
+		egressStats: &EgressStats{},
+		history:     newEventHistory(config.HistorySize),
+		dedupe:      newEventDeduper(config.DedupeWindow),
+		bots:        newBotRegistry(config.MaxStandbyBots),
+		querySlots:  make(chan struct{}, config.MaxConcurrentQueries),
+		upgrader:    newUpgrader(config),
+		commands:    newCommandTracker(),
+		botSessions: make(chan botSessionEvent, 256),
+
+		discordBridgeLimiter: keyservice.NewRateLimiter(config.DiscordBridgeRateWindow),
 	}
+
+	//Revoked or rotated keys should not keep working on open websockets.
+	keyService.OnKeyRevoked(c.disconnectClientsUsingKey)
+
+	//Open websockets close at a keys new expiry, not the one it had when they connected.
+	keyService.OnKeyExpiryChanged(c.updateClientKeyExpiry)
+
+	return c
 }
 
 func LoadAndHandleRoutes(router *mux.Router, controller *Controller) {
@@ -91,6 +158,9 @@ func LoadAndHandleRoutes(router *mux.Router, controller *Controller) {
 	//Continous running function that processes all Websocket Messages.
 	go ProcessWebsocketEvent(controller)
 
+	//Saving bot sessions for /bot/uptime.
+	go controller.runBotSessions()
+
 	var routes = []Route{
 		//Gets all available servers forestbot has been on
 		//example url: http://localhost:5000/api/v1/all-server
@@ -294,7 +364,7 @@ func LoadAndHandleRoutes(router *mux.Router, controller *Controller) {
 			Method:      http.MethodGet,
 			Pattern:     apiUrl + "/discord/guilds",
 			HandlerFunc: controller.GetDiscordGuilds,
-			isProtected: true,
+			scope:       keyservice.ScopeDiscordRead,
 		},
 
 		//get all live chat channels for our discord bot
@@ -302,7 +372,16 @@ func LoadAndHandleRoutes(router *mux.Router, controller *Controller) {
 			Method:      http.MethodGet,
 			Pattern:     apiUrl + "/discord/livechats",
 			HandlerFunc: controller.GetDiscordLiveChatChannels,
-			isProtected: true,
+			scope:       keyservice.ScopeDiscordRead,
+		},
+
+		//queries: server (optional), days (optional, default 7)
+		//description: how much of the last days each server had a bot collecting data
+		//example url: http://localhost:5000/api/v1/bot/uptime?server=simplyvanilla&days=30
+		{
+			Method:      http.MethodGet,
+			Pattern:     apiUrl + "/bot/uptime",
+			HandlerFunc: controller.GetBotUptime,
 		},
 
 		//////POST REQUESTS//////
@@ -314,7 +393,7 @@ func LoadAndHandleRoutes(router *mux.Router, controller *Controller) {
 			Method:      http.MethodPost,
 			Pattern:     apiUrl + "/discord/addguild",
 			HandlerFunc: controller.PostDiscordGuild,
-			isProtected: true,
+			scope:       keyservice.ScopeDiscordAdmin,
 		},
 		//body: {"guildName": "simplyvanilla_discord_server", "guildID": "123", "channelID": "123", "setupBy": "123", "date": "123", "mcServer": "simplyvanilla"}
 		//description: adds a live chat channel to the database
@@ -323,7 +402,7 @@ func LoadAndHandleRoutes(router *mux.Router, controller *Controller) {
 			Method:      http.MethodPost,
 			Pattern:     apiUrl + "/discord/addlivechat",
 			HandlerFunc: controller.PostDiscordLiveChat,
-			isProtected: true,
+			scope:       keyservice.ScopeDiscordAdmin,
 		},
 
 		//body: {"username": "febzey", "description": "I am a cool guy"}
@@ -344,7 +423,7 @@ func LoadAndHandleRoutes(router *mux.Router, controller *Controller) {
 			Method:      http.MethodDelete,
 			Pattern:     apiUrl + "/discord/deleteguild",
 			HandlerFunc: controller.DeleteDiscordGuild,
-			isProtected: true,
+			scope:       keyservice.ScopeDiscordAdmin,
 		},
 
 		//queries: channel_id
@@ -354,14 +433,14 @@ func LoadAndHandleRoutes(router *mux.Router, controller *Controller) {
 			Method:      http.MethodDelete,
 			Pattern:     apiUrl + "/discord/deletelivechat",
 			HandlerFunc: controller.DeleteDiscordLiveChat,
-			isProtected: true,
+			scope:       keyservice.ScopeDiscordAdmin,
 		},
 
 		/*
 			Generating api key for a new client,
 			Body: {
 				"contactEmail": "someEmail@gmail.com",
-				"Permissions": { "write": false, "read": true },
+				"Permissions": { "write": false, "read": true, "admin": false },
 				"rateLimit": 100,
 			}
 			url: http://localhost:5000/api/v1/key/generate
@@ -370,12 +449,97 @@ func LoadAndHandleRoutes(router *mux.Router, controller *Controller) {
 			Method:      http.MethodPost,
 			Pattern:     apiUrl + "/key/generate",
 			HandlerFunc: controller.PostNewApiKey,
-			isProtected: true,
+			scope:       keyservice.ScopeKeysAdmin,
+		},
+
+		//queries: owner (optional)
+		//description: lists all api keys, or all keys for an owner email
+		//example url: http://localhost:5000/api/v1/key/list?owner=someEmail@gmail.com
+		{
+			Method:      http.MethodGet,
+			Pattern:     apiUrl + "/key/list",
+			HandlerFunc: controller.GetApiKeys,
+			scope:       keyservice.ScopeKeysAdmin,
+		},
+
+		//queries: owner (optional)
+		//description: usage for each api key, last used, events written/read and open connections
+		//example url: http://localhost:5000/api/v1/key/usage?owner=someEmail@gmail.com
+		{
+			Method:      http.MethodGet,
+			Pattern:     apiUrl + "/key/usage",
+			HandlerFunc: controller.GetApiKeyUsage,
+			scope:       keyservice.ScopeKeysAdmin,
+		},
+
+		//queries: key
+		//description: gives a key a new secret, keeping its owner and permissions
+		//example url: http://localhost:5000/api/v1/key/rotate?key=encryptedkey
+		{
+			Method:      http.MethodPost,
+			Pattern:     apiUrl + "/key/rotate",
+			HandlerFunc: controller.PostRotateApiKey,
+			scope:       keyservice.ScopeKeysAdmin,
+		},
+
+		//body: {"key": "encryptedkey", "expiresAt": 1700000000000}
+		//description: sets when a key expires, 0 removes the expiry
+		//example url: http://localhost:5000/api/v1/key/expire
+		{
+			Method:      http.MethodPost,
+			Pattern:     apiUrl + "/key/expire",
+			HandlerFunc: controller.PostApiKeyExpiry,
+			scope:       keyservice.ScopeKeysAdmin,
+		},
+
+		//description: outbound websocket message counters, dropped messages and queue lengths per client
+		//example url: http://localhost:5000/api/v1/websocket/stats
+		{
+			Method:      http.MethodGet,
+			Pattern:     apiUrl + "/websocket/stats",
+			HandlerFunc: controller.GetWebsocketStats,
+			scope:       keyservice.ScopeWebsocketAdmin,
+		},
+
+		//body: {"server": "simplyvanilla", "command": "whisper", "args": {"username": "febzey", "message": "hi"}, "timeout": 10}
+		//description: sends a command to the active bot of a server and responds with its result
+		//example url: http://localhost:5000/api/v1/bot/command
+		{
+			Method:      http.MethodPost,
+			Pattern:     apiUrl + "/bot/command",
+			HandlerFunc: controller.PostBotCommand,
+			scope:       keyservice.ScopeBotCommand,
+		},
+
+		//body: {"scopes": ["events:read"], "ttl": 900} (both optional)
+		//description: trades the api key in the x-api-key header for a short lived session token
+		//example url: http://localhost:5000/api/v1/key/session
+		{
+			Method:      http.MethodPost,
+			Pattern:     apiUrl + "/key/session",
+			HandlerFunc: controller.PostSessionToken,
+			requireKey:  true,
+		},
+
+		//queries: key
+		//description: revokes a key and disconnects any websocket using it
+		//example url: http://localhost:5000/api/v1/key/revoke?key=encryptedkey
+		{
+			Method:      http.MethodDelete,
+			Pattern:     apiUrl + "/key/revoke",
+			HandlerFunc: controller.DeleteApiKey,
+			scope:       keyservice.ScopeKeysAdmin,
 		},
 	}
 
 	for _, route := range routes {
-		router.HandleFunc(route.Pattern, route.HandlerFunc).Methods(route.Method)
+		var handler http.Handler = route.HandlerFunc
+
+		if route.scope != "" || route.requireKey {
+			handler = middleware.RequireAPIKey(controller.KeyService, route.scope)(handler)
+		}
+
+		router.Handle(route.Pattern, handler).Methods(route.Method)
 	}
 
 }
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"net/http"
 
+	"github.com/febzey/ForestBot-Mainframe/presence"
 	"github.com/febzey/ForestBot-Mainframe/utils"
 )
 
@@ -13,8 +14,7 @@ import (
 //RESPONSE: ARRAY
 //Example: http://localhost:5000/api/v1/tablist?server=newtest_new1
 
-// PlayerLists map[string][]types.Player
-// string will be server name, []types.Player will be the list of players on that server
+// the player list for the server comes from c.Presence
 func (c *Controller) GetTablist(w http.ResponseWriter, r *http.Request) {
 	server := r.URL.Query().Get("server")
 
@@ -23,8 +23,8 @@ func (c *Controller) GetTablist(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	playerList := c.PlayerLists[server]
-	if playerList == nil {
+	playerList, ok := c.Presence.List(server)
+	if !ok {
 		http.Error(w, "Server does not have an active player list", http.StatusBadRequest)
 		return
 	}
@@ -38,6 +38,11 @@ func (c *Controller) GetTablist(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	//the servers bot is gone, the tablist may be out of date.
+	if len(playerList) > 0 && playerList[0].Status == presence.StatusUnknown {
+		w.Header().Set("X-Player-List-Status", presence.StatusUnknown)
+	}
+
 	//send the image to the client
 	http.ServeFile(w, r, filePath)
 
@@ -1,9 +1,9 @@
 package controllers
 
 import (
-	"fmt"
 	"net/http"
 
+	"github.com/febzey/ForestBot-Mainframe/presence"
 	"github.com/febzey/ForestBot-Mainframe/utils"
 )
 
@@ -17,17 +17,20 @@ func (c *Controller) GetUserOnlineCheck(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	//look for that username inside of our plaerList map
-	for _, playerList := range c.PlayerLists {
-		for _, player := range playerList {
-			c.Logger.Info(fmt.Sprintf("Player: %s Our Player: %s", player.Username, username))
+	utils.RespondWithJSON(w, http.StatusOK, c.onlineStatus(username))
+}
+
+// Checking if a user is online, shared by /online and the online query.
+func (c *Controller) onlineStatus(username string) map[string]string {
+	player, ok := c.Presence.ByUsername(username)
+	if !ok {
+		return map[string]string{"online": "false"}
+	}
 
-			if player.Username == username {
-				utils.RespondWithJSON(w, http.StatusOK, map[string]string{"online": "true", "server": player.Server})
-				return
-			}
-		}
+	// the servers bot is gone, they may have left since.
+	if player.Status == presence.StatusUnknown {
+		return map[string]string{"online": "unknown", "server": player.Server}
 	}
 
-	utils.RespondWithJSON(w, http.StatusOK, map[string]string{"online": "false"})
+	return map[string]string{"online": "true", "server": player.Server}
 }
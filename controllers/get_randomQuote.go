@@ -3,7 +3,6 @@ package controllers
 import (
 	"net/http"
 
-	"github.com/febzey/ForestBot-Mainframe/types"
 	"github.com/febzey/ForestBot-Mainframe/utils"
 )
 
@@ -26,34 +25,13 @@ func (c *Controller) GetRandomQuotes(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	rows, err := c.Database.Query("SELECT name,message,date,mc_server,uuid FROM messages WHERE mc_server = ? AND name = ? AND LENGTH(message) > 10 ORDER BY RAND() LIMIT 1", server, name)
+	message, err := c.Database.GetRandomQuote(name, server)
 	if err != nil {
 		c.Logger.Error(err.Error())
 		http.Error(w, "Internal Database Error - Contact Febzey or IncognitoMode", http.StatusInternalServerError)
 		return
 	}
 
-	defer rows.Close()
-
-	var message types.MinecraftChatMessage
-
-	for rows.Next() {
-
-		err := rows.Scan(
-			&message.Name,
-			&message.Message,
-			&message.Date,
-			&message.Mc_server,
-			&message.Uuid,
-		)
-		if err != nil {
-			c.Logger.Error(err.Error())
-			http.Error(w, "Internal Database Error - Contact Febzey or IncognitoMode", http.StatusInternalServerError)
-			return
-		}
-
-	}
-
 	utils.RespondWithJSON(w, http.StatusOK, message)
 
 }
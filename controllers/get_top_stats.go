@@ -1,11 +1,11 @@
 package controllers
 
 import (
-	"database/sql"
-	"fmt"
+	"errors"
 	"net/http"
 	"strconv"
 
+	"github.com/febzey/ForestBot-Mainframe/database"
 	"github.com/febzey/ForestBot-Mainframe/utils"
 )
 
@@ -27,62 +27,23 @@ func (c *Controller) GetTopStatistics(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Ensure the user-specified statistic is a valid column name to prevent SQL injection
-	validStatistics := map[string]bool{"playtime": true, "joins": true, "kills": true, "deaths": true}
-	if !validStatistics[statistic] {
-		http.Error(w, "Invalid 'statistic' parameter", http.StatusBadRequest)
+	limitNumber, err := strconv.Atoi(limit)
+	if err != nil {
+		http.Error(w, "Invalid 'limit' parameter", http.StatusBadRequest)
 		return
 	}
 
-	// Construct the SQL query dynamically
-	SELECT_TOP_STATISTICS_QUERY := fmt.Sprintf("SELECT username, %s FROM users WHERE mc_server = ? ORDER BY %s DESC LIMIT ?", statistic, statistic)
-
-	rows, err := c.Database.Query(SELECT_TOP_STATISTICS_QUERY, server, limit)
+	topStatistics, err := c.Database.GetTopStatistic(server, statistic, limitNumber)
+	if errors.Is(err, database.ErrInvalidStatistic) {
+		http.Error(w, "Invalid 'statistic' parameter", http.StatusBadRequest)
+		return
+	}
 	if err != nil {
 		http.Error(w, "Internal Database Error - Please contact Febzey on Discord", http.StatusInternalServerError)
 		c.Logger.Error(err.Error())
 		return
 	}
 
-	defer rows.Close()
-
-	type TopStatistic struct {
-		Username  string      `json:"username"`
-		Statistic interface{} `json:"statistic"`
-	}
-
-	var topStatistics []TopStatistic
-
-	for rows.Next() {
-		var ts TopStatistic
-		var stat sql.RawBytes
-
-		err := rows.Scan(&ts.Username, &stat)
-		if err != nil {
-			http.Error(w, "Internal Database Error - Please contact Febzey on Discord", http.StatusInternalServerError)
-			c.Logger.Error(err.Error())
-			return
-		}
-
-		// Convert RawBytes to the appropriate data type based on the selected statistic
-		switch statistic {
-		case "playtime", "joins", "kills", "deaths":
-			ts.Statistic, err = strconv.Atoi(string(stat))
-			if err != nil {
-				http.Error(w, "Internal Database Error - Unable to convert statistic to integer", http.StatusInternalServerError)
-				c.Logger.Error(err.Error())
-				return
-			}
-		// Add additional cases if needed for other data types
-
-		default:
-			http.Error(w, "Internal Database Error - Unknown statistic type", http.StatusInternalServerError)
-			return
-		}
-
-		topStatistics = append(topStatistics, ts)
-	}
-
 	utils.RespondWithJSON(w, http.StatusOK, topStatistics)
 
 }
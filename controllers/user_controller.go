@@ -100,37 +100,15 @@ func (c *Controller) GetWhoIs(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	//SELECT username, description FROM whois WHERE username=? is our query
-
-	rows, err := c.Database.Query("SELECT username, description FROM whois WHERE username=?", username)
+	descriptions, err := c.Database.GetWhoisDescriptions(username)
 	if err != nil {
 		http.Error(w, "Internal Database Error - Please contact Febzey on Discord", http.StatusInternalServerError)
 		c.Logger.Error(err.Error())
 		return
 	}
 
-	defer rows.Close()
-
-	//we need to create a slice of strings to store the usernames in.
-	var usernames []string
-	var descriptions []string
-
-	//we need to loop through the rows and append the usernames to the slice.
-	for rows.Next() {
-		var username string
-		var description string
-		err := rows.Scan(&username, &description)
-		if err != nil {
-			http.Error(w, "Internal Database Error - Please contact Febzey on Discord", http.StatusInternalServerError)
-			c.Logger.Error(err.Error())
-			return
-		}
-		usernames = append(usernames, username)
-		descriptions = append(descriptions, description)
-	}
-
 	//we need to check if the slice is empty.
-	if len(usernames) == 0 {
+	if len(descriptions) == 0 {
 		http.Error(w, "No usernames found", http.StatusNotFound)
 		return
 	}
@@ -0,0 +1,164 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"time"
+)
+
+/******
+
+Delivery acknowledgements for write events.
+A bot can send an "event_id" (any unique string it generates) with a write event,
+once we are done with the event (saved to the database) we answer with "ack",
+or "nack" with an error code if something went wrong, so the bot knows if it should retry.
+
+Events without an event_id get the same "error" events as before, or structured
+error events on protocol version 2.
+
+******/
+
+// Error codes sent in nacks and structured error events.
+const (
+	//the data for the event was not in the right structure.
+	codeInvalidPayload = "invalid_payload"
+
+	//saving the event to the database failed, retrying may work.
+	codeDatabaseError = "database_error"
+
+	//the api key is not allowed to write data for the server.
+	codeServerNotAllowed = "server_not_allowed"
+
+	//the api key is missing the scope for the action.
+	codeMissingScope = "missing_scope"
+
+	//the api key is over its rate limit.
+	codeRateLimited = "rate_limited"
+
+	//the action does not exist.
+	codeUnknownAction = "unknown_action"
+
+	//the client is a standby bot, only the active bot for a server can write.
+	codeNotActiveBot = "not_active_bot"
+
+	//a discord message could not be sent in game, the server has no bot connected.
+	codeNoBotConnected = "no_bot_connected"
+
+	//the bot for the server is too far behind to take the discord message.
+	codeDeliveryFailed = "delivery_failed"
+)
+
+// An error returned by a websocket event handler.
+type EventError struct {
+	Code    string
+	Message string
+
+	//the field in the data that was wrong, for invalid_payload.
+	Field string
+
+	//if true, sending the same event again may work.
+	Retryable bool
+
+	//seconds to wait before retrying, for rate limits.
+	RetryAfter int
+
+	//events without an event_id get a structured error event if true,
+	//or the plain string error event we used to send if false.
+	structured bool
+}
+
+func (e *EventError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+// An error for a bad event payload.
+func invalidPayloadError(message string) *EventError {
+	return &EventError{Code: codeInvalidPayload, Message: message}
+}
+
+// An error for a failed database write, these can be retried.
+func databaseError(message string) *EventError {
+	return &EventError{Code: codeDatabaseError, Message: message, Retryable: true}
+}
+
+func rateLimitedError(retryAfter time.Duration) *EventError {
+	return &EventError{
+		Code:       codeRateLimited,
+		Message:    "Rate limit exceeded for your api key, this event was dropped.",
+		Retryable:  true,
+		RetryAfter: int(math.Ceil(retryAfter.Seconds())),
+		structured: true,
+	}
+}
+
+// The data for an ack event.
+type AckData struct {
+	EventID string `json:"event_id"`
+	Action  string `json:"action"`
+}
+
+// The data for a nack event.
+type NackData struct {
+	EventID    string `json:"event_id"`
+	Action     string `json:"action"`
+	Code       string `json:"code"`
+	Field      string `json:"field,omitempty"`
+	Message    string `json:"message"`
+	Retryable  bool   `json:"retryable"`
+	RetryAfter int    `json:"retry_after,omitempty"`
+}
+
+// Letting the client know how an event went.
+// With an event_id the client gets an ack (if ack is true for the action) or a nack,
+// without one, errors are sent as error events and successes are silent.
+// Protocol 1 clients get plain string errors for errors that are not structured.
+func (c *Controller) reportEventResult(message WebsocketEvent, ack bool, err error) {
+	if err == nil {
+		if ack && message.Event_id != "" {
+			c.sendMessageByStructure(message.Client_id, WebsocketEvent{
+				Client_id: message.Client_id,
+				Action:    "ack",
+				Data:      AckData{EventID: message.Event_id, Action: message.Action},
+			})
+		}
+		return
+	}
+
+	var eventErr *EventError
+	if !errors.As(err, &eventErr) {
+		eventErr = &EventError{Code: "internal_error", Message: err.Error(), Retryable: true}
+	}
+
+	if message.Event_id != "" {
+		c.sendMessageByStructure(message.Client_id, WebsocketEvent{
+			Client_id: message.Client_id,
+			Action:    "nack",
+			Data: NackData{
+				EventID:    message.Event_id,
+				Action:     message.Action,
+				Code:       eventErr.Code,
+				Field:      eventErr.Field,
+				Message:    eventErr.Message,
+				Retryable:  eventErr.Retryable,
+				RetryAfter: eventErr.RetryAfter,
+			},
+		})
+		return
+	}
+
+	errorData := WebsocketErrorData{
+		Code:       eventErr.Code,
+		Action:     message.Action,
+		Field:      eventErr.Field,
+		Message:    eventErr.Message,
+		RetryAfter: eventErr.RetryAfter,
+	}
+
+	if eventErr.structured {
+		c.sendStructuredErrorMessage(message.Client_id, errorData)
+		return
+	}
+
+	c.sendErrorMessage(message.Client_id, errorData)
+}
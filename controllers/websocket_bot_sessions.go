@@ -0,0 +1,153 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/febzey/ForestBot-Mainframe/database"
+	"github.com/febzey/ForestBot-Mainframe/utils"
+)
+
+/******
+
+Bot presence and uptime.
+When a server gets an active bot we broadcast "bot_online", when it loses it "bot_offline",
+and every stretch of time a bot was active is saved in the bot_sessions table.
+Stat consumers can use GET /bot/uptime to tell a gap in the data caused by the bot being
+down from a server that was just empty.
+
+A standby taking over ends one session and starts the next at the same time,
+so it does not show up as downtime.
+
+******/
+
+// How often open sessions are marked as still going.
+const botSessionHeartbeat = time.Minute
+
+// The data for the bot_online and bot_offline events.
+type BotPresenceData struct {
+	Server   string `json:"server"`
+	ClientID string `json:"client_id"`
+
+	//milliseconds, when the bot came online or went offline.
+	Timestamp int64 `json:"timestamp"`
+
+	//bot_online: the bot was a standby that took over.
+	Promoted bool `json:"promoted,omitempty"`
+
+	//bot_offline: the standby that took over, "" if the server has no bot now.
+	ReplacedBy string `json:"replaced_by,omitempty"`
+}
+
+// A bot going online or offline, saved and broadcast in order by runBotSessions.
+type botSessionEvent struct {
+	online bool
+	data   BotPresenceData
+}
+
+/*
+Saving bot sessions and broadcasting bot_online and bot_offline in a go routine of its own.
+Events are queued while holding the controllers mutex, in the order the bots came and went,
+so a session is never ended before it was started. Runs for as long as the program does.
+*/
+func (c *Controller) runBotSessions() {
+	// sessions still open were left by a crash, they ended when they were last seen.
+	if err := c.Database.CloseStaleBotSessions(); err != nil {
+		c.Logger.Error(err.Error())
+	}
+
+	ticker := time.NewTicker(botSessionHeartbeat)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case event := <-c.botSessions:
+			c.saveBotSession(event)
+
+		case now := <-ticker.C:
+			if err := c.Database.TouchBotSessions(now.UnixMilli()); err != nil {
+				c.Logger.Error(err.Error())
+			}
+		}
+	}
+}
+
+func (c *Controller) saveBotSession(event botSessionEvent) {
+	data := event.data
+
+	var err error
+	if event.online {
+		c.Logger.WebsocketConnect(fmt.Sprintf("Bot online for Minecraft Server: %s | ID: %s", data.Server, data.ClientID))
+		c.BroadcastMessageToClients(data.Server, WebsocketEvent{Action: "bot_online", Data: data})
+		err = c.Database.StartBotSession(data.Server, data.ClientID, data.Timestamp)
+	} else {
+		c.Logger.WebsocketDisconnect(fmt.Sprintf("Bot offline for Minecraft Server: %s | ID: %s", data.Server, data.ClientID))
+		c.BroadcastMessageToClients(data.Server, WebsocketEvent{Action: "bot_offline", Data: data})
+		err = c.Database.EndBotSession(data.ClientID, data.Timestamp)
+	}
+
+	if err != nil {
+		c.Logger.Error(err.Error())
+	}
+}
+
+func (c *Controller) queueBotSession(event botSessionEvent) {
+	select {
+	case c.botSessions <- event:
+	default:
+		c.Logger.Error(fmt.Sprintf("Bot session queue is full, session for %s (%s) was not saved", event.data.Server, event.data.ClientID))
+	}
+}
+
+// A bot became the active bot for its server, must be called while holding the controllers mutex.
+func (c *Controller) botOnline(server string, clientID string, promoted bool) {
+	c.queueBotSession(botSessionEvent{
+		online: true,
+		data:   BotPresenceData{Server: server, ClientID: clientID, Timestamp: time.Now().UnixMilli(), Promoted: promoted},
+	})
+}
+
+// The active bot for a server left, must be called while holding the controllers mutex.
+func (c *Controller) botOffline(server string, clientID string, replacedBy string) {
+	c.queueBotSession(botSessionEvent{
+		online: false,
+		data:   BotPresenceData{Server: server, ClientID: clientID, Timestamp: time.Now().UnixMilli(), ReplacedBy: replacedBy},
+	})
+}
+
+// METHOD: GET
+// PATH: /bot/uptime
+// QUERIES: server (optional), days (optional, default 7)
+// DESCRIPTION: How much of the last days each server had a bot collecting data.
+func (c *Controller) GetBotUptime(w http.ResponseWriter, r *http.Request) {
+	server := r.URL.Query().Get("server")
+
+	days := 7
+	if value := r.URL.Query().Get("days"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 || parsed > 365 {
+			http.Error(w, "Invalid 'days' parameter, must be 1 to 365", http.StatusBadRequest)
+			return
+		}
+		days = parsed
+	}
+
+	until := time.Now().UnixMilli()
+	since := until - int64(days)*int64(24*time.Hour/time.Millisecond)
+
+	uptimes, err := c.Database.GetBotUptime(server, since, until)
+	if err != nil {
+		c.Logger.Error(err.Error())
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	// a server that had no bot at all in the window.
+	if server != "" && len(uptimes) == 0 {
+		uptimes = append(uptimes, database.BotUptime{Server: server, WindowSeconds: (until - since) / 1000})
+	}
+
+	utils.RespondWithJSON(w, http.StatusOK, uptimes)
+}
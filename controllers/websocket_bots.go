@@ -0,0 +1,168 @@
+package controllers
+
+import (
+	"fmt"
+	"strings"
+)
+
+/******
+
+Bot failover.
+Every minecraft server has one active bot client, the one whose data we save,
+and up to WEBSOCKET_MAX_STANDBY_BOTS standby bots waiting to take over.
+
+Bots only take a slot once their api key is verified, so a socket that never
+authenticates can not take the active slot from a bot that is reconnecting.
+
+When the active bot disconnects (or stops answering pings and is reaped by the heartbeat),
+the standby that connected first is promoted and gets a "promoted" event.
+Standby bots stay connected and can read, but their write events are rejected
+until they are promoted, otherwise every event would be saved once per bot.
+
+******/
+
+// The bots connected for one mc server.
+type serverBots struct {
+	//client id of the active bot, "" if there is none.
+	active string
+
+	//client ids of the standby bots, in the order they connected.
+	standby []string
+}
+
+// Active and standby bots for every mc server.
+// must only be used while holding the controllers mutex.
+type botRegistry struct {
+	//key is the lowercase server name.
+	servers map[string]*serverBots
+
+	maxStandby int
+}
+
+// The data for the "standby" and "promoted" events.
+type BotRoleData struct {
+	Server  string `json:"server"`
+	Message string `json:"message"`
+}
+
+func newBotRegistry(maxStandby int) *botRegistry {
+	return &botRegistry{
+		servers:    make(map[string]*serverBots),
+		maxStandby: maxStandby,
+	}
+}
+
+// Registering a bot for a server.
+// Returns if the bot is the active one, ok is false if the server already has an active bot
+// and every standby slot is taken.
+func (b *botRegistry) register(mcServer string, clientID string) (active bool, ok bool) {
+	key := strings.ToLower(mcServer)
+
+	bots, exists := b.servers[key]
+	if !exists {
+		bots = &serverBots{}
+		b.servers[key] = bots
+	}
+
+	if bots.active == "" {
+		bots.active = clientID
+		return true, true
+	}
+
+	if len(bots.standby) >= b.maxStandby {
+		return false, false
+	}
+
+	bots.standby = append(bots.standby, clientID)
+	return false, true
+}
+
+// Removing a bot from its server.
+// If it was the active bot the first standby takes over, its client id is returned.
+func (b *botRegistry) remove(mcServer string, clientID string) (promoted string) {
+	key := strings.ToLower(mcServer)
+
+	bots, ok := b.servers[key]
+	if !ok {
+		return ""
+	}
+
+	if bots.active == clientID {
+		bots.active = ""
+		if len(bots.standby) > 0 {
+			bots.active = bots.standby[0]
+			bots.standby = bots.standby[1:]
+		}
+		promoted = bots.active
+	} else {
+		for i, id := range bots.standby {
+			if id == clientID {
+				bots.standby = append(bots.standby[:i], bots.standby[i+1:]...)
+				break
+			}
+		}
+	}
+
+	if bots.active == "" && len(bots.standby) == 0 {
+		delete(b.servers, key)
+	}
+
+	return promoted
+}
+
+// Checking if a server can take another bot, as the active bot or a standby.
+func (b *botRegistry) hasRoom(mcServer string) bool {
+	bots, ok := b.servers[strings.ToLower(mcServer)]
+	return !ok || bots.active == "" || len(bots.standby) < b.maxStandby
+}
+
+// Checking if a bot is the active one for its server.
+func (b *botRegistry) isActive(mcServer string, clientID string) bool {
+	bots, ok := b.servers[strings.ToLower(mcServer)]
+	return ok && bots.active == clientID
+}
+
+// Getting the client id of the active bot for a server, "" if there is none.
+func (b *botRegistry) activeFor(mcServer string) string {
+	bots, ok := b.servers[strings.ToLower(mcServer)]
+	if !ok {
+		return ""
+	}
+	return bots.active
+}
+
+// The event telling a bot another bot is active for its server.
+func standbyEvent(client *WebsocketClient) WebsocketEvent {
+	return WebsocketEvent{
+		Client_id: client.ClientID,
+		Action:    "standby",
+		Data: BotRoleData{
+			Server:  client.Mc_server,
+			Message: "Another bot is active for this server, you will get a 'promoted' event when it is your turn. Write events are rejected until then.",
+		},
+	}
+}
+
+// Telling a standby bot it is now the active bot for its server.
+// enqueue never blocks, so this is safe while holding the controllers mutex.
+func (c *Controller) sendPromoted(client *WebsocketClient) {
+	c.Logger.WebsocketConnect(fmt.Sprintf("Standby bot promoted for Minecraft Server: %s | ID: %s", client.Mc_server, client.ClientID))
+
+	client.enqueuePrivate(WebsocketEvent{
+		Client_id: client.ClientID,
+		Action:    "promoted",
+		Data: BotRoleData{
+			Server:  client.Mc_server,
+			Message: "You are now the active bot for this server.",
+		},
+	})
+}
+
+// An error for write events sent by a standby bot.
+func notActiveBotError(mcServer string) *EventError {
+	return &EventError{
+		Code:       codeNotActiveBot,
+		Message:    fmt.Sprintf("You are a standby bot for the server '%s', wait for the 'promoted' event before sending write events.", mcServer),
+		structured: true,
+	}
+}
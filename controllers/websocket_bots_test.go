@@ -0,0 +1,129 @@
+package controllers
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestBotRegistryRegister(t *testing.T) {
+	bots := newBotRegistry(2)
+
+	tests := []struct {
+		server     string
+		clientID   string
+		wantActive bool
+		wantOk     bool
+	}{
+		{"simplyvanilla", "a", true, true},
+		{"SimplyVanilla", "b", false, true},
+		{"simplyvanilla", "c", false, true},
+		{"simplyvanilla", "d", false, false},
+		{"2b2t", "e", true, true},
+	}
+
+	for _, test := range tests {
+		active, ok := bots.register(test.server, test.clientID)
+		if active != test.wantActive || ok != test.wantOk {
+			t.Errorf("register(%s, %s) = %v, %v, want %v, %v", test.server, test.clientID, active, ok, test.wantActive, test.wantOk)
+		}
+	}
+
+	if bots.hasRoom("SIMPLYVANILLA") {
+		t.Error("hasRoom with every standby slot taken = true")
+	}
+	if !bots.hasRoom("2b2t") || !bots.hasRoom("constantiam") {
+		t.Error("hasRoom for a server with free slots = false")
+	}
+	if !bots.isActive("simplyvanilla", "a") || bots.isActive("simplyvanilla", "b") {
+		t.Error("isActive does not match the first bot registered")
+	}
+}
+
+func TestBotRegistryWithoutStandby(t *testing.T) {
+	// WEBSOCKET_MAX_STANDBY_BOTS=0 is one bot per server, like before standby bots.
+	bots := newBotRegistry(0)
+
+	bots.register("simplyvanilla", "a")
+	if _, ok := bots.register("simplyvanilla", "b"); ok {
+		t.Error("second bot was registered without standby slots")
+	}
+	if bots.hasRoom("simplyvanilla") {
+		t.Error("hasRoom = true without standby slots")
+	}
+}
+
+func TestBotRegistryPromotion(t *testing.T) {
+	bots := newBotRegistry(3)
+	for _, id := range []string{"a", "b", "c", "d"} {
+		bots.register("simplyvanilla", id)
+	}
+
+	// a standby leaving does not change the active bot.
+	if promoted := bots.remove("simplyvanilla", "c"); promoted != "" {
+		t.Errorf("removing a standby promoted %q", promoted)
+	}
+
+	// the active bot disconnecting or being reaped, standbys take over in the order they connected.
+	for _, want := range []string{"b", "d", ""} {
+		active := bots.servers["simplyvanilla"].active
+		if promoted := bots.remove("SimplyVanilla", active); promoted != want {
+			t.Fatalf("removing %s promoted %q, want %q", active, promoted, want)
+		}
+		if want != "" && !bots.isActive("simplyvanilla", want) {
+			t.Errorf("%s is not active after being promoted", want)
+		}
+	}
+
+	if _, ok := bots.servers["simplyvanilla"]; ok {
+		t.Error("server without bots was not removed")
+	}
+	if promoted := bots.remove("simplyvanilla", "a"); promoted != "" {
+		t.Errorf("removing from a server without bots promoted %q", promoted)
+	}
+}
+
+func TestBotRegistryStandbyOrder(t *testing.T) {
+	bots := newBotRegistry(3)
+	for _, id := range []string{"a", "b", "c", "d"} {
+		bots.register("simplyvanilla", id)
+	}
+
+	bots.remove("simplyvanilla", "b")
+
+	if got := bots.servers["simplyvanilla"].standby; !reflect.DeepEqual(got, []string{"c", "d"}) {
+		t.Errorf("standby = %v, want [c d]", got)
+	}
+
+	// the freed slot can be taken again.
+	if active, ok := bots.register("simplyvanilla", "e"); active || !ok {
+		t.Errorf("register after a standby left = %v, %v, want a standby", active, ok)
+	}
+}
+
+func TestRemoveActiveBotPromotesStandby(t *testing.T) {
+	c := newTestController(t, WebsocketConfig{EgressQueueSize: 1})
+
+	for _, id := range []string{"a", "b"} {
+		bot := newTestClient(c, id)
+		bot.IsMcClient = true
+		bot.Mc_server = "simplyvanilla"
+		c.bots.register("simplyvanilla", id)
+	}
+	standby := c.Clients["b"]
+
+	// the promoted event is queued while removing holds the controller lock, nothing is written to a connection.
+	c.removeWebSocketClient("a")
+
+	select {
+	case message := <-standby.Egress:
+		if message.event.Action != "promoted" || !message.private {
+			t.Errorf("standby got %+v, want a promoted event for it only", message.event)
+		}
+	default:
+		t.Fatal("standby was not told it was promoted")
+	}
+
+	if !c.bots.isActive("simplyvanilla", "b") {
+		t.Error("standby is not active after the active bot was removed")
+	}
+}
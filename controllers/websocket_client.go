@@ -1,9 +1,12 @@
 package controllers
 
 import (
-	"encoding/json"
+	"errors"
 	"fmt"
+	"net"
 	"net/http"
+	"sync"
+	"time"
 
 	"github.com/febzey/ForestBot-Mainframe/keyservice"
 	"github.com/febzey/ForestBot-Mainframe/utils"
@@ -22,9 +25,10 @@ type WebsocketClient struct {
 	ClientID string
 
 	// Here is the users api key, some contact info, created date, permissions.
-	// This struct will become populated once the user sends their api key
-	// using the "x-api-key" message event and the key is verified successfully.
+	// This struct is populated when the key is sent with the upgrade request,
+	// or once the user sends their api key using the "x-api-key" message event and the key is verified successfully.
 	// if the key does not exist, the client will not be able to read/write data.
+	// replaced while holding the controllers mutex, the clients own go routines use apiKey().
 	Key *keyservice.APIkey
 
 	//The minecraft server the websocket is being used for.
@@ -33,18 +37,16 @@ type WebsocketClient struct {
 	//since all messages are sent from one pipeline anywas
 	Mc_server string
 
-	//Perhaps add a list of servers a regular client would want to listen for?
-	//if the option is "all", we will loop through active connections, and add each mc_server to this list
-	//or the client can specifiy individual servers to listen for, we would then do a check to see if that server exists.
-	//Design choice: Option A: add this as a optional query parameter. Option B: add a event option the user can send later as a "command".
-	//we will implement this if the websocket server becomes overwhelemed with broadcasts. (which it will with our current setup.)
-	//ListeningServers []string
+	//The mc servers and actions the client wants broadcasted to it.
+	//set with the "servers" and "actions" url queries, or the subscribe and unsubscribe actions.
+	//only read or change this while holding the controllers mutex.
+	Subscriptions *Subscriptions
 
 	//Determine if this client is an active minecraft bot.
 	//Mc Clients are essential for this entire project,
 	//they will take first priority when needed.
 	//these are the actual bots that will be in minecraft servers collecting data
-	//There can only be 1 mc-client to 1 mc_server
+	//There can only be 1 active mc-client to 1 mc_server, other bots for the server wait as standbys.
 	//if a user wants to read messages for a certain mc server without being a bot,
 	//simply just do not register your self as a bot client in the url queries
 	IsMcClient bool
@@ -52,21 +54,54 @@ type WebsocketClient struct {
 	//The websocket connection for the client.
 	Conn *websocket.Conn
 
+	//The ip address the client connected from, used to track failed key attempts.
+	RemoteIP string
+
+	//The websocket protocol version the client asked for with the "protocol" url query.
+	//set when the client connects, 1 if it did not ask for one.
+	Protocol int
+
 	//egress channel for outbound websocket messages (messages that we send back to the client)
 	//we have a go routine running that listens to this channel and will send messages accordingly.
-	Egress chan WebsocketEvent
+	//the channel is bounded, messages are added with enqueue which never blocks.
+	Egress chan *outboundMessage
+
+	//How messages to and from the client are encoded, picked with the subprotocol when connecting.
+	Encoding Encoding
+
+	//closed when the client is removed, stops the write go routine.
+	done      chan struct{}
+	closeOnce sync.Once
+
+	//only one go routine can write to the connection at a time.
+	writeMu sync.Mutex
+
+	//messages dropped because the egress queue was full.
+	dropped int64
 
 	//A pointer to our programs Controller
 	Controller *Controller
 }
 
+// The subprotocol we answer with, clients sending their key as a
+// subprotocol should also offer this one so browsers accept the handshake.
+const websocketSubprotocol = "forestbot"
+
+// Prefix for sending the api key as a subprotocol, example: "apikey.your-key"
+const apiKeySubprotocolPrefix = "apikey."
+
 /*
-Some settings for our websocket behaviour
+Some settings for our websocket behaviour.
+The binary encodings come first, so a client offering one of them and "forestbot" gets the binary one.
 */
-var upgrader = websocket.Upgrader{
-	ReadBufferSize:  1024,
-	WriteBufferSize: 1024,
-	CheckOrigin:     func(*http.Request) bool { return true },
+func newUpgrader(config WebsocketConfig) websocket.Upgrader {
+	return websocket.Upgrader{
+		ReadBufferSize:    1024,
+		WriteBufferSize:   1024,
+		CheckOrigin:       func(*http.Request) bool { return true },
+		Subprotocols:      []string{msgpackSubprotocol, cborSubprotocol, websocketSubprotocol},
+		EnableCompression: config.Compression,
+	}
 }
 
 /*
@@ -75,46 +110,31 @@ var upgrader = websocket.Upgrader{
 initializing our websocket client
 when the user connects, this function will
 generate their unique client_id then send the client_id back to the user for the user to store and send with each message.
-api key is sent in a seperate event message, after the client_id is sent back to the user.
+key is the api key verified during the upgrade, or nil if the client will send it
+in a seperate event message, after the client_id is sent back to the user.
 *
 */
-func NewWebsocketClient(conn *websocket.Conn, mc_server string, isBot string, c *Controller) *WebsocketClient {
-	c.Mutex.Lock()
-	defer c.Mutex.Unlock()
+func NewWebsocketClient(conn *websocket.Conn, mc_server string, isBot string, key *keyservice.APIkey, c *Controller) *WebsocketClient {
+	// every message, even these first ones, is sent in the encoding the client asked for.
+	encoding := encodingForSubprotocol(conn.Subprotocol())
 
 	//
 	//Checking if the connecting client is a mc bot
 	//
 	if isBot == "true" {
 		if mc_server == "" {
-			if err := conn.WriteJSON(WebsocketEvent{
-				Client_id: "",
-				Action:    "error",
-				Data:      "When registering as a bot-client, you must provide a server your bot associates with.",
-			}); err != nil {
-				c.Logger.WebsocketError("Error sending message to client.")
-			}
-			conn.Close()
+			c.rejectWebsocketConnection(conn, encoding, "When registering as a bot-client, you must provide a server your bot associates with.")
 			return nil
 		}
 
-		// checking if a bot client already exists for this mc_serverss
-		for _, client := range c.Clients {
-			if client.Mc_server == mc_server && client.IsMcClient {
-				//a user is trying to connect as a bot client, but a
-				//bot client already exists for this mc_server
-				if err := conn.WriteJSON(WebsocketEvent{
-					Client_id: "",
-					Action:    "error",
-					Data:      "A mc client already exists and is running for this minecraft server, if you still want to listen to the traffic, then take away the is-bot-client from your query",
-				}); err != nil {
-					c.Logger.WebsocketError("Error sending message to client.")
-				}
-				conn.Close()
-				return nil
-			}
+		// a bot client can only register for a server its key is scoped to.
+		if key != nil && !key.AllowsServer(mc_server) {
+			c.rejectWebsocketConnection(conn, encoding, WebsocketErrorData{
+				Code:    "server_not_allowed",
+				Message: fmt.Sprintf("Your api key is not allowed to be used for the server '%s'.", mc_server),
+			})
+			return nil
 		}
-
 	}
 
 	//
@@ -123,29 +143,13 @@ func NewWebsocketClient(conn *websocket.Conn, mc_server string, isBot string, c
 	client_id, err := utils.RandomUUID()
 	if err != nil {
 		fmt.Println(err.Error())
-		err := conn.WriteJSON(WebsocketEvent{
-			Client_id: client_id,
-			Action:    "error",
-			Data:      "Error generating client_id - Internal server error",
-		})
-		if err != nil {
-			c.Logger.WebsocketError("Error sending message to client after uuid failed to generate.")
-		}
-		conn.Close()
+		c.rejectWebsocketConnection(conn, encoding, "Error generating client_id - Internal server error")
 		return nil
 	}
 
-	//
-	//Sending the recenetly generated client_id back to the client so they can store it to use in future messages
-	//
-	if err := conn.WriteJSON(WebsocketEvent{
-		Client_id: client_id,
-		Action:    "id",
-		Data:      client_id,
-	}); err != nil {
-		c.Logger.Error("Failed to send generated uuid back to client. Closing connection.")
-		conn.Close()
-		return nil
+	authenticated := key != nil
+	if !authenticated {
+		key = &keyservice.APIkey{}
 	}
 
 	//
@@ -155,18 +159,80 @@ func NewWebsocketClient(conn *websocket.Conn, mc_server string, isBot string, c
 		ClientID:   client_id,
 		Conn:       conn,
 		Mc_server:  mc_server,
-		Egress:     make(chan WebsocketEvent),
+		Egress:     make(chan *outboundMessage, c.Config.EgressQueueSize),
+		Encoding:   encoding,
+		done:       make(chan struct{}),
 		Controller: c,
-		Key:        &keyservice.APIkey{},
+		Key:        key,
 		IsMcClient: isBot == "true",
+
+		Protocol:      minProtocolVersion,
+		Subscriptions: NewSubscriptions(),
+	}
+
+	//
+	//Sending the client_id back to the client so they can store it to use in future messages,
+	//and letting the client know the key from their upgrade request was accepted.
+	//
+	welcome := []WebsocketEvent{{
+		Client_id: client_id,
+		Action:    "id",
+		Data:      client_id,
+	}}
+	if authenticated {
+		welcome = append(welcome, WebsocketEvent{
+			Client_id: client_id,
+			Action:    "key-accepted",
+			Data:      "Authenticated successfully. Welcome to the ForestBot Control Server",
+		})
+	}
+
+	c.Mutex.Lock()
+
+	// checking if the server already has an active bot and every standby slot is taken.
+	if client.IsMcClient && !c.bots.hasRoom(mc_server) {
+		c.Mutex.Unlock()
+
+		//a user is trying to connect as a bot client, but a
+		//bot client already exists for this mc_server
+		c.rejectWebsocketConnection(conn, encoding, "A mc client already exists and is running for this minecraft server, and there is no room for another standby bot. if you still want to listen to the traffic, then take away the is-bot-client from your query")
+		return nil
+	}
+
+	//
+	//Registering bot clients that authenticated with the upgrade, the first bot for a server is active,
+	//the others wait as standbys. Bots using the x-api-key event are registered once their key is verified.
+	//
+	if client.IsMcClient && authenticated {
+		active, _ := c.bots.register(mc_server, client_id)
+		if active {
+			//letting everyone know the server has a bot collecting data again.
+			c.botOnline(mc_server, client_id, false)
+		} else {
+			welcome = append(welcome, standbyEvent(client))
+		}
 	}
 
 	//
 	//Adding the websocket client to our clients map inside of the Controller Struct
 	//
-	//c.Mutex.Lock()
 	c.Clients[client_id] = client
-	//c.Mutex.Unlock()
+
+	c.KeyService.ConnectionOpened(*key)
+
+	c.Mutex.Unlock()
+
+	//
+	//The write go routine is not running yet, so the welcome messages are the first ones the client gets.
+	//They are written after the lock is released, a client that stops reading only holds up its own connection.
+	//
+	for _, message := range welcome {
+		if err := client.writeEvent(message); err != nil {
+			c.Logger.Error("Failed to send welcome messages to client. Closing connection.")
+			c.removeWebSocketClient(client_id)
+			return nil
+		}
+	}
 
 	//
 	//Returning our newly creating client instance since all checks have passed!
@@ -175,6 +241,28 @@ func NewWebsocketClient(conn *websocket.Conn, mc_server string, isBot string, c
 
 }
 
+// Telling a client why it can not connect and closing the connection,
+// only used before the client is created.
+func (c *Controller) rejectWebsocketConnection(conn *websocket.Conn, encoding Encoding, data interface{}) {
+	if err := writeEncoded(conn, encoding, WebsocketEvent{
+		Client_id: "",
+		Action:    "error",
+		Data:      data,
+	}); err != nil {
+		c.Logger.WebsocketError("Error sending message to client.")
+	}
+	conn.Close()
+}
+
+// A copy of the clients api key, read while holding the controllers mutex
+// since the key is replaced when the client authenticates.
+func (ws *WebsocketClient) apiKey() keyservice.APIkey {
+	ws.Controller.Mutex.Lock()
+	defer ws.Controller.Mutex.Unlock()
+
+	return *ws.Key
+}
+
 /*
 Go routine for reading messages per client
 for the server to even read their message content, they need to have a proper write api key.
@@ -186,40 +274,76 @@ func (ws *WebsocketClient) readMessages() {
 		ws.Controller.removeWebSocketClient(ws.ClientID)
 	}()
 
+	//
+	//The client has to answer our pings (or send messages) before the read deadline,
+	//otherwise the read fails and the client is removed. This is how we find half open connections.
+	//
+	pongTimeout := ws.Controller.Config.PongTimeout
+	if ws.Controller.Config.PingInterval > 0 {
+		ws.Conn.SetReadDeadline(time.Now().Add(pongTimeout))
+		ws.Conn.SetPongHandler(func(string) error {
+			return ws.Conn.SetReadDeadline(time.Now().Add(pongTimeout))
+		})
+	}
+
 	for {
 		//
 		//Read raw incoming data.
 		//
-		_, p, err := ws.Conn.ReadMessage()
+		messageType, p, err := ws.Conn.ReadMessage()
 		if err != nil {
-			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				ws.Controller.Logger.WebsocketDisconnect(fmt.Sprintf("Websocket timed out, no pong in %s, client_id: %s", pongTimeout, ws.ClientID))
+			} else if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
 				ws.Controller.Logger.WebsocketDisconnect(fmt.Sprintf("Websocket disconnected: Error: %s, client_id: %s \n", err, ws.ClientID))
 			}
 			break
 		}
 
+		if ws.Controller.Config.PingInterval > 0 {
+			ws.Conn.SetReadDeadline(time.Now().Add(pongTimeout))
+		}
+
 		//
 		//Attempting to decode the websocket message into our desired message structure.
 		//Here is where we check if the message sent has the proper WebsocketEvent structure.
 		//
 		var recievedMessage WebsocketEvent
-		if err := json.Unmarshal(p, &recievedMessage); err != nil {
+		if err := decodeEvent(ws.Encoding, messageType, p, &recievedMessage); err != nil {
 			ws.Controller.Logger.WebsocketError(err.Error())
-			ws.Controller.sendErrorMessage(ws.ClientID, "Invalid message structure")
+			ws.Controller.sendErrorMessage(ws.ClientID, WebsocketErrorData{
+				Code:    "invalid_message",
+				Message: "Invalid message structure",
+			})
 			continue
 		}
 
 		// For other actions, check if API key is registered.
-		if ws.Key.Key == "" && recievedMessage.Action != "x-api-key" {
-			ws.Controller.sendErrorMessage(ws.ClientID, "You need to register your API key with the 'x-api-key' event action")
+		key := ws.apiKey()
+		if key.Key == "" && recievedMessage.Action != "x-api-key" {
+			// written straight to the connection since the client is removed right after,
+			// this is the clients own read go routine so nobody else waits on the write.
+			ws.writeEvent(errorEvent(ws, WebsocketErrorData{
+				Code:    "not_authenticated",
+				Action:  recievedMessage.Action,
+				Message: "You need to register your API key with the 'x-api-key' event action",
+			}))
 			break
 		}
 
-		// Check for write permissions, if the action is not a client submitting their api key
-		if !ws.Key.Permissions.Write && recievedMessage.Action != "x-api-key" {
-			ws.Controller.sendErrorMessage(ws.ClientID, "No write permissions for your API key.")
-			break
+		// Scopes for each action are checked in ProcessWebsocketEvent.
+		// Every accepted event counts towards the key's rate limit,
+		// the counter is shared by every connection using the same key.
+		if recievedMessage.Action != "x-api-key" {
+			if allowed, retryAfter := ws.Controller.KeyService.Limiter.Allow(key); !allowed {
+				ws.Controller.reportEventResult(recievedMessage, true, rateLimitedError(retryAfter))
+				continue
+			}
+
+			ws.Controller.KeyService.RecordWrite(key, 1)
 		}
+
 		//
 		//Send data to our websocket message channel
 		//for proccessing in the ProccessWebsocketEvent go routine
@@ -236,33 +360,72 @@ func (ws *WebsocketClient) readMessages() {
 Go routine for sending messages.
 we will constantly read our egress channel and send messages
 each client will have their own egress.
-for now all of our messages will be sent as json since our event structure uses json
+messages are sent in the clients encoding, json unless it asked for msgpack or cbor
 Server -> Client
 */
 func (ws *WebsocketClient) writeMessages() {
+	//
+	//Pinging the client every interval, a nil channel never fires when pings are disabled.
+	//
+	var ping <-chan time.Time
+	if ws.Controller.Config.PingInterval > 0 {
+		ticker := time.NewTicker(ws.Controller.Config.PingInterval)
+		defer ticker.Stop()
+		ping = ticker.C
+	}
+
 	defer func() {
 		ws.Controller.removeWebSocketClient(ws.ClientID)
 	}()
 
-	for message := range ws.Egress {
+	// a client authenticates once and keeps the same key hash until it is removed,
+	// so the key only has to be looked up again until it is set.
+	var key keyservice.APIkey
+
+	for {
+		var message *outboundMessage
+		select {
+		case message = <-ws.Egress:
+		case <-ping:
+			// WriteControl is safe to call alongside other writes.
+			var deadline time.Time
+			if timeout := ws.Controller.Config.WriteTimeout; timeout > 0 {
+				deadline = time.Now().Add(timeout)
+			}
+
+			if err := ws.Conn.WriteControl(websocket.PingMessage, nil, deadline); err != nil {
+				return
+			}
+			continue
+		case <-ws.done:
+			return
+		}
 
 		// Ignoring clients who have not submitted their key, to avoid them seeing data without authenticating
 		// sort of seems our authentication all leads up to this one if statement lol.
 		// THE GREAT WALL OF CHINA - (if ur not authenticated lel)
-		if ws.Key.Key == "" {
-			continue
+		// errors and other messages meant only for this client still get through.
+		if key.Key == "" && !message.private {
+			if key = ws.apiKey(); key.Key == "" {
+				continue
+			}
 		}
 
-		if message.Action == "" {
-			if err := ws.Conn.WriteMessage(websocket.CloseMessage, nil); err != nil {
-				break
-			}
+		if message.event.Action == "" {
+			ws.writeMu.Lock()
+			ws.setWriteDeadline()
+			ws.Conn.WriteMessage(websocket.CloseMessage, nil)
+			ws.writeMu.Unlock()
 			return
 		}
 
-		if err := ws.Conn.WriteJSON(message); err != nil {
+		// a failed write (or one past the write deadline) means the connection is gone.
+		if err := ws.writeOutbound(message); err != nil {
 			ws.Controller.Logger.WebsocketError(err.Error())
+			return
 		}
+
+		ws.Controller.KeyService.RecordRead(key, 1)
 	}
 
 }
@@ -0,0 +1,348 @@
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/febzey/ForestBot-Mainframe/middleware"
+	"github.com/febzey/ForestBot-Mainframe/utils"
+	"github.com/mitchellh/mapstructure"
+)
+
+/******
+
+Commands for minecraft bots.
+The mainframe can tell the active bot of a server to do something in game,
+like saying a chat line or whispering a player, with the "bot_command" event:
+
+{ "action": "bot_command", "data": { "id": "generated id", "command": "whisper", "args": { "username": "febzey", "message": "hi" }, "timeout": 10 } }
+
+the bot does it and answers with "bot_command_result" using the same id:
+
+{ "action": "bot_command_result", "data": { "id": "generated id", "ok": true, "result": { ... } } }
+
+If the bot does not answer within the timeout, or disconnects first, the command fails.
+Commands are sent with POST /bot/command, by tools with a key that has the bot:command scope.
+
+******/
+
+// The longest a command can wait for its result.
+const maxBotCommandTimeout = 60 * time.Second
+
+var (
+	ErrNoBotConnected    = errors.New("no bot is connected for the server")
+	ErrBotCommandTimeout = errors.New("the bot did not answer the command in time")
+	ErrBotDisconnected   = errors.New("the bot disconnected before answering the command")
+	ErrBotNotKeepingUp   = errors.New("the bot is not keeping up, the command was not sent")
+)
+
+// The data for the bot_command event.
+type BotCommand struct {
+	//id we generate, the bot sends it back with the result.
+	ID string `json:"id"`
+
+	//the command, example: say
+	Command string `json:"command"`
+
+	//arguments for the command, see botCommands.
+	Args map[string]string `json:"args"`
+
+	//seconds the bot has to answer.
+	Timeout int `json:"timeout"`
+}
+
+// The data for the bot_command_result event.
+type BotCommandResult struct {
+	ID      string      `json:"id"`
+	Command string      `json:"command"`
+	Ok      bool        `json:"ok"`
+	Result  interface{} `json:"result,omitempty"`
+	Error   string      `json:"error,omitempty"`
+}
+
+// Errors for commands with an unknown name or missing arguments.
+type invalidBotCommandError struct {
+	message string
+}
+
+func (e *invalidBotCommandError) Error() string {
+	return e.message
+}
+
+// A command a bot can be sent.
+type botCommandSpec struct {
+	//arguments that must be given.
+	required []string
+
+	//arguments that are said in game, these are cleaned up like discord messages.
+	chat []string
+}
+
+/*
+Every command bots understand.
+
+say: says a chat line.
+whisper: whispers a player (/msg).
+status: reports the bots status, result is up to the bot (health, position, ping...).
+*/
+var botCommands = map[string]botCommandSpec{
+	"say": {
+		required: []string{"message"},
+		chat:     []string{"message"},
+	},
+	"whisper": {
+		required: []string{"username", "message"},
+		chat:     []string{"message"},
+	},
+	"status": {},
+}
+
+// Commands waiting for a result from a bot.
+type commandTracker struct {
+	pending map[string]*pendingCommand
+	mu      sync.Mutex
+}
+
+type pendingCommand struct {
+	//the bot the command was sent to, only it can answer.
+	clientID string
+
+	command string
+
+	outcome chan commandOutcome
+}
+
+// The result for a pending command, or why it failed.
+type commandOutcome struct {
+	result BotCommandResult
+	err    error
+}
+
+func newCommandTracker() *commandTracker {
+	return &commandTracker{pending: make(map[string]*pendingCommand)}
+}
+
+func (t *commandTracker) add(id string, command *pendingCommand) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.pending[id] = command
+}
+
+func (t *commandTracker) remove(id string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.pending, id)
+}
+
+// Giving a pending command its result, false if the command is not waiting
+// or was sent to a different client.
+func (t *commandTracker) resolve(clientID string, result BotCommandResult) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	command, ok := t.pending[result.ID]
+	if !ok || command.clientID != clientID {
+		return false
+	}
+
+	delete(t.pending, result.ID)
+	result.Command = command.command
+	command.outcome <- commandOutcome{result: result}
+
+	return true
+}
+
+// Failing every command waiting on a client, when it disconnects.
+func (t *commandTracker) failClient(clientID string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for id, command := range t.pending {
+		if command.clientID == clientID {
+			delete(t.pending, id)
+			command.outcome <- commandOutcome{err: ErrBotDisconnected}
+		}
+	}
+}
+
+// Checking a commands arguments, and cleaning up the ones said in game.
+func validateBotCommand(command string, args map[string]string, maxLength int) (map[string]string, error) {
+	spec, ok := botCommands[command]
+	if !ok {
+		names := []string{}
+		for name := range botCommands {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		return nil, &invalidBotCommandError{fmt.Sprintf("Unknown command '%s', must be one of: %s", command, strings.Join(names, ", "))}
+	}
+
+	cleaned := make(map[string]string)
+	for name, value := range args {
+		cleaned[name] = value
+	}
+
+	for _, name := range spec.chat {
+		cleaned[name] = sanitizeMinecraftChat(cleaned[name], maxLength)
+	}
+
+	for _, name := range spec.required {
+		if strings.TrimSpace(cleaned[name]) == "" {
+			return nil, &invalidBotCommandError{fmt.Sprintf("The '%s' argument is required for the '%s' command", name, command)}
+		}
+	}
+
+	return cleaned, nil
+}
+
+/*
+Sending a command to the active bot of a server and waiting for its result.
+A timeout of 0 uses WEBSOCKET_BOT_COMMAND_TIMEOUT_SECONDS.
+*/
+func (c *Controller) SendBotCommand(mcServer string, command string, args map[string]string, timeout time.Duration) (BotCommandResult, error) {
+	args, err := validateBotCommand(command, args, c.Config.DiscordBridgeMaxLength)
+	if err != nil {
+		return BotCommandResult{}, err
+	}
+
+	if timeout <= 0 {
+		timeout = c.Config.BotCommandTimeout
+	}
+	if timeout > maxBotCommandTimeout {
+		timeout = maxBotCommandTimeout
+	}
+
+	c.Mutex.Lock()
+	var bot *WebsocketClient
+	if botID := c.bots.activeFor(mcServer); botID != "" {
+		bot = c.Clients[botID]
+	}
+	c.Mutex.Unlock()
+
+	if bot == nil {
+		return BotCommandResult{}, ErrNoBotConnected
+	}
+
+	id, err := utils.RandomUUID()
+	if err != nil {
+		return BotCommandResult{}, err
+	}
+
+	pending := &pendingCommand{clientID: bot.ClientID, command: command, outcome: make(chan commandOutcome, 1)}
+	c.commands.add(id, pending)
+
+	if !bot.enqueue(WebsocketEvent{
+		Client_id: bot.ClientID,
+		Action:    "bot_command",
+		Data: BotCommand{
+			ID:      id,
+			Command: command,
+			Args:    args,
+			Timeout: int(timeout.Seconds()),
+		},
+	}) {
+		c.commands.remove(id)
+		return BotCommandResult{}, ErrBotNotKeepingUp
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case outcome := <-pending.outcome:
+		return outcome.result, outcome.err
+	case <-timer.C:
+		c.commands.remove(id)
+		return BotCommandResult{}, ErrBotCommandTimeout
+	}
+}
+
+/*
+* Handling bot_command_result, a bot answering a command we sent it.
+ */
+func (c *Controller) handleBotCommandResult(message WebsocketEvent) error {
+	var result BotCommandResult
+	if err := mapstructure.Decode(message.Data, &result); err != nil || result.ID == "" {
+		return invalidPayloadError("Invalid message structure for bot_command_result, 'id' and 'ok' are required")
+	}
+
+	if !c.commands.resolve(message.Client_id, result) {
+		return &EventError{
+			Code:       codeInvalidPayload,
+			Message:    fmt.Sprintf("No command with the id '%s' is waiting for a result from you, it may have timed out.", result.ID),
+			Field:      "id",
+			structured: true,
+		}
+	}
+
+	return nil
+}
+
+// The body for POST /bot/command.
+type BotCommandRequest struct {
+	Server  string            `json:"server"`
+	Command string            `json:"command"`
+	Args    map[string]string `json:"args"`
+
+	//seconds to wait for the bot, optional.
+	Timeout int `json:"timeout"`
+}
+
+// METHOD: POST
+// PATH: /bot/command
+// DESCRIPTION: Sends a command to the active bot of a server and responds with its result.
+func (c *Controller) PostBotCommand(w http.ResponseWriter, r *http.Request) {
+	key, ok := middleware.APIKeyFromRequest(r)
+	if !ok {
+		http.Error(w, "Missing api key", http.StatusUnauthorized)
+		return
+	}
+
+	var req BotCommandRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON format", http.StatusBadRequest)
+		return
+	}
+
+	if req.Server == "" || req.Command == "" {
+		http.Error(w, "'server' and 'command' are required", http.StatusBadRequest)
+		return
+	}
+
+	if !key.AllowsServer(req.Server) {
+		http.Error(w, fmt.Sprintf("Your api key is not allowed to be used for the server '%s'", req.Server), http.StatusForbidden)
+		return
+	}
+
+	result, err := c.SendBotCommand(req.Server, req.Command, req.Args, time.Duration(req.Timeout)*time.Second)
+	if err != nil {
+		var invalidErr *invalidBotCommandError
+		switch {
+		case errors.As(err, &invalidErr):
+			http.Error(w, invalidErr.message, http.StatusBadRequest)
+		case errors.Is(err, ErrNoBotConnected):
+			http.Error(w, fmt.Sprintf("No bot is connected for the server '%s'", req.Server), http.StatusServiceUnavailable)
+		case errors.Is(err, ErrBotCommandTimeout):
+			http.Error(w, err.Error(), http.StatusGatewayTimeout)
+		case errors.Is(err, ErrBotDisconnected), errors.Is(err, ErrBotNotKeepingUp):
+			http.Error(w, err.Error(), http.StatusBadGateway)
+		default:
+			c.Logger.Error(err.Error())
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	c.Logger.WebsocketInfo(fmt.Sprintf("Bot command '%s' sent to %s, ok: %t", req.Command, req.Server, result.Ok))
+
+	utils.RespondWithJSON(w, http.StatusOK, result)
+}
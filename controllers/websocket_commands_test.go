@@ -0,0 +1,210 @@
+package controllers
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/febzey/ForestBot-Mainframe/keyservice"
+	"github.com/febzey/ForestBot-Mainframe/middleware"
+)
+
+func TestCommandTrackerResolve(t *testing.T) {
+	tracker := newCommandTracker()
+	pending := &pendingCommand{clientID: "bot", command: "status", outcome: make(chan commandOutcome, 1)}
+	tracker.add("1", pending)
+
+	if tracker.resolve("other-bot", BotCommandResult{ID: "1", Ok: true}) {
+		t.Error("resolve from a client the command was not sent to = true")
+	}
+	if tracker.resolve("bot", BotCommandResult{ID: "2", Ok: true}) {
+		t.Error("resolve for an id that is not waiting = true")
+	}
+	if _, ok := tracker.pending["1"]; !ok {
+		t.Fatal("the command stopped waiting after a wrong result")
+	}
+
+	if !tracker.resolve("bot", BotCommandResult{ID: "1", Ok: true}) {
+		t.Fatal("resolve from the right client = false")
+	}
+
+	outcome := <-pending.outcome
+	if outcome.err != nil || !outcome.result.Ok || outcome.result.Command != "status" {
+		t.Errorf("outcome = %+v, want ok for the status command", outcome)
+	}
+
+	if tracker.resolve("bot", BotCommandResult{ID: "1", Ok: true}) {
+		t.Error("resolving the same command twice = true")
+	}
+}
+
+func TestCommandTrackerFailClient(t *testing.T) {
+	tracker := newCommandTracker()
+
+	commands := map[string]*pendingCommand{
+		"1": {clientID: "bot", outcome: make(chan commandOutcome, 1)},
+		"2": {clientID: "bot", outcome: make(chan commandOutcome, 1)},
+		"3": {clientID: "other-bot", outcome: make(chan commandOutcome, 1)},
+	}
+	for id, command := range commands {
+		tracker.add(id, command)
+	}
+
+	tracker.failClient("bot")
+
+	for _, id := range []string{"1", "2"} {
+		select {
+		case outcome := <-commands[id].outcome:
+			if !errors.Is(outcome.err, ErrBotDisconnected) {
+				t.Errorf("command %s failed with %v, want ErrBotDisconnected", id, outcome.err)
+			}
+		default:
+			t.Errorf("command %s was not failed", id)
+		}
+	}
+
+	if len(commands["3"].outcome) != 0 {
+		t.Error("a command for another bot was failed")
+	}
+	if len(tracker.pending) != 1 {
+		t.Errorf("%d commands still waiting, want 1", len(tracker.pending))
+	}
+}
+
+func TestValidateBotCommand(t *testing.T) {
+	tests := []struct {
+		name    string
+		command string
+		args    map[string]string
+		want    map[string]string
+		wantErr string
+	}{
+		{"say", "say", map[string]string{"message": "hi"}, map[string]string{"message": "hi"}, ""},
+		{"chat is cleaned", "say", map[string]string{"message": "§ahi\n/op me"}, map[string]string{"message": "hi /op me"}, ""},
+		{"chat is cut to the max length", "say", map[string]string{"message": strings.Repeat("a", 30)}, map[string]string{"message": strings.Repeat("a", 17) + "..."}, ""},
+		{"only chat args are cleaned", "whisper", map[string]string{"username": "§afebzey", "message": "hi"}, map[string]string{"username": "§afebzey", "message": "hi"}, ""},
+		{"no args", "status", nil, map[string]string{}, ""},
+		{"unknown command", "op", nil, nil, "Unknown command 'op', must be one of: say, status, whisper"},
+		{"missing arg", "whisper", map[string]string{"message": "hi"}, nil, "The 'username' argument is required for the 'whisper' command"},
+		{"arg empty once cleaned", "say", map[string]string{"message": "§a\n"}, nil, "The 'message' argument is required for the 'say' command"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := validateBotCommand(test.command, test.args, 20)
+
+			if test.wantErr != "" {
+				var invalidErr *invalidBotCommandError
+				if !errors.As(err, &invalidErr) || invalidErr.message != test.wantErr {
+					t.Errorf("validateBotCommand error = %v, want %q", err, test.wantErr)
+				}
+				return
+			}
+
+			if err != nil || !reflect.DeepEqual(got, test.want) {
+				t.Errorf("validateBotCommand = %v, %v, want %v", got, err, test.want)
+			}
+		})
+	}
+}
+
+// How the test bot handles the commands it is sent.
+type testBotBehaviour int
+
+const (
+	botAnswers testBotBehaviour = iota
+	botIgnores
+	botDisconnects
+	botQueueFull
+)
+
+func TestPostBotCommand(t *testing.T) {
+	tests := []struct {
+		name       string
+		body       string
+		bot        testBotBehaviour
+		noBot      bool
+		wantCode   int
+		wantInBody string
+	}{
+		{"answered", `{"server": "SimplyVanilla", "command": "say", "args": {"message": "hi"}}`, botAnswers, false, http.StatusOK, `"ok":true`},
+		{"unknown command", `{"server": "simplyvanilla", "command": "op"}`, botAnswers, false, http.StatusBadRequest, "Unknown command"},
+		{"missing arg", `{"server": "simplyvanilla", "command": "say"}`, botAnswers, false, http.StatusBadRequest, "'message' argument is required"},
+		{"missing server", `{"command": "status"}`, botAnswers, false, http.StatusBadRequest, "'server' and 'command' are required"},
+		{"server not allowed", `{"server": "2b2t", "command": "status"}`, botAnswers, false, http.StatusForbidden, "not allowed"},
+		{"no bot", `{"server": "simplyvanilla", "command": "status"}`, botAnswers, true, http.StatusServiceUnavailable, "No bot is connected"},
+		{"timed out", `{"server": "simplyvanilla", "command": "status"}`, botIgnores, false, http.StatusGatewayTimeout, ErrBotCommandTimeout.Error()},
+		{"bot disconnected", `{"server": "simplyvanilla", "command": "status"}`, botDisconnects, false, http.StatusBadGateway, ErrBotDisconnected.Error()},
+		{"bot not keeping up", `{"server": "simplyvanilla", "command": "status"}`, botQueueFull, false, http.StatusBadGateway, ErrBotNotKeepingUp.Error()},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := newTestController(t, WebsocketConfig{
+				EgressQueueSize:   1,
+				OverflowPolicy:    OverflowDropNewest,
+				BotCommandTimeout: 50 * time.Millisecond,
+			})
+
+			plainTextKey, err := c.KeyService.NewApiKey(keyservice.APIPermissions{Admin: true}, "owner@example.com", 0, "tool", []string{"simplyvanilla"}, nil)
+			if err != nil {
+				t.Fatalf("NewApiKey: %v", err)
+			}
+
+			if !test.noBot {
+				bot := newTestClient(c, "bot")
+				bot.IsMcClient = true
+				bot.Mc_server = "simplyvanilla"
+				c.bots.register("simplyvanilla", "bot")
+
+				if test.bot == botQueueFull {
+					bot.enqueue(WebsocketEvent{Action: "inbound_minecraft_chat"})
+				} else {
+					go runTestBot(c, bot, test.bot)
+				}
+			}
+
+			handler := middleware.RequireAPIKey(c.KeyService, keyservice.ScopeBotCommand)(http.HandlerFunc(c.PostBotCommand))
+
+			request := httptest.NewRequest("POST", "/bot/command", strings.NewReader(test.body))
+			request.Header.Set("x-api-key", plainTextKey)
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, request)
+
+			if recorder.Code != test.wantCode || !strings.Contains(recorder.Body.String(), test.wantInBody) {
+				t.Errorf("got %d %q, want %d containing %q", recorder.Code, recorder.Body.String(), test.wantCode, test.wantInBody)
+			}
+
+			// whatever happened, nothing is left waiting for the bot.
+			c.commands.mu.Lock()
+			defer c.commands.mu.Unlock()
+			if len(c.commands.pending) != 0 {
+				t.Errorf("%d commands still waiting", len(c.commands.pending))
+			}
+		})
+	}
+}
+
+// Reading the first command sent to the bot and answering it like the test wants.
+func runTestBot(c *Controller, bot *WebsocketClient, behaviour testBotBehaviour) {
+	message := <-bot.Egress
+	command, ok := message.event.Data.(BotCommand)
+	if !ok {
+		return
+	}
+
+	switch behaviour {
+	case botAnswers:
+		c.handleBotCommandResult(WebsocketEvent{
+			Client_id: bot.ClientID,
+			Action:    "bot_command_result",
+			Data:      map[string]interface{}{"id": command.ID, "ok": true, "result": "said"},
+		})
+	case botDisconnects:
+		c.commands.failClient(bot.ClientID)
+	}
+}
@@ -0,0 +1,152 @@
+package controllers
+
+import (
+	"os"
+	"time"
+
+	"github.com/febzey/ForestBot-Mainframe/utils"
+)
+
+/*
+Settings for our websocket server, loaded from the environment.
+Every setting has a default so the .env file only needs the ones being changed.
+*/
+type WebsocketConfig struct {
+	//If true, websocket upgrades without an api key (header, token query or subprotocol)
+	//are refused with a 401. The x-api-key event flow is then disabled.
+	//env: WEBSOCKET_REQUIRE_HANDSHAKE_AUTH
+	RequireHandshakeAuth bool
+
+	//How long a client that connected without an api key has to send
+	//the x-api-key event before we close the connection. 0 disables the deadline.
+	//env: WEBSOCKET_AUTH_TIMEOUT_SECONDS
+	AuthTimeout time.Duration
+
+	//How many outbound messages can be queued for a client before the overflow policy kicks in.
+	//env: WEBSOCKET_EGRESS_QUEUE_SIZE
+	EgressQueueSize int
+
+	//What happens when a clients queue is full: drop_oldest, drop_newest or disconnect.
+	//env: WEBSOCKET_EGRESS_OVERFLOW_POLICY
+	OverflowPolicy OverflowPolicy
+
+	//How often we ping each client. 0 disables pings and read deadlines.
+	//env: WEBSOCKET_PING_INTERVAL_SECONDS
+	PingInterval time.Duration
+
+	//How long a client can go without sending a pong (or any message) before
+	//we consider the connection dead and remove the client. Must be longer than PingInterval.
+	//env: WEBSOCKET_PONG_TIMEOUT_SECONDS
+	PongTimeout time.Duration
+
+	//How long a single write to a client can take before we give up on the connection.
+	//env: WEBSOCKET_WRITE_TIMEOUT_SECONDS
+	WriteTimeout time.Duration
+
+	//How many broadcasts we keep per mc server for clients resuming after a reconnect.
+	//0 disables resuming.
+	//env: WEBSOCKET_HISTORY_SIZE
+	HistorySize int
+
+	//How long we remember saved write events, a retried or replayed event within
+	//the window is acked without being saved again. 0 disables deduplication.
+	//env: WEBSOCKET_DEDUPE_WINDOW_SECONDS
+	DedupeWindow time.Duration
+
+	//How many standby bots can wait to take over for the active bot of a server.
+	//0 refuses a second bot for a server.
+	//env: WEBSOCKET_MAX_STANDBY_BOTS
+	MaxStandbyBots int
+
+	//How many queries from the query action can run at the same time, across every client.
+	//env: WEBSOCKET_MAX_CONCURRENT_QUERIES
+	MaxConcurrentQueries int
+
+	//If true, clients that support it get compressed messages (permessage-deflate).
+	//env: WEBSOCKET_COMPRESSION
+	Compression bool
+
+	//How long a bot has to answer a command when the request does not give a timeout.
+	//env: WEBSOCKET_BOT_COMMAND_TIMEOUT_SECONDS
+	BotCommandTimeout time.Duration
+
+	//How long players stay on a servers list as "unknown" after its bot disconnects,
+	//before the list is removed and they are logged out.
+	//env: WEBSOCKET_PLAYER_LIST_GRACE_SECONDS
+	PlayerListGrace time.Duration
+
+	//The longest discord message (in characters) we send to a minecraft bot, longer ones are cut off.
+	//env: DISCORD_BRIDGE_MAX_LENGTH
+	DiscordBridgeMaxLength int
+
+	//How many discord messages each guild can send to minecraft servers per DiscordBridgeRateWindow,
+	//messages without a guild count against the api key that sent them. 0 disables the limit.
+	//env: DISCORD_BRIDGE_RATE_LIMIT
+	DiscordBridgeRateLimit int
+
+	//env: DISCORD_BRIDGE_RATE_WINDOW_SECONDS
+	DiscordBridgeRateWindow time.Duration
+}
+
+func LoadWebsocketConfig() WebsocketConfig {
+	config := WebsocketConfig{
+		RequireHandshakeAuth: utils.GetEnvBool("WEBSOCKET_REQUIRE_HANDSHAKE_AUTH", false),
+		AuthTimeout:          time.Duration(utils.GetEnvInt("WEBSOCKET_AUTH_TIMEOUT_SECONDS", 10)) * time.Second,
+		EgressQueueSize:      utils.GetEnvInt("WEBSOCKET_EGRESS_QUEUE_SIZE", 256),
+		OverflowPolicy:       parseOverflowPolicy(os.Getenv("WEBSOCKET_EGRESS_OVERFLOW_POLICY")),
+		PingInterval:         time.Duration(utils.GetEnvInt("WEBSOCKET_PING_INTERVAL_SECONDS", 30)) * time.Second,
+		PongTimeout:          time.Duration(utils.GetEnvInt("WEBSOCKET_PONG_TIMEOUT_SECONDS", 60)) * time.Second,
+		WriteTimeout:         time.Duration(utils.GetEnvInt("WEBSOCKET_WRITE_TIMEOUT_SECONDS", 10)) * time.Second,
+		HistorySize:          utils.GetEnvInt("WEBSOCKET_HISTORY_SIZE", 500),
+		DedupeWindow:         time.Duration(utils.GetEnvInt("WEBSOCKET_DEDUPE_WINDOW_SECONDS", 600)) * time.Second,
+		MaxStandbyBots:       utils.GetEnvInt("WEBSOCKET_MAX_STANDBY_BOTS", 2),
+		MaxConcurrentQueries: utils.GetEnvInt("WEBSOCKET_MAX_CONCURRENT_QUERIES", 8),
+		Compression:          utils.GetEnvBool("WEBSOCKET_COMPRESSION", true),
+		BotCommandTimeout:    time.Duration(utils.GetEnvInt("WEBSOCKET_BOT_COMMAND_TIMEOUT_SECONDS", 10)) * time.Second,
+		PlayerListGrace:      time.Duration(utils.GetEnvInt("WEBSOCKET_PLAYER_LIST_GRACE_SECONDS", 120)) * time.Second,
+
+		DiscordBridgeMaxLength:  utils.GetEnvInt("DISCORD_BRIDGE_MAX_LENGTH", 256),
+		DiscordBridgeRateLimit:  utils.GetEnvInt("DISCORD_BRIDGE_RATE_LIMIT", 5),
+		DiscordBridgeRateWindow: time.Duration(utils.GetEnvInt("DISCORD_BRIDGE_RATE_WINDOW_SECONDS", 10)) * time.Second,
+	}
+
+	// minecraft chat messages can not be longer than 256 characters.
+	if config.DiscordBridgeMaxLength < 1 || config.DiscordBridgeMaxLength > 256 {
+		config.DiscordBridgeMaxLength = 256
+	}
+
+	if config.BotCommandTimeout <= 0 || config.BotCommandTimeout > maxBotCommandTimeout {
+		config.BotCommandTimeout = 10 * time.Second
+	}
+
+	if config.DiscordBridgeRateWindow <= 0 {
+		config.DiscordBridgeRateWindow = 10 * time.Second
+	}
+
+	if config.MaxConcurrentQueries < 1 {
+		config.MaxConcurrentQueries = 1
+	}
+
+	if config.MaxStandbyBots < 0 {
+		config.MaxStandbyBots = 0
+	}
+
+	if config.PlayerListGrace < 0 {
+		config.PlayerListGrace = 0
+	}
+
+	if config.HistorySize < 0 {
+		config.HistorySize = 0
+	}
+
+	// a pong can not arrive before the ping is sent.
+	if config.PingInterval > 0 && config.PongTimeout <= config.PingInterval {
+		config.PongTimeout = config.PingInterval * 2
+	}
+
+	if config.EgressQueueSize < 1 {
+		config.EgressQueueSize = 1
+	}
+
+	return config
+}
@@ -10,9 +10,15 @@ package controllers
 import (
 	"errors"
 	"fmt"
+	"math"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
-	"github.com/febzey/ForestBot-Mainframe/types"
+	"github.com/febzey/ForestBot-Mainframe/keyservice"
+	"github.com/febzey/ForestBot-Mainframe/middleware"
+	"github.com/gorilla/websocket"
 )
 
 /*
@@ -32,18 +38,101 @@ type MessageChannel struct {
 
 /*
 Function used for removing a websocket client from our Controller Client map.
+Safe to call more than once, and from any go routine (the read and write go routines,
+heartbeat timeouts, revoked keys). Removing the active bot client promotes
+a standby bot for its server, or frees the server so a restarted bot can connect right away.
 */
 func (c *Controller) removeWebSocketClient(clientID string) {
 	c.Mutex.Lock()
 	defer c.Mutex.Unlock()
 
 	if client, ok := c.Clients[clientID]; ok {
+		client.closeOnce.Do(func() { close(client.done) })
+
 		if client.Conn != nil {
 			client.Conn.Close()
 			c.Logger.WebsocketDisconnect(fmt.Sprintf("Client removed ID: %s", clientID))
 		}
 
+		c.KeyService.ConnectionClosed(*client.Key)
+
 		delete(c.Clients, clientID)
+
+		// commands waiting on this client will never get an answer.
+		c.commands.failClient(clientID)
+
+		// a standby takes over for the active bot.
+		if client.IsMcClient {
+			wasActive := c.bots.isActive(client.Mc_server, clientID)
+
+			promotedID := c.bots.remove(client.Mc_server, clientID)
+			if promoted, ok := c.Clients[promotedID]; ok {
+				c.sendPromoted(promoted)
+			}
+
+			if wasActive {
+				c.botOffline(client.Mc_server, clientID, promotedID)
+				if promotedID != "" {
+					c.botOnline(client.Mc_server, promotedID, true)
+				} else {
+					// nobody can see who is online until a bot is back.
+					c.markPlayerListUnknown(client.Mc_server)
+				}
+			}
+		}
+	}
+}
+
+/*
+Disconnecting every websocket client that authenticated with
+a key that was revoked or rotated.
+*/
+func (c *Controller) disconnectClientsUsingKey(encryptedKey string) {
+	c.Mutex.Lock()
+	var clients []*WebsocketClient
+	for _, client := range c.Clients {
+		if client.Key != nil && client.Key.Key == encryptedKey {
+			clients = append(clients, client)
+		}
+	}
+	c.Mutex.Unlock()
+
+	for _, client := range clients {
+		c.disconnectWithError(client, WebsocketErrorData{
+			Code:    "key_revoked",
+			Message: "Your api key was revoked.",
+		})
+	}
+}
+
+/*
+Giving every websocket client using a key its new expiry, and closing them
+when it comes (right away if it already passed). Clients using a session token
+keep their tokens expiry unless the key now expires before it.
+*/
+func (c *Controller) updateClientKeyExpiry(encryptedKey string, expiresAt int64) {
+	c.Mutex.Lock()
+	updated := map[string]keyservice.APIkey{}
+	for id, client := range c.Clients {
+		if client.Key == nil || client.Key.Key != encryptedKey {
+			continue
+		}
+
+		key := *client.Key
+		if key.TokenType != keyservice.SessionTokenType {
+			key.ExpiresAt = expiresAt
+		} else if expiresAt > 0 && expiresAt < key.ExpiresAt {
+			key.ExpiresAt = expiresAt
+		}
+
+		// the timer for the old expiry sees the key changed and does nothing.
+		client.Key = &key
+		updated[id] = key
+	}
+	c.Mutex.Unlock()
+
+	for id, key := range updated {
+		c.closeWhenKeyExpires(id, key)
 	}
 }
 
@@ -57,15 +146,73 @@ it is a http endpoint but is upgraded to websocket.
 func (c *Controller) websocketController(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 
+	//
+	//Authenticating before the upgrade if the client sent a key,
+	//so we never allocate a client for a bad key.
+	//
+	var key *keyservice.APIkey
+	remoteIP := middleware.ClientIP(r)
+
+	if credential := extractHandshakeCredential(r); credential != "" {
+		verified, err := c.KeyService.VerifyAPIKey(credential, "ip:"+remoteIP)
+		if err != nil {
+			var banned *keyservice.BannedError
+			if errors.As(err, &banned) {
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(banned.RetryAfter.Seconds()))))
+				http.Error(w, "Too many failed api key attempts, try again later", http.StatusTooManyRequests)
+				return
+			}
+
+			if errors.Is(err, keyservice.ErrSessionTokenExpired) || errors.Is(err, keyservice.ErrSessionTokenRevoked) {
+				http.Error(w, "Your session token has expired, request a new one", http.StatusUnauthorized)
+				return
+			}
+
+			http.Error(w, "Invalid api key", http.StatusUnauthorized)
+			return
+		}
+		key = &verified
+	} else if c.Config.RequireHandshakeAuth {
+		http.Error(w, "Missing api key, send it in the 'x-api-key' header, 'token' query or as an 'apikey.<key>' subprotocol", http.StatusUnauthorized)
+		return
+	}
+
+	//
+	//Optional subscriptions, example: servers=simplyvanilla,2b2t&actions=inbound_minecraft_chat
+	//
+	subscriptions := SubscriptionRequest{
+		Servers: splitSubscriptionQuery(r.URL.Query().Get("servers")),
+		Actions: splitSubscriptionQuery(r.URL.Query().Get("actions")),
+	}
+	if err := validateSubscriptionActions(subscriptions.Actions); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	//
+	//The protocol version the client speaks, example: protocol=2
+	//
+	protocol, err := parseProtocolVersion(r.URL.Query().Get("protocol"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	//
 	//Upgrading http connection to websocket
 	//
-	conn, err := upgrader.Upgrade(w, r, nil)
+	conn, err := c.upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		c.Logger.Error(err.Error())
 		return
 	}
 
+	// connections turned away in NewWebsocketClient are written to before the client exists,
+	// a client that stops reading during the handshake can not hold up its handler for long.
+	if c.Config.WriteTimeout > 0 {
+		conn.SetWriteDeadline(time.Now().Add(c.Config.WriteTimeout))
+	}
+
 	//
 	//Getting our server and x-api-key url queries.
 	//
@@ -74,80 +221,181 @@ func (c *Controller) websocketController(w http.ResponseWriter, r *http.Request)
 	//
 	//Creating a websocket instance with or given queries.
 	//
-	client := NewWebsocketClient(conn, mc_server, isBot, c)
+	client := NewWebsocketClient(conn, mc_server, isBot, key, c)
 	if client == nil {
 		c.Logger.WebsocketError("Client failed to connect.")
 		return
 	}
 
+	c.Mutex.Lock()
+	client.RemoteIP = remoteIP
+	client.Protocol = protocol
+	client.Subscriptions.Subscribe(subscriptions)
+	c.Mutex.Unlock()
+
+	//
+	//Letting newer clients know which protocol version we are using with them,
+	//like the welcome messages this is written before the write go routine starts.
+	//
+	if protocol >= 2 {
+		client.writeEvent(WebsocketEvent{
+			Client_id: client.ClientID,
+			Action:    "protocol",
+			Data:      ProtocolData{Version: protocol, Supported: supportedProtocolVersions()},
+		})
+	}
+
 	//
 	//Let the console know a websocket client has connected.
 	//
-	c.Logger.WebsocketConnect(fmt.Sprintf("Websocket Client Connected For Minecraft Server: %s | ID: %s | isMcBot: %t", mc_server, client.ClientID, isBot == "true"))
+	c.Logger.WebsocketConnect(fmt.Sprintf("Websocket Client Connected For Minecraft Server: %s | ID: %s | isMcBot: %t | authenticated: %t | protocol: %d", mc_server, client.ClientID, isBot == "true", key != nil, protocol))
 
 	go client.readMessages()
 	go client.writeMessages()
 
+	//
+	//Clients using the x-api-key event get a deadline to authenticate.
+	//
+	if key == nil && c.Config.AuthTimeout > 0 {
+		time.AfterFunc(c.Config.AuthTimeout, func() {
+			c.closeIfUnauthenticated(client.ClientID)
+		})
+	}
+
+	if key != nil {
+		c.closeWhenKeyExpires(client.ClientID, *key)
+	}
+
 }
 
 /*
-Removing a specific user from a specific servers c.PlayerLists
-if the user and the server are present in the map
+Getting an api key sent with the websocket upgrade request.
+Checked in order: x-api-key or bearer header, the "token" query,
+then an "apikey.<key>" entry in Sec-WebSocket-Protocol (for browsers, which can not set headers).
 */
-func (c *Controller) removeUserFromPlayerList(serverName string, usernameToRemove string) {
-	c.Mutex.Lock()
-	defer c.Mutex.Unlock()
+func extractHandshakeCredential(r *http.Request) string {
+	if key := middleware.ExtractAPIKey(r); key != "" {
+		return key
+	}
 
-	if playerList, ok := c.PlayerLists[serverName]; ok {
-		var updatedPlayerList []types.Player
+	if token := r.URL.Query().Get("token"); token != "" {
+		return token
+	}
 
-		for _, player := range playerList {
-			if player.Username != usernameToRemove {
-				updatedPlayerList = append(updatedPlayerList, player)
-			}
+	for _, protocol := range websocket.Subprotocols(r) {
+		if strings.HasPrefix(protocol, apiKeySubprotocolPrefix) {
+			return strings.TrimPrefix(protocol, apiKeySubprotocolPrefix)
 		}
-
-		c.PlayerLists[serverName] = updatedPlayerList
 	}
+
+	return ""
 }
 
 /*
-Adding a user to the c.PlayerLists map.
-If the server doesnt exist as a key in c.PlayerLists,
-we will create a new one and add the user.
+Closing a client that connected without a key and never sent
+the x-api-key event, so it does not hold a slot forever.
 */
-func (c *Controller) addUserToPlayerList(serverName string, newPlayer types.Player) {
+func (c *Controller) closeIfUnauthenticated(clientID string) {
 	c.Mutex.Lock()
-	defer c.Mutex.Unlock()
+	client, ok := c.Clients[clientID]
+	authenticated := ok && client.Key.Key != ""
+	c.Mutex.Unlock()
 
-	if playerList, ok := c.PlayerLists[serverName]; ok {
-		for i, player := range playerList {
-			if player.Username == newPlayer.Username {
-				c.PlayerLists[serverName][i] = newPlayer
-				return
-			}
-		}
+	if !ok || authenticated {
+		return
+	}
 
-		c.PlayerLists[serverName] = append(playerList, newPlayer)
-	} else {
-		c.PlayerLists[serverName] = []types.Player{newPlayer}
+	c.disconnectWithError(client, WebsocketErrorData{
+		Code:    "auth_timeout",
+		Action:  "x-api-key",
+		Message: "You did not send your api key in time, closing connection.",
+	})
+}
+
+/*
+Closing a client once the key (or session token) it authenticated with expires,
+so a short lived token can not keep a connection open forever.
+*/
+func (c *Controller) closeWhenKeyExpires(clientID string, key keyservice.APIkey) {
+	if key.ExpiresAt <= 0 {
+		return
 	}
+
+	time.AfterFunc(time.Until(time.UnixMilli(key.ExpiresAt)), func() {
+		c.Mutex.Lock()
+		client, ok := c.Clients[clientID]
+		sameKey := ok && client.Key.Key == key.Key && client.Key.ExpiresAt == key.ExpiresAt
+		c.Mutex.Unlock()
+
+		if !sameKey {
+			return
+		}
+
+		c.disconnectWithError(client, WebsocketErrorData{
+			Code:    "key_expired",
+			Message: "Your api key or session token has expired, closing connection.",
+		})
+	})
+}
+
+/*
+Sending a client one last error event, then removing it.
+The error can not go through the egress queue since removing the client stops its write go routine,
+so it is written from a go routine of its own and the caller (a key being revoked, a timer) never waits on it.
+A client that stops reading is removed once the write timeout passes.
+*/
+func (c *Controller) disconnectWithError(client *WebsocketClient, data WebsocketErrorData) {
+	go func() {
+		client.writeEvent(WebsocketEvent{
+			Client_id: client.ClientID,
+			Action:    "error",
+			Data:      data,
+		})
+
+		c.removeWebSocketClient(client.ClientID)
+	}()
 }
 
 /*
 With this function we are able to send a message
 to every websocket client connected to our server by
-sending a message to each of our connected clients egress channels
+sending a message to each of our connected clients egress channels.
+Only clients subscribed to the server and action get the message,
+mcServer can be empty for messages not tied to a server.
+Every broadcast gets a sequence number and is saved for clients that resume.
 */
-func (c *Controller) BroadcastMessageToClients(message WebsocketEvent) {
-	c.Mutex.Lock()
-	defer c.Mutex.Unlock()
+func (c *Controller) BroadcastMessageToClients(mcServer string, message WebsocketEvent) {
+	c.broadcast(mcServer, message, true)
+}
 
+// Broadcasting a message, bot clients only get it if includeBots is true.
+func (c *Controller) broadcast(mcServer string, message WebsocketEvent, includeBots bool) {
+	// holding the history lock until every client has the message,
+	// so clients always get broadcasts in sequence order.
+	c.history.mu.Lock()
+	defer c.history.mu.Unlock()
+
+	message = c.history.record(mcServer, message)
+
+	// encoded at most once per encoding, shared by every client.
+	outbound := newOutboundMessage(message)
+
+	c.Mutex.Lock()
+	var clients []*WebsocketClient
 	for _, client := range c.Clients {
-		if client.Key.Permissions.Read {
-			client.Egress <- message
+		if !includeBots && client.IsMcClient {
+			continue
+		}
+		if client.Key.HasScope(keyservice.ScopeEventsRead) && client.Subscriptions.Matches(mcServer, message.Action) {
+			clients = append(clients, client)
 		}
 	}
+	c.Mutex.Unlock()
+
+	// enqueue never blocks, so a slow client can not hold up everyone else.
+	for _, client := range clients {
+		client.enqueueOutbound(outbound)
+	}
 }
 
 /*
@@ -155,27 +403,106 @@ This function allows us to send a message to specific
 websocket connection, while following our websocket message structure.
 */
 func (c *Controller) sendMessageByStructure(id string, message WebsocketEvent) error {
+	c.Mutex.Lock()
 	client, ok := c.Clients[id]
+	c.Mutex.Unlock()
+
 	if !ok {
 		return errors.New("no client found")
 	}
 
-	client.Egress <- message
+	if !client.enqueue(message) {
+		return errors.New("message dropped, client egress queue is full")
+	}
+
 	return nil
 }
 
-// Sending error messages, we bypass the clients egress channel and just send
-// the message straight to the connection.
-func (c *Controller) sendErrorMessage(id string, message string) {
+// Sending error messages through the clients egress queue, they are sent
+// even if the client has not authenticated yet.
+func (c *Controller) sendErrorMessage(id string, data WebsocketErrorData) {
+	c.Mutex.Lock()
+	client, ok := c.Clients[id]
+	c.Mutex.Unlock()
+
+	// the client may have been removed (disconnected for being slow) while we were handling its event.
+	if !ok {
+		return
+	}
+
+	client.enqueuePrivate(errorEvent(client, data))
+
+}
+
+// The error event for a client.
+// Clients on protocol 1 get just the message string they always got,
+// newer clients get the structured data.
+func errorEvent(client *WebsocketClient, data WebsocketErrorData) WebsocketEvent {
+	var errorData interface{} = data
+	if client.Protocol < 2 {
+		errorData = data.Message
+	}
+
+	return WebsocketEvent{
+		Client_id: client.ClientID,
+		Action:    "error",
+		Data:      errorData,
+	}
+}
+
+/*
+Structured data for error events that clients may want to handle,
+instead of only showing the message.
+*/
+type WebsocketErrorData struct {
+	//machine readable error code, example: rate_limited
+	Code string `json:"code"`
+
+	//the action that caused the error.
+	Action string `json:"action,omitempty"`
+
+	//the field in the data that caused the error.
+	Field string `json:"field,omitempty"`
+
+	//human readable message
+	Message string `json:"message"`
+
+	//seconds until the client may try again.
+	RetryAfter int `json:"retry_after,omitempty"`
+}
+
+// Sending an error event with structured data, whatever protocol the client is on.
+func (c *Controller) sendStructuredErrorMessage(id string, data WebsocketErrorData) {
+	c.Mutex.Lock()
 	client, ok := c.Clients[id]
+	c.Mutex.Unlock()
+
 	if !ok {
-		panic("Failed to send error message to client")
+		return
 	}
 
-	client.Conn.WriteJSON(WebsocketEvent{
+	client.enqueuePrivate(WebsocketEvent{
 		Client_id: id,
 		Action:    "error",
-		Data:      message,
+		Data:      data,
 	})
+}
 
+// Checking that the clients api key is allowed to write data for a minecraft server.
+// If it is not, we return a server_not_allowed error for the handler to return.
+func (c *Controller) serverScopeError(id string, mcServer string) error {
+	c.Mutex.Lock()
+	client, ok := c.Clients[id]
+	allowed := ok && client.Key.AllowsServer(mcServer)
+	c.Mutex.Unlock()
+
+	if allowed {
+		return nil
+	}
+
+	return &EventError{
+		Code:       codeServerNotAllowed,
+		Message:    fmt.Sprintf("Your api key is not allowed to write data for the server '%s'.", mcServer),
+		structured: true,
+	}
 }
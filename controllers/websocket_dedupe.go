@@ -0,0 +1,124 @@
+package controllers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+)
+
+/******
+
+Deduplicating write events.
+Bots retry events after a nack and replay them after reconnecting, without this
+every retry would save another chat message, death or join.
+
+An event is identified by its event_id (scoped to the api key and server), or if it has
+no event_id, by a hash of its data, but only when the data has a timestamp,
+otherwise two players saying "hi" would count as the same message.
+
+Events we already saved within the dedupe window are acked again without being
+saved or broadcasted a second time. Failed saves are not remembered, so they can be retried.
+
+******/
+
+type eventDeduper struct {
+	//when each event was saved, key is from eventDedupeKey.
+	seen map[string]time.Time
+
+	window    time.Duration
+	lastPrune time.Time
+
+	mu *sync.Mutex
+}
+
+func newEventDeduper(window time.Duration) *eventDeduper {
+	return &eventDeduper{
+		seen:      make(map[string]time.Time),
+		window:    window,
+		lastPrune: time.Now(),
+		mu:        &sync.Mutex{},
+	}
+}
+
+// Checking if an event was saved within the window.
+func (d *eventDeduper) isDuplicate(key string) bool {
+	if key == "" || d.window <= 0 {
+		return false
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	savedAt, ok := d.seen[key]
+	return ok && time.Since(savedAt) < d.window
+}
+
+// Remembering an event that was saved.
+func (d *eventDeduper) remember(key string) {
+	if key == "" || d.window <= 0 {
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := time.Now()
+	d.seen[key] = now
+
+	// removing old events at most once a minute so the map does not grow forever.
+	if now.Sub(d.lastPrune) > time.Minute {
+		for key, savedAt := range d.seen {
+			if now.Sub(savedAt) >= d.window {
+				delete(d.seen, key)
+			}
+		}
+		d.lastPrune = now
+	}
+}
+
+// Building the dedupe key for a write event.
+// timestampField is the field in the data holding the events time, for events without an event_id.
+// Returns "" if the event can not be deduplicated.
+func (c *Controller) eventDedupeKey(message WebsocketEvent, mcServer string, timestampField string) string {
+	if message.Event_id != "" {
+		c.Mutex.Lock()
+		client, ok := c.Clients[message.Client_id]
+		var keyHash string
+		if ok {
+			keyHash = client.Key.Key
+		}
+		c.Mutex.Unlock()
+
+		return fmt.Sprintf("id:%s:%s:%s", keyHash, mcServer, message.Event_id)
+	}
+
+	dataMap, ok := message.Data.(map[string]interface{})
+	if !ok {
+		return ""
+	}
+
+	switch timestamp := dataMap[timestampField].(type) {
+	case nil:
+		return ""
+	case string:
+		if timestamp == "" {
+			return ""
+		}
+	case float64:
+		if timestamp == 0 {
+			return ""
+		}
+	}
+
+	// maps are encoded with sorted keys, so the same data always has the same hash.
+	data, err := json.Marshal(dataMap)
+	if err != nil {
+		return ""
+	}
+
+	hash := sha256.Sum256(data)
+	return fmt.Sprintf("hash:%s:%s:%s", message.Action, mcServer, hex.EncodeToString(hash[:]))
+}
@@ -0,0 +1,118 @@
+package controllers
+
+import (
+	"testing"
+	"time"
+
+	"github.com/febzey/ForestBot-Mainframe/keyservice"
+)
+
+func TestEventDeduperWindow(t *testing.T) {
+	deduper := newEventDeduper(30 * time.Millisecond)
+
+	if deduper.isDuplicate("a") {
+		t.Fatal("an event that was never saved is a duplicate")
+	}
+
+	deduper.remember("a")
+	if !deduper.isDuplicate("a") {
+		t.Error("a saved event is not a duplicate")
+	}
+	if deduper.isDuplicate("b") {
+		t.Error("another event is a duplicate")
+	}
+
+	time.Sleep(40 * time.Millisecond)
+	if deduper.isDuplicate("a") {
+		t.Error("event is still a duplicate after the window")
+	}
+}
+
+func TestEventDeduperDisabled(t *testing.T) {
+	// WEBSOCKET_DEDUPE_WINDOW_SECONDS=0 turns it off, events without a key are never duplicates.
+	for _, deduper := range []*eventDeduper{newEventDeduper(0), newEventDeduper(time.Minute)} {
+		deduper.remember("")
+		if deduper.isDuplicate("") {
+			t.Errorf("window %s: empty key is a duplicate", deduper.window)
+		}
+	}
+
+	disabled := newEventDeduper(0)
+	disabled.remember("a")
+	if disabled.isDuplicate("a") {
+		t.Error("event is a duplicate with the dedupe window off")
+	}
+}
+
+func TestEventDeduperPrune(t *testing.T) {
+	deduper := newEventDeduper(time.Minute)
+
+	deduper.remember("old")
+	deduper.seen["old"] = time.Now().Add(-2 * time.Minute)
+	deduper.lastPrune = time.Now().Add(-2 * time.Minute)
+
+	deduper.remember("new")
+
+	if _, ok := deduper.seen["old"]; ok {
+		t.Error("expired event was not pruned")
+	}
+	if _, ok := deduper.seen["new"]; !ok {
+		t.Error("current event was pruned")
+	}
+}
+
+func TestEventDedupeKeyEventID(t *testing.T) {
+	c := newTestController(t, WebsocketConfig{EgressQueueSize: 1})
+	newTestClient(c, "bot-a").Key = &keyservice.APIkey{Key: "key-a"}
+	newTestClient(c, "bot-a2").Key = &keyservice.APIkey{Key: "key-a"}
+	newTestClient(c, "bot-b").Key = &keyservice.APIkey{Key: "key-b"}
+
+	key := func(clientID string, server string) string {
+		message := WebsocketEvent{Client_id: clientID, Action: "inbound_minecraft_chat", Event_id: "1"}
+		return c.eventDedupeKey(message, server, "date")
+	}
+
+	if key("bot-a", "simplyvanilla") != key("bot-a2", "simplyvanilla") {
+		t.Error("the same event id from two connections with the same key got different keys")
+	}
+	if key("bot-a", "simplyvanilla") == key("bot-b", "simplyvanilla") {
+		t.Error("the same event id from another api key got the same key")
+	}
+	if key("bot-a", "simplyvanilla") == key("bot-a", "2b2t") {
+		t.Error("the same event id for another server got the same key")
+	}
+}
+
+func TestEventDedupeKeyHash(t *testing.T) {
+	c := newTestController(t, WebsocketConfig{EgressQueueSize: 1})
+	newTestClient(c, "bot")
+
+	key := func(server string, data map[string]interface{}) string {
+		message := WebsocketEvent{Client_id: "bot", Action: "inbound_minecraft_chat", Data: data}
+		return c.eventDedupeKey(message, server, "date")
+	}
+
+	chat := func(date interface{}) map[string]interface{} {
+		return map[string]interface{}{"name": "febzey", "message": "hi", "date": date}
+	}
+
+	if key("simplyvanilla", chat("1700000000000")) == "" {
+		t.Fatal("chat with a date got no key")
+	}
+	if key("simplyvanilla", chat("1700000000000")) != key("simplyvanilla", chat("1700000000000")) {
+		t.Error("the same chat got different keys")
+	}
+	if key("simplyvanilla", chat("1700000000000")) == key("simplyvanilla", chat("1700000000001")) {
+		t.Error("the same message at another time got the same key")
+	}
+	if key("simplyvanilla", chat("1700000000000")) == key("2b2t", chat("1700000000000")) {
+		t.Error("the same chat on another server got the same key")
+	}
+
+	// without a timestamp two players saying "hi" can not be told apart from a retry.
+	for _, date := range []interface{}{nil, "", float64(0)} {
+		if got := key("simplyvanilla", chat(date)); got != "" {
+			t.Errorf("chat with date %v got key %q, want none", date, got)
+		}
+	}
+}
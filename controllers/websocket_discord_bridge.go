@@ -0,0 +1,137 @@
+package controllers
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+
+	"github.com/febzey/ForestBot-Mainframe/types"
+)
+
+/******
+
+The discord to minecraft chat bridge.
+Discord messages for a minecraft server (inbound_discord_chat with a "server") are sent
+only to that servers active bot, as an "outbound_minecraft_chat" event for the bot to say in game.
+
+The message is cleaned up for minecraft first (no formatting codes, control characters or
+new lines, and cut to DISCORD_BRIDGE_MAX_LENGTH characters), and every discord guild
+can only send DISCORD_BRIDGE_RATE_LIMIT messages per DISCORD_BRIDGE_RATE_WINDOW_SECONDS,
+so one busy guild can not flood a server. Messages without a guild_id count against
+the api key that sent them instead.
+
+******/
+
+// Longest username we pass on, minecraft and discord names are both shorter than this.
+const maxBridgeUsernameLength = 32
+
+// The data for the outbound_minecraft_chat event, sent to a bot to say in game.
+type OutboundMinecraftChat struct {
+	Server    string `json:"server"`
+	Username  string `json:"username"`
+	Message   string `json:"message"`
+	GuildID   string `json:"guild_id"`
+	GuildName string `json:"guild_name"`
+	ChannelID string `json:"channel_id"`
+}
+
+// Cleaning up text so it is safe to say in minecraft chat.
+// § and the character after it are a formatting code in minecraft, and control characters (including new lines)
+// can get a bot kicked, new lines and tabs become spaces, everything else is removed.
+// Text longer than maxLength characters is cut off with "...".
+func sanitizeMinecraftChat(text string, maxLength int) string {
+	var b strings.Builder
+	skipCode := false
+	for _, r := range text {
+		switch {
+		case skipCode:
+			// the character after § is the formatting code itself.
+			skipCode = false
+		case r == '§':
+			skipCode = true
+		case r == '\n' || r == '\r' || r == '\t':
+			b.WriteRune(' ')
+		case unicode.IsControl(r) || r == unicode.ReplacementChar:
+			continue
+		default:
+			b.WriteRune(r)
+		}
+	}
+
+	// collapsing the spaces left behind.
+	cleaned := strings.Join(strings.Fields(b.String()), " ")
+
+	runes := []rune(cleaned)
+	if maxLength > 0 && len(runes) > maxLength {
+		if maxLength <= 3 {
+			return string(runes[:maxLength])
+		}
+		return strings.TrimRight(string(runes[:maxLength-3]), " ") + "..."
+	}
+
+	return cleaned
+}
+
+// Sending a discord message from a client to the active bot of its minecraft server.
+func (c *Controller) bridgeDiscordToMinecraft(clientID string, discordMessage types.DiscordMessage) error {
+	chat := OutboundMinecraftChat{
+		Server:    discordMessage.Server,
+		Username:  sanitizeMinecraftChat(discordMessage.Username, maxBridgeUsernameLength),
+		Message:   sanitizeMinecraftChat(discordMessage.Message, c.Config.DiscordBridgeMaxLength),
+		GuildID:   discordMessage.Guild_ID,
+		GuildName: discordMessage.Guild_Name,
+		ChannelID: discordMessage.Channel_ID,
+	}
+
+	if chat.Message == "" || chat.Username == "" {
+		return &EventError{Code: codeInvalidPayload, Message: "The message or username is empty after removing characters minecraft can not show.", structured: true}
+	}
+
+	c.Mutex.Lock()
+	var bot *WebsocketClient
+	if botID := c.bots.activeFor(discordMessage.Server); botID != "" {
+		bot = c.Clients[botID]
+	}
+
+	// messages without a guild count against the senders api key, so leaving out
+	// the guild_id does not get around the limit.
+	limitID, limitName := "guild:"+discordMessage.Guild_ID, fmt.Sprintf("The guild '%s'", discordMessage.Guild_ID)
+	if discordMessage.Guild_ID == "" {
+		limitID, limitName = "client:"+clientID, "This connection"
+		if sender, ok := c.Clients[clientID]; ok && sender.Key.Key != "" {
+			limitID, limitName = "key:"+sender.Key.Key, "Your api key"
+		}
+	}
+	c.Mutex.Unlock()
+
+	if bot == nil {
+		return &EventError{
+			Code:       codeNoBotConnected,
+			Message:    fmt.Sprintf("No bot is connected for the server '%s', the message was not delivered.", discordMessage.Server),
+			Retryable:  true,
+			structured: true,
+		}
+	}
+
+	// only messages that can be delivered count towards the limit.
+	if allowed, retryAfter := c.discordBridgeLimiter.AllowID(limitID, c.Config.DiscordBridgeRateLimit); !allowed {
+		err := rateLimitedError(retryAfter)
+		err.Message = fmt.Sprintf("%s is sending too many messages to '%s', this message was not delivered.", limitName, discordMessage.Server)
+		return err
+	}
+
+	if !bot.enqueue(WebsocketEvent{
+		Client_id: bot.ClientID,
+		Action:    "outbound_minecraft_chat",
+		Data:      chat,
+	}) {
+		return &EventError{
+			Code:       codeDeliveryFailed,
+			Message:    fmt.Sprintf("The bot for the server '%s' is not keeping up, the message was not delivered.", discordMessage.Server),
+			Retryable:  true,
+			structured: true,
+		}
+	}
+
+	return nil
+}
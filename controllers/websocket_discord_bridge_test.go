@@ -0,0 +1,85 @@
+package controllers
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/febzey/ForestBot-Mainframe/keyservice"
+	"github.com/febzey/ForestBot-Mainframe/types"
+)
+
+func TestBridgeRateLimit(t *testing.T) {
+	c := newTestController(t, WebsocketConfig{EgressQueueSize: 8, DiscordBridgeMaxLength: 256, DiscordBridgeRateLimit: 1})
+
+	bot := newTestClient(c, "bot")
+	bot.IsMcClient = true
+	bot.Mc_server = "simplyvanilla"
+	c.bots.register("simplyvanilla", "bot")
+
+	for _, id := range []string{"relay", "other-relay", "same-key-relay"} {
+		newTestClient(c, id)
+	}
+	c.Clients["relay"].Key = &keyservice.APIkey{Key: "relay-key"}
+	c.Clients["other-relay"].Key = &keyservice.APIkey{Key: "other-key"}
+	c.Clients["same-key-relay"].Key = &keyservice.APIkey{Key: "relay-key"}
+
+	message := func(guildID string) types.DiscordMessage {
+		return types.DiscordMessage{Server: "simplyvanilla", Username: "febzey", Message: "hi", Guild_ID: guildID}
+	}
+
+	tests := []struct {
+		name        string
+		clientID    string
+		guildID     string
+		wantLimited bool
+	}{
+		{"first message from a guild", "relay", "123", false},
+		{"same guild", "other-relay", "123", true},
+		{"first message without a guild", "relay", "", false},
+		{"without a guild from the same key", "same-key-relay", "", true},
+		{"without a guild from another key", "other-relay", "", false},
+	}
+
+	for _, test := range tests {
+		err := c.bridgeDiscordToMinecraft(test.clientID, message(test.guildID))
+
+		var eventErr *EventError
+		limited := errors.As(err, &eventErr) && eventErr.Code == codeRateLimited
+		if limited != test.wantLimited || (err != nil && !limited) {
+			t.Errorf("%s: bridgeDiscordToMinecraft = %v, want rate limited %v", test.name, err, test.wantLimited)
+		}
+	}
+}
+
+func TestDiscordChatWithoutServerSkipsBots(t *testing.T) {
+	c := newTestController(t, WebsocketConfig{EgressQueueSize: 8})
+
+	readKey := &keyservice.APIkey{Key: "read-key", Permissions: keyservice.APIPermissions{Read: true}}
+
+	bot := newTestClient(c, "bot")
+	bot.IsMcClient = true
+	bot.Mc_server = "simplyvanilla"
+	bot.Key = readKey
+
+	dashboard := newTestClient(c, "dashboard")
+	dashboard.Key = readKey
+
+	newTestClient(c, "relay").Key = &keyservice.APIkey{Key: "relay-key"}
+
+	err := c.handleInboundDiscordChat(WebsocketEvent{
+		Client_id: "relay",
+		Action:    "inbound_discord_chat",
+		Data:      map[string]interface{}{"username": "febzey", "message": "hi", "guild_id": "123"},
+	})
+	if err != nil {
+		t.Fatalf("handleInboundDiscordChat: %v", err)
+	}
+
+	if len(dashboard.Egress) != 1 {
+		t.Errorf("dashboard got %d messages, want the chat", len(dashboard.Egress))
+	}
+	// a bot would say chat it can not tell is for its server in game.
+	if len(bot.Egress) != 0 {
+		t.Errorf("bot got %d messages, want none for chat without a server", len(bot.Egress))
+	}
+}
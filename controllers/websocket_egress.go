@@ -0,0 +1,218 @@
+package controllers
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/febzey/ForestBot-Mainframe/utils"
+)
+
+/******
+
+Outbound websocket messages.
+Every client has a bounded egress queue, messages are added without ever blocking,
+so one slow client can not hold up broadcasts (or the controller lock) for everyone else.
+When a clients queue is full the overflow policy decides what happens.
+
+Writes to a connection all go through writeEvent or writeOutbound, gorilla websockets only
+support one writer at a time. Nothing writes to a connection while holding the controller lock,
+messages for a client go through its queue, and writeEvent is only used by the clients own
+go routines or for the last message before a client is removed.
+
+******/
+
+// What happens when a clients egress queue is full.
+type OverflowPolicy string
+
+const (
+	//drop the oldest queued message to make room for the new one.
+	OverflowDropOldest OverflowPolicy = "drop_oldest"
+
+	//drop the new message.
+	OverflowDropNewest OverflowPolicy = "drop_newest"
+
+	//disconnect the client, it is not keeping up.
+	OverflowDisconnect OverflowPolicy = "disconnect"
+)
+
+func parseOverflowPolicy(value string) OverflowPolicy {
+	switch OverflowPolicy(strings.ToLower(strings.TrimSpace(value))) {
+	case OverflowDropNewest:
+		return OverflowDropNewest
+	case OverflowDisconnect:
+		return OverflowDisconnect
+	default:
+		return OverflowDropOldest
+	}
+}
+
+// Counters for outbound messages across every client.
+type EgressStats struct {
+	//messages added to a clients queue.
+	Enqueued int64
+
+	//messages dropped because a queue was full.
+	Dropped int64
+
+	//clients disconnected for not keeping up.
+	SlowConsumerDisconnects int64
+}
+
+// Adding a message to a clients egress queue without blocking.
+// Returns false if the message was dropped or the client was disconnected.
+func (ws *WebsocketClient) enqueue(message WebsocketEvent) bool {
+	return ws.enqueueOutbound(newOutboundMessage(message))
+}
+
+// Like enqueue, for a message meant only for this client (errors, promoted),
+// which is sent even if the client has not authenticated yet.
+func (ws *WebsocketClient) enqueuePrivate(message WebsocketEvent) bool {
+	outbound := newOutboundMessage(message)
+	outbound.private = true
+	return ws.enqueueOutbound(outbound)
+}
+
+// Like enqueue, for a message shared between clients (broadcasts).
+func (ws *WebsocketClient) enqueueOutbound(message *outboundMessage) bool {
+	c := ws.Controller
+
+	select {
+	case <-ws.done:
+		return false
+	default:
+	}
+
+	select {
+	case ws.Egress <- message:
+		atomic.AddInt64(&c.egressStats.Enqueued, 1)
+		return true
+	default:
+	}
+
+	switch c.Config.OverflowPolicy {
+	case OverflowDropNewest:
+		ws.recordDrop()
+		return false
+
+	case OverflowDisconnect:
+		ws.recordDrop()
+		atomic.AddInt64(&c.egressStats.SlowConsumerDisconnects, 1)
+		c.Logger.WebsocketError("Disconnecting slow client: " + ws.ClientID)
+		go c.removeWebSocketClient(ws.ClientID)
+		return false
+
+	default:
+		// making room by dropping the oldest message, if the writer emptied
+		// the queue in the mean time there is nothing to drop.
+		select {
+		case <-ws.Egress:
+			ws.recordDrop()
+		default:
+		}
+
+		select {
+		case ws.Egress <- message:
+			atomic.AddInt64(&c.egressStats.Enqueued, 1)
+			return true
+		default:
+			ws.recordDrop()
+			return false
+		}
+	}
+}
+
+func (ws *WebsocketClient) recordDrop() {
+	atomic.AddInt64(&ws.dropped, 1)
+	atomic.AddInt64(&ws.Controller.egressStats.Dropped, 1)
+}
+
+// Writing straight to the connection in the clients encoding, bypassing the egress queue.
+// Safe to call from any go routine, but never while holding the controller lock. A write that takes longer than the
+// write timeout fails, and the connection is dead after that.
+func (ws *WebsocketClient) writeEvent(message WebsocketEvent) error {
+	messageType, data, err := encodeMessage(ws.Encoding, message)
+	if err != nil {
+		return err
+	}
+
+	ws.writeMu.Lock()
+	defer ws.writeMu.Unlock()
+
+	ws.setWriteDeadline()
+	return ws.Conn.WriteMessage(messageType, data)
+}
+
+// Writing a queued message, using the prepared message for the clients encoding.
+func (ws *WebsocketClient) writeOutbound(message *outboundMessage) error {
+	prepared, err := message.preparedFor(ws.Encoding)
+	if err != nil {
+		return err
+	}
+
+	ws.writeMu.Lock()
+	defer ws.writeMu.Unlock()
+
+	ws.setWriteDeadline()
+	return ws.Conn.WritePreparedMessage(prepared)
+}
+
+func (ws *WebsocketClient) setWriteDeadline() {
+	if timeout := ws.Controller.Config.WriteTimeout; timeout > 0 {
+		ws.Conn.SetWriteDeadline(time.Now().Add(timeout))
+	}
+}
+
+// Egress stats for a single client.
+type ClientEgressStats struct {
+	ClientID   string   `json:"clientId"`
+	Server     string   `json:"server"`
+	IsMcClient bool     `json:"isMcClient"`
+	Encoding   Encoding `json:"encoding"`
+	Queued     int      `json:"queued"`
+	Dropped    int64    `json:"dropped"`
+}
+
+type WebsocketStatsResponse struct {
+	Policy                  OverflowPolicy      `json:"policy"`
+	QueueSize               int                 `json:"queueSize"`
+	Enqueued                int64               `json:"enqueued"`
+	Dropped                 int64               `json:"dropped"`
+	SlowConsumerDisconnects int64               `json:"slowConsumerDisconnects"`
+	Clients                 []ClientEgressStats `json:"clients"`
+}
+
+// METHOD: GET
+// PATH: /websocket/stats
+// DESCRIPTION: Outbound message counters, dropped messages and queue lengths for every client.
+func (c *Controller) GetWebsocketStats(w http.ResponseWriter, r *http.Request) {
+	response := WebsocketStatsResponse{
+		Policy:                  c.Config.OverflowPolicy,
+		QueueSize:               c.Config.EgressQueueSize,
+		Enqueued:                atomic.LoadInt64(&c.egressStats.Enqueued),
+		Dropped:                 atomic.LoadInt64(&c.egressStats.Dropped),
+		SlowConsumerDisconnects: atomic.LoadInt64(&c.egressStats.SlowConsumerDisconnects),
+		Clients:                 []ClientEgressStats{},
+	}
+
+	c.Mutex.Lock()
+	for _, client := range c.Clients {
+		response.Clients = append(response.Clients, ClientEgressStats{
+			ClientID:   client.ClientID,
+			Server:     client.Mc_server,
+			IsMcClient: client.IsMcClient,
+			Encoding:   client.Encoding,
+			Queued:     len(client.Egress),
+			Dropped:    atomic.LoadInt64(&client.dropped),
+		})
+	}
+	c.Mutex.Unlock()
+
+	sort.Slice(response.Clients, func(i, j int) bool {
+		return response.Clients[i].ClientID < response.Clients[j].ClientID
+	})
+
+	utils.RespondWithJSON(w, http.StatusOK, response)
+}
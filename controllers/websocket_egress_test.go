@@ -0,0 +1,175 @@
+package controllers
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/febzey/ForestBot-Mainframe/keyservice"
+	"github.com/febzey/ForestBot-Mainframe/logger"
+)
+
+// A controller without a database, settings come from config instead of the environment.
+func newTestController(t *testing.T, config WebsocketConfig) *Controller {
+	t.Helper()
+
+	keyService, err := keyservice.NewAPIKeyService(keyservice.NewMemoryKeyStore(""), "")
+	if err != nil {
+		t.Fatalf("NewAPIKeyService: %v", err)
+	}
+
+	c := NewController(nil, &logger.Logger{Logger: log.New(io.Discard, "", 0)}, keyService)
+	c.Config = config
+
+	return c
+}
+
+// Adding a client without a connection, its egress queue is never read unless the test does.
+func newTestClient(c *Controller, clientID string) *WebsocketClient {
+	client := &WebsocketClient{
+		ClientID:      clientID,
+		Key:           &keyservice.APIkey{},
+		Encoding:      EncodingJSON,
+		Egress:        make(chan *outboundMessage, c.Config.EgressQueueSize),
+		done:          make(chan struct{}),
+		Subscriptions: NewSubscriptions(),
+		Controller:    c,
+	}
+
+	c.Mutex.Lock()
+	c.Clients[clientID] = client
+	c.Mutex.Unlock()
+
+	return client
+}
+
+func queuedActions(client *WebsocketClient) []string {
+	var actions []string
+	for len(client.Egress) > 0 {
+		actions = append(actions, (<-client.Egress).event.Action)
+	}
+	return actions
+}
+
+func TestEnqueueOverflowPolicies(t *testing.T) {
+	tests := []struct {
+		policy      OverflowPolicy
+		wantQueued  bool
+		wantActions []string
+	}{
+		{OverflowDropOldest, true, []string{"second", "third"}},
+		{OverflowDropNewest, false, []string{"first", "second"}},
+		{OverflowDisconnect, false, []string{"first", "second"}},
+	}
+
+	for _, test := range tests {
+		t.Run(string(test.policy), func(t *testing.T) {
+			c := newTestController(t, WebsocketConfig{EgressQueueSize: 2, OverflowPolicy: test.policy})
+			client := newTestClient(c, "client")
+
+			for _, action := range []string{"first", "second"} {
+				if !client.enqueue(WebsocketEvent{Action: action}) {
+					t.Fatalf("enqueue(%s) = false with room in the queue", action)
+				}
+			}
+
+			if queued := client.enqueue(WebsocketEvent{Action: "third"}); queued != test.wantQueued {
+				t.Errorf("enqueue on a full queue = %v, want %v", queued, test.wantQueued)
+			}
+
+			if got := queuedActions(client); len(got) != 2 || got[0] != test.wantActions[0] || got[1] != test.wantActions[1] {
+				t.Errorf("queue = %v, want %v", got, test.wantActions)
+			}
+
+			if dropped := atomic.LoadInt64(&client.dropped); dropped != 1 {
+				t.Errorf("client dropped = %d, want 1", dropped)
+			}
+			if dropped := atomic.LoadInt64(&c.egressStats.Dropped); dropped != 1 {
+				t.Errorf("total dropped = %d, want 1", dropped)
+			}
+		})
+	}
+}
+
+func TestEnqueueDisconnectsSlowClient(t *testing.T) {
+	c := newTestController(t, WebsocketConfig{EgressQueueSize: 1, OverflowPolicy: OverflowDisconnect})
+	client := newTestClient(c, "slow")
+	newTestClient(c, "fast")
+
+	client.enqueue(WebsocketEvent{Action: "first"})
+	client.enqueue(WebsocketEvent{Action: "second"})
+
+	if disconnects := atomic.LoadInt64(&c.egressStats.SlowConsumerDisconnects); disconnects != 1 {
+		t.Errorf("SlowConsumerDisconnects = %d, want 1", disconnects)
+	}
+
+	// the client is removed on its own go routine.
+	deadline := time.Now().Add(time.Second)
+	for {
+		c.Mutex.Lock()
+		_, slow := c.Clients["slow"]
+		_, fast := c.Clients["fast"]
+		c.Mutex.Unlock()
+
+		if !slow {
+			if !fast {
+				t.Error("the client keeping up was removed too")
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("slow client was not removed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if client.enqueue(WebsocketEvent{Action: "third"}) {
+		t.Error("enqueue after the client was removed = true, want false")
+	}
+}
+
+func TestGetWebsocketStats(t *testing.T) {
+	c := newTestController(t, WebsocketConfig{EgressQueueSize: 1, OverflowPolicy: OverflowDropNewest})
+	client := newTestClient(c, "b")
+	newTestClient(c, "a")
+
+	client.enqueue(WebsocketEvent{Action: "first"})
+	client.enqueue(WebsocketEvent{Action: "second"})
+
+	recorder := httptest.NewRecorder()
+	c.GetWebsocketStats(recorder, httptest.NewRequest("GET", "/websocket/stats", nil))
+
+	var stats WebsocketStatsResponse
+	if err := json.NewDecoder(recorder.Body).Decode(&stats); err != nil {
+		t.Fatalf("decoding stats: %v", err)
+	}
+
+	if stats.Policy != OverflowDropNewest || stats.QueueSize != 1 || stats.Enqueued != 1 || stats.Dropped != 1 {
+		t.Errorf("stats = %+v, want drop_newest with 1 enqueued and 1 dropped", stats)
+	}
+
+	want := []ClientEgressStats{{ClientID: "a", Encoding: EncodingJSON}, {ClientID: "b", Encoding: EncodingJSON, Queued: 1, Dropped: 1}}
+	if len(stats.Clients) != 2 || stats.Clients[0] != want[0] || stats.Clients[1] != want[1] {
+		t.Errorf("clients = %+v, want %+v", stats.Clients, want)
+	}
+}
+
+func TestParseOverflowPolicy(t *testing.T) {
+	tests := map[string]OverflowPolicy{
+		"":             OverflowDropOldest,
+		"drop_oldest":  OverflowDropOldest,
+		" DROP_NEWEST": OverflowDropNewest,
+		"disconnect":   OverflowDisconnect,
+		"something":    OverflowDropOldest,
+	}
+
+	for value, want := range tests {
+		if got := parseOverflowPolicy(value); got != want {
+			t.Errorf("parseOverflowPolicy(%q) = %s, want %s", value, got, want)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package controllers
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"sync"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/gorilla/websocket"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+/******
+
+Websocket message encodings.
+JSON is the default, clients that want smaller messages can ask for MessagePack or CBOR
+by offering the "forestbot.msgpack" or "forestbot.cbor" subprotocol (Sec-WebSocket-Protocol) when connecting.
+Binary encodings are sent as binary frames, clients can send their events in the same encoding
+(as binary frames) or as JSON text frames.
+
+Broadcasts are encoded (and compressed) once per encoding as a prepared message,
+not once for every client.
+
+******/
+
+// How a clients messages are encoded.
+type Encoding string
+
+const (
+	EncodingJSON    Encoding = "json"
+	EncodingMsgpack Encoding = "msgpack"
+	EncodingCBOR    Encoding = "cbor"
+)
+
+// Subprotocols for each encoding, the plain forestbot subprotocol is JSON.
+const (
+	msgpackSubprotocol = websocketSubprotocol + ".msgpack"
+	cborSubprotocol    = websocketSubprotocol + ".cbor"
+)
+
+// Getting the encoding for the subprotocol we agreed on during the upgrade.
+func encodingForSubprotocol(subprotocol string) Encoding {
+	switch subprotocol {
+	case msgpackSubprotocol:
+		return EncodingMsgpack
+	case cborSubprotocol:
+		return EncodingCBOR
+	default:
+		return EncodingJSON
+	}
+}
+
+var (
+	cborEncMode, _ = cbor.EncOptions{}.EncMode()
+
+	// maps decode to map[string]interface{} like they do from json, so handlers work the same for every encoding.
+	cborDecMode, _ = cbor.DecOptions{DefaultMapType: reflect.TypeOf(map[string]interface{}(nil))}.DecMode()
+)
+
+// Encoding a message, returns the frame type to send it as.
+// Every encoding uses our json struct tags, so field names are the same.
+func encodeMessage(encoding Encoding, message interface{}) (int, []byte, error) {
+	switch encoding {
+	case EncodingMsgpack:
+		var buf bytes.Buffer
+		enc := msgpack.NewEncoder(&buf)
+		enc.SetCustomStructTag("json")
+		if err := enc.Encode(message); err != nil {
+			return 0, nil, err
+		}
+		return websocket.BinaryMessage, buf.Bytes(), nil
+
+	case EncodingCBOR:
+		data, err := cborEncMode.Marshal(message)
+		return websocket.BinaryMessage, data, err
+
+	default:
+		data, err := json.Marshal(message)
+		return websocket.TextMessage, data, err
+	}
+}
+
+// Decoding an event a client sent, text frames are always json.
+func decodeEvent(encoding Encoding, messageType int, data []byte, event *WebsocketEvent) error {
+	if messageType == websocket.TextMessage {
+		return json.Unmarshal(data, event)
+	}
+
+	switch encoding {
+	case EncodingMsgpack:
+		dec := msgpack.NewDecoder(bytes.NewReader(data))
+		dec.SetCustomStructTag("json")
+		dec.UseLooseInterfaceDecoding(true)
+		return dec.Decode(event)
+
+	case EncodingCBOR:
+		return cborDecMode.Unmarshal(data, event)
+
+	default:
+		return json.Unmarshal(data, event)
+	}
+}
+
+// Writing a message to a connection in an encoding.
+// only used before the client is created, after that use the clients writeJSON.
+func writeEncoded(conn *websocket.Conn, encoding Encoding, message interface{}) error {
+	messageType, data, err := encodeMessage(encoding, message)
+	if err != nil {
+		return err
+	}
+
+	return conn.WriteMessage(messageType, data)
+}
+
+// An event waiting in a clients egress queue.
+// A broadcast shares one of these between every client, so it is encoded
+// (and compressed) at most once per encoding.
+type outboundMessage struct {
+	event WebsocketEvent
+
+	//sent even before the client authenticates, for messages meant only for
+	//this client like errors. broadcasts never are.
+	private bool
+
+	prepared map[Encoding]*websocket.PreparedMessage
+	mu       sync.Mutex
+}
+
+func newOutboundMessage(event WebsocketEvent) *outboundMessage {
+	return &outboundMessage{event: event}
+}
+
+// Getting the prepared message for an encoding, encoding it the first time it is needed.
+func (m *outboundMessage) preparedFor(encoding Encoding) (*websocket.PreparedMessage, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if prepared, ok := m.prepared[encoding]; ok {
+		return prepared, nil
+	}
+
+	messageType, data, err := encodeMessage(encoding, m.event)
+	if err != nil {
+		return nil, err
+	}
+
+	prepared, err := websocket.NewPreparedMessage(messageType, data)
+	if err != nil {
+		return nil, err
+	}
+
+	if m.prepared == nil {
+		m.prepared = make(map[Encoding]*websocket.PreparedMessage)
+	}
+	m.prepared[encoding] = prepared
+
+	return prepared, nil
+}
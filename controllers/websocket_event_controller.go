@@ -1,8 +1,12 @@
 package controllers
 
 import (
+	"errors"
 	"fmt"
+	"math"
+	"strings"
 
+	"github.com/febzey/ForestBot-Mainframe/keyservice"
 	"github.com/febzey/ForestBot-Mainframe/types"
 	"github.com/mitchellh/mapstructure"
 )
@@ -19,13 +23,32 @@ type WebsocketEvent struct {
 	//The data for the message.
 	//The data can be many of our structs below.
 	Data interface{} `json:"data"`
+
+	//Optional id the client generates for write events, we answer with an
+	//ack or nack carrying the same id once the event is saved.
+	Event_id string `json:"event_id,omitempty"`
+
+	//Sequence number for broadcasts, every broadcast gets a higher one than the last.
+	//clients keep the last one they saw to resume after reconnecting.
+	Seq uint64 `json:"seq,omitempty"`
 }
 
 // Individual Handler structure.
 // I think this struct is only used when we need to create the initial map.
 type Handler struct {
 	action  string
-	handler func(WebsocketEvent)
+	handler func(WebsocketEvent) error
+
+	//Write events that answer with ack or nack when the client sends an event_id.
+	ack bool
+
+	//Minecraft data only the active bot for a server can send,
+	//standby bots get a not_active_bot error.
+	activeBotOnly bool
+
+	//The scope the clients api key needs to send this action.
+	//empty means any client can send it (x-api-key, bot_command_result).
+	scope keyservice.Scope
 }
 
 /*
@@ -36,30 +59,80 @@ func (c *Controller) setupWebsocketEventHandlers() {
 		{
 			action:  "inbound_discord_chat",
 			handler: c.handleInboundDiscordChat,
+			scope:   keyservice.ScopeDiscordChatWrite,
+			ack:     true,
+		},
+		{
+			action:        "inbound_minecraft_chat",
+			handler:       c.handleInboundMinecraftChat,
+			scope:         keyservice.ScopeMinecraftChatWrite,
+			ack:           true,
+			activeBotOnly: true,
+		},
+		{
+			action:        "minecraft_advancement",
+			handler:       c.handleMinecraftAdvancement,
+			scope:         keyservice.ScopeMinecraftEventsWrite,
+			ack:           true,
+			activeBotOnly: true,
+		},
+		{
+			action:        "minecraft_player_join",
+			handler:       c.handleMinecraftPlayerJoin,
+			scope:         keyservice.ScopeMinecraftPresenceWrite,
+			ack:           true,
+			activeBotOnly: true,
+		},
+		{
+			action:        "minecraft_player_leave",
+			handler:       c.handleMinecraftPlayerLeave,
+			scope:         keyservice.ScopeMinecraftPresenceWrite,
+			ack:           true,
+			activeBotOnly: true,
+		},
+		{
+			action:        "minecraft_player_death",
+			handler:       c.handleMinecraftPlayerDeath,
+			scope:         keyservice.ScopeMinecraftEventsWrite,
+			ack:           true,
+			activeBotOnly: true,
 		},
 		{
-			action:  "inbound_minecraft_chat",
-			handler: c.handleInboundMinecraftChat,
+			action:        "send_update_player_list",
+			handler:       c.handleUpdatePlayerList,
+			scope:         keyservice.ScopeMinecraftPresenceWrite,
+			ack:           true,
+			activeBotOnly: true,
 		},
 		{
-			action:  "minecraft_advancement",
-			handler: c.handleMinecraftAdvancement,
+			action:  "subscribe",
+			handler: c.handleSubscribe,
+			scope:   keyservice.ScopeEventsRead,
 		},
 		{
-			action:  "minecraft_player_join",
-			handler: c.handleMinecraftPlayerJoin,
+			action:  "unsubscribe",
+			handler: c.handleUnsubscribe,
+			scope:   keyservice.ScopeEventsRead,
 		},
 		{
-			action:  "minecraft_player_leave",
-			handler: c.handleMinecraftPlayerLeave,
+			action:  "list_subscriptions",
+			handler: c.handleListSubscriptions,
+			scope:   keyservice.ScopeEventsRead,
 		},
 		{
-			action:  "minecraft_player_death",
-			handler: c.handleMinecraftPlayerDeath,
+			action:  "resume",
+			handler: c.handleResume,
+			scope:   keyservice.ScopeEventsRead,
 		},
 		{
-			action:  "send_update_player_list",
-			handler: c.handleUpdatePlayerList,
+			action:  "query",
+			handler: c.handleQuery,
+			scope:   keyservice.ScopeStatsRead,
+		},
+		{
+			//only the bot a command was sent to can answer it.
+			action:  "bot_command_result",
+			handler: c.handleBotCommandResult,
 		},
 		{
 			action:  "x-api-key",
@@ -70,6 +143,8 @@ func (c *Controller) setupWebsocketEventHandlers() {
 	for _, event := range events {
 		c.Handlers[event.action] = event
 	}
+
+	c.queries = c.queryHandlers()
 }
 
 /*
@@ -89,27 +164,73 @@ func ProcessWebsocketEvent(c *Controller) {
 		message, realClientID := messageChannel.Message, messageChannel.ClientID
 
 		// The client_id the client sent is not found.
-		if _, ok := c.Clients[message.Client_id]; !ok {
-			c.sendErrorMessage(realClientID, "The client_id you gave is not valid. or unexpected error.")
+		c.Mutex.Lock()
+		client, ok := c.Clients[message.Client_id]
+		c.Mutex.Unlock()
+
+		if !ok {
+			c.sendErrorMessage(realClientID, WebsocketErrorData{
+				Code:    "invalid_client_id",
+				Action:  message.Action,
+				Field:   "client_id",
+				Message: "The client_id you gave is not valid. or unexpected error.",
+			})
 			continue
 		}
 
 		// The client send a client_id that already exists
 		// either a bug or possible that someone found a active clients id
 		if message.Client_id != realClientID {
-			c.sendErrorMessage(realClientID, "It seems you sent a client_id that does not match the one assigned to you!")
+			c.sendErrorMessage(realClientID, WebsocketErrorData{
+				Code:    "invalid_client_id",
+				Action:  message.Action,
+				Field:   "client_id",
+				Message: "It seems you sent a client_id that does not match the one assigned to you!",
+			})
 			continue
 		}
 
 		// Looing for the 'action' message event type sent by the user
 		event, ok := c.Handlers[message.Action]
 		if !ok {
-			c.sendErrorMessage(realClientID, "Invalid event action type")
+			c.reportEventResult(message, false, &EventError{Code: codeUnknownAction, Message: "Invalid event action type"})
+			continue
+		}
+
+		// Checking the clients key has the scope for this action.
+		if event.scope != "" && !client.apiKey().HasScope(event.scope) {
+			c.reportEventResult(message, event.ack, &EventError{
+				Code:       codeMissingScope,
+				Message:    fmt.Sprintf("Your api key is missing the '%s' scope for this action.", event.scope),
+				structured: true,
+			})
 			continue
 		}
 
+		// Newer protocol versions check the data against the actions schema
+		// before the handler sees it, older ones are decoded loosely like always.
+		if schema, ok := actionSchemas[message.Action]; ok && client.Protocol >= 2 {
+			if err := schema.validate(message.Action, message.Data); err != nil {
+				c.reportEventResult(message, event.ack, err)
+				continue
+			}
+		}
+
+		// Standby bots are in the same minecraft server as the active bot,
+		// saving their data too would save everything twice.
+		if event.activeBotOnly && client.IsMcClient {
+			c.Mutex.Lock()
+			active := c.bots.isActive(client.Mc_server, client.ClientID)
+			c.Mutex.Unlock()
+
+			if !active {
+				c.reportEventResult(message, event.ack, notActiveBotError(client.Mc_server))
+				continue
+			}
+		}
+
 		if event.handler != nil {
-			event.handler(message)
+			c.reportEventResult(message, event.ack, event.handler(message))
 			continue
 		}
 	}
@@ -124,36 +245,108 @@ func ProcessWebsocketEvent(c *Controller) {
 *
 **/
 
-func (c *Controller) handleApiKey(message WebsocketEvent) {
+func (c *Controller) handleApiKey(message WebsocketEvent) error {
 	c.Mutex.Lock()
+	client, ok := c.Clients[message.Client_id]
+	c.Mutex.Unlock()
+
+	if !ok {
+		c.sendErrorMessage(message.Client_id, WebsocketErrorData{
+			Code:    "internal_error",
+			Action:  message.Action,
+			Message: "Could not find your client - Internal Server Error",
+		})
+		return nil
+	}
 
-	if c.Clients[message.Client_id].Key.Key != "" {
-		c.sendErrorMessage(message.Client_id, "You are already authenticated.")
-		return
+	if client.apiKey().Key != "" {
+		c.sendErrorMessage(message.Client_id, WebsocketErrorData{
+			Code:    "already_authenticated",
+			Action:  message.Action,
+			Message: "You are already authenticated.",
+		})
+		return nil
 	}
 
 	var apiKey string
 
 	if err := mapstructure.Decode(message.Data, &apiKey); err != nil {
-		c.sendErrorMessage(message.Client_id, "Invalid message structure for x-api-key")
-		return
+		c.sendErrorMessage(message.Client_id, WebsocketErrorData{
+			Code:    codeInvalidPayload,
+			Action:  message.Action,
+			Message: "Invalid message structure for x-api-key",
+		})
+		return nil
 	}
 
-	key, exists := c.KeyService.GetAndVerifyAPIKey(apiKey)
-	if !exists {
-		c.sendErrorMessage(message.Client_id, "Invalid api key recieved.")
-		return
+	key, err := c.KeyService.VerifyAPIKey(apiKey, "ip:"+client.RemoteIP, "conn:"+message.Client_id)
+	if err != nil {
+		// too many failed attempts, we tell the client when to try again and disconnect them.
+		var banned *keyservice.BannedError
+		if errors.As(err, &banned) {
+			c.disconnectWithError(client, WebsocketErrorData{
+				Code:       "too_many_attempts",
+				Action:     message.Action,
+				Message:    "Too many failed api key attempts, try again later.",
+				RetryAfter: int(math.Ceil(banned.RetryAfter.Seconds())),
+			})
+			return nil
+		}
+
+		if errors.Is(err, keyservice.ErrSessionTokenExpired) || errors.Is(err, keyservice.ErrSessionTokenRevoked) {
+			c.disconnectWithError(client, WebsocketErrorData{
+				Code:    "key_expired",
+				Action:  message.Action,
+				Message: "Your session token has expired, request a new one.",
+			})
+			return nil
+		}
+
+		c.sendErrorMessage(message.Client_id, WebsocketErrorData{
+			Code:    "invalid_key",
+			Action:  message.Action,
+			Message: "Invalid api key recieved.",
+		})
+		return nil
 	}
 
-	client, ok := c.Clients[message.Client_id]
-	if !ok {
-		c.sendErrorMessage(message.Client_id, "Could not find your client - Internal Server Error")
-		return
+	// A bot client can only register for a server its key is scoped to.
+	if client.IsMcClient && !key.AllowsServer(client.Mc_server) {
+		c.sendStructuredErrorMessage(message.Client_id, WebsocketErrorData{
+			Code:    "server_not_allowed",
+			Action:  message.Action,
+			Message: fmt.Sprintf("Your api key is not allowed to be used for the server '%s'.", client.Mc_server),
+		})
+		return nil
+	}
+
+	// Bots take their slot for the server once their key is verified.
+	c.Mutex.Lock()
+	active, registered := false, true
+	if client.IsMcClient {
+		active, registered = c.bots.register(client.Mc_server, client.ClientID)
+		if active {
+			c.botOnline(client.Mc_server, client.ClientID, false)
+		}
+	}
+	if registered {
+		client.Key = &key
+	}
+	c.Mutex.Unlock()
+
+	if !registered {
+		c.disconnectWithError(client, WebsocketErrorData{
+			Code:    "no_bot_slot",
+			Action:  message.Action,
+			Message: "A mc client already exists and is running for this minecraft server, and there is no room for another standby bot.",
+		})
+		return nil
 	}
 
-	client.Key = &key
+	c.KeyService.ConnectionOpened(key)
+	c.closeWhenKeyExpires(message.Client_id, key)
 
-	err := c.sendMessageByStructure(message.Client_id, WebsocketEvent{
+	err = c.sendMessageByStructure(message.Client_id, WebsocketEvent{
 		Client_id: message.Client_id,
 		Action:    "key-accepted",
 		Data:      "Authenticated successfully. Welcome to the ForestBot Control Server",
@@ -162,82 +355,147 @@ func (c *Controller) handleApiKey(message WebsocketEvent) {
 		fmt.Println(err.Error())
 	}
 
+	if client.IsMcClient && !active {
+		if err := c.sendMessageByStructure(message.Client_id, standbyEvent(client)); err != nil {
+			fmt.Println(err.Error())
+		}
+	}
+
+	return nil
 }
 
 /*
 * Handling Inbound discord chat messages from our websocket
  */
-func (c *Controller) handleInboundDiscordChat(message WebsocketEvent) {
+func (c *Controller) handleInboundDiscordChat(message WebsocketEvent) error {
 	var discordMessage types.DiscordMessage
 	if err := mapstructure.Decode(message.Data, &discordMessage); err != nil {
-		c.sendErrorMessage(message.Client_id, "Invalid message structure for inbound_discord_chat")
-		return
+		return invalidPayloadError("Invalid message structure for inbound_discord_chat")
+	}
+
+	if discordMessage.Server != "" {
+		if err := c.serverScopeError(message.Client_id, discordMessage.Server); err != nil {
+			return err
+		}
 	}
 
 	c.Logger.WebsocketInfo("Discord chat message received from client: " + fmt.Sprintf("%v", discordMessage))
-	c.BroadcastMessageToClients(message)
+
+	// without a server a bot can not tell if the message is for it, so only other clients get it.
+	if discordMessage.Server == "" {
+		c.broadcast(discordMessage.Server, message, false)
+		return nil
+	}
+
+	// the servers active bot gets the message as outbound_minecraft_chat,
+	// every other client still gets inbound_discord_chat.
+	err := c.bridgeDiscordToMinecraft(message.Client_id, discordMessage)
+
+	// the sender is told the bot did not get it, relays and dashboards still do.
+	// messages refused for the sender (rate limited, nothing left to show) are not broadcast.
+	var eventErr *EventError
+	if err == nil || (errors.As(err, &eventErr) && (eventErr.Code == codeNoBotConnected || eventErr.Code == codeDeliveryFailed)) {
+		c.broadcast(discordMessage.Server, message, false)
+	}
+
+	return err
 }
 
 /*
 * Handling minecraft inbound chat messages from our websocket.
  */
-func (c *Controller) handleInboundMinecraftChat(message WebsocketEvent) {
+func (c *Controller) handleInboundMinecraftChat(message WebsocketEvent) error {
 	var minecraftChatMessage types.MinecraftChatMessage
 	if err := mapstructure.Decode(message.Data, &minecraftChatMessage); err != nil {
-		c.sendErrorMessage(message.Client_id, "Invalid message structure for inbound_minecraft_chat")
-		return
+		return invalidPayloadError("Invalid message structure for inbound_minecraft_chat")
+	}
+
+	if err := c.serverScopeError(message.Client_id, minecraftChatMessage.Mc_server); err != nil {
+		return err
+	}
+
+	// already saved, ack it again without saving or broadcasting it twice.
+	dedupeKey := c.eventDedupeKey(message, minecraftChatMessage.Mc_server, "date")
+	if c.dedupe.isDuplicate(dedupeKey) {
+		return nil
 	}
 
 	c.Logger.WebsocketInfo("Minecraft chat message received from client: " + fmt.Sprintf("%v", minecraftChatMessage))
 
-	err := c.Database.SaveMinecraftChatMessage(minecraftChatMessage)
-	if err != nil {
-		fmt.Println(err)
-		c.sendErrorMessage(message.Client_id, "Error saving minecraft chat message to database")
+	if err := c.Database.SaveMinecraftChatMessage(minecraftChatMessage); err != nil {
+		c.Logger.Error(err.Error())
+		return databaseError("Error saving minecraft chat message to database")
 	}
 
-	c.BroadcastMessageToClients(message)
+	c.dedupe.remember(dedupeKey)
+
+	c.BroadcastMessageToClients(minecraftChatMessage.Mc_server, message)
+
+	return nil
 }
 
 /*
 * Handling inbound minecraft chat advancements from our websocket.
  */
-func (c *Controller) handleMinecraftAdvancement(message WebsocketEvent) {
+func (c *Controller) handleMinecraftAdvancement(message WebsocketEvent) error {
 	var minecraftAdvancementMessage types.MinecraftAdvancementMessage
 	if err := mapstructure.Decode(message.Data, &minecraftAdvancementMessage); err != nil {
-		c.sendErrorMessage(message.Client_id, "Invalid message structure for minecraft_advancement")
-		return
+		return invalidPayloadError("Invalid message structure for minecraft_advancement")
+	}
+
+	if err := c.serverScopeError(message.Client_id, minecraftAdvancementMessage.Mc_server); err != nil {
+		return err
+	}
+
+	// already saved, ack it again without saving or broadcasting it twice.
+	dedupeKey := c.eventDedupeKey(message, minecraftAdvancementMessage.Mc_server, "time")
+	if c.dedupe.isDuplicate(dedupeKey) {
+		return nil
 	}
 
 	c.Logger.WebsocketInfo("Minecraft advancement message received from client: " + fmt.Sprintf("%v", minecraftAdvancementMessage))
 
-	err := c.Database.SaveMinecraftAdvancementMessage(minecraftAdvancementMessage)
-	if err != nil {
-		c.sendErrorMessage(message.Client_id, "Error saving minecraft advancement message to database")
+	if err := c.Database.SaveMinecraftAdvancementMessage(minecraftAdvancementMessage); err != nil {
+		c.Logger.Error(err.Error())
+		return databaseError("Error saving minecraft advancement message to database")
 	}
 
-	c.BroadcastMessageToClients(message)
+	c.dedupe.remember(dedupeKey)
+
+	c.BroadcastMessageToClients(minecraftAdvancementMessage.Mc_server, message)
+
+	return nil
 }
 
 /*
 * Handing minecraft player join messages from our websocket.
  */
-func (c *Controller) handleMinecraftPlayerJoin(message WebsocketEvent) {
+func (c *Controller) handleMinecraftPlayerJoin(message WebsocketEvent) error {
 	var minecraftPlayerJoinMessage types.MinecraftPlayerJoinMessage
 	if err := mapstructure.Decode(message.Data, &minecraftPlayerJoinMessage); err != nil {
-		c.sendErrorMessage(message.Client_id, "minecraft_player_join")
-		return
+		return invalidPayloadError("Invalid message structure for minecraft_player_join")
+	}
+
+	if err := c.serverScopeError(message.Client_id, minecraftPlayerJoinMessage.Server); err != nil {
+		return err
+	}
+
+	// already saved, ack it again without saving or broadcasting it twice.
+	dedupeKey := c.eventDedupeKey(message, minecraftPlayerJoinMessage.Server, "timestamp")
+	if c.dedupe.isDuplicate(dedupeKey) {
+		return nil
 	}
 
 	c.Logger.WebsocketInfo("Minecraft player join message received from client: " + fmt.Sprintf("%v", minecraftPlayerJoinMessage))
 
 	data, err := c.Database.SavePlayerJoin(minecraftPlayerJoinMessage)
 	if err != nil {
-		fmt.Println(err.Error())
-		c.sendErrorMessage(message.Client_id, "Error saving minecraft player join message to database")
-		return
+		c.Logger.Error(err.Error())
+		return databaseError("Error saving minecraft player join message to database")
 	}
 
+	c.dedupe.remember(dedupeKey)
+
 	player := types.Player{
 		Username: minecraftPlayerJoinMessage.Username,
 		Uuid:     minecraftPlayerJoinMessage.Uuid,
@@ -246,105 +504,190 @@ func (c *Controller) handleMinecraftPlayerJoin(message WebsocketEvent) {
 		Head_url: head_url + minecraftPlayerJoinMessage.Username + "/16",
 	}
 
-	c.addUserToPlayerList(minecraftPlayerJoinMessage.Server, player)
+	c.Presence.Add(minecraftPlayerJoinMessage.Server, player)
 
 	switch data.Action {
 	case "new_name":
-		c.BroadcastMessageToClients(WebsocketEvent{
+		c.BroadcastMessageToClients(minecraftPlayerJoinMessage.Server, WebsocketEvent{
 			Client_id: message.Client_id,
 			Action:    "new_name",
-			Data:      map[string]interface{}{"user": data.Data, "server": c.Clients[message.Client_id].Mc_server},
+			Data:      map[string]interface{}{"user": data.Data, "server": minecraftPlayerJoinMessage.Server},
 		})
 	case "new_user":
-		c.BroadcastMessageToClients(WebsocketEvent{
+		c.BroadcastMessageToClients(minecraftPlayerJoinMessage.Server, WebsocketEvent{
 			Client_id: message.Client_id,
 			Action:    "new_user",
-			Data:      map[string]interface{}{"user": data.Data, "server": c.Clients[message.Client_id].Mc_server},
+			Data:      map[string]interface{}{"user": data.Data, "server": minecraftPlayerJoinMessage.Server},
 		})
 	case "none":
-		c.BroadcastMessageToClients(message)
+		c.BroadcastMessageToClients(minecraftPlayerJoinMessage.Server, message)
 	default:
 		c.Logger.Error("Invalid action from database")
 	}
+
+	return nil
 }
 
 /*
 * Handing minecraft player leave messages from our websocket
  */
-func (c *Controller) handleMinecraftPlayerLeave(message WebsocketEvent) {
+func (c *Controller) handleMinecraftPlayerLeave(message WebsocketEvent) error {
 	var minecraftPlayerLeaveMessage types.MinecraftPlayerLeaveMessage
 	if err := mapstructure.Decode(message.Data, &minecraftPlayerLeaveMessage); err != nil {
-		c.sendErrorMessage(message.Client_id, "minecraft_player_leave")
-		return
+		return invalidPayloadError("Invalid message structure for minecraft_player_leave")
+	}
+
+	if err := c.serverScopeError(message.Client_id, minecraftPlayerLeaveMessage.Server); err != nil {
+		return err
+	}
+
+	// already saved, ack it again without saving or broadcasting it twice.
+	dedupeKey := c.eventDedupeKey(message, minecraftPlayerLeaveMessage.Server, "timestamp")
+	if c.dedupe.isDuplicate(dedupeKey) {
+		return nil
 	}
 
 	c.Logger.WebsocketInfo("Minecraft player leave message received from client: " + fmt.Sprintf("%v", minecraftPlayerLeaveMessage))
 
 	if err := c.Database.SavePlayerLeave(minecraftPlayerLeaveMessage); err != nil {
-		c.sendErrorMessage(message.Client_id, "Error saving minecraft player leave message to database")
-		return
+		c.Logger.Error(err.Error())
+		return databaseError("Error saving minecraft player leave message to database")
 	}
 
-	c.removeUserFromPlayerList(minecraftPlayerLeaveMessage.Server, minecraftPlayerLeaveMessage.Username)
+	c.dedupe.remember(dedupeKey)
+
+	c.Presence.Remove(minecraftPlayerLeaveMessage.Server, minecraftPlayerLeaveMessage.Username)
+
+	c.BroadcastMessageToClients(minecraftPlayerLeaveMessage.Server, message)
 
-	c.BroadcastMessageToClients(message)
+	return nil
 }
 
 /*
 * Handling minecraft player deaths and kills
  */
-func (c *Controller) handleMinecraftPlayerDeath(message WebsocketEvent) {
+func (c *Controller) handleMinecraftPlayerDeath(message WebsocketEvent) error {
 	var minecraftPlayerDeathMessage types.MinecraftPlayerDeathMessage
 	if err := mapstructure.Decode(message.Data, &minecraftPlayerDeathMessage); err != nil {
-		c.sendErrorMessage(message.Client_id, "minecraft_player_death")
-		return
+		return invalidPayloadError("Invalid message structure for minecraft_player_death")
+	}
+
+	if err := c.serverScopeError(message.Client_id, minecraftPlayerDeathMessage.Mc_server); err != nil {
+		return err
+	}
+
+	// already saved, ack it again without saving or broadcasting it twice.
+	dedupeKey := c.eventDedupeKey(message, minecraftPlayerDeathMessage.Mc_server, "time")
+	if c.dedupe.isDuplicate(dedupeKey) {
+		return nil
 	}
 
 	c.Logger.WebsocketInfo("Minecraft player death message received from client: " + fmt.Sprintf("%v", minecraftPlayerDeathMessage))
 
 	if err := c.Database.InsertPlayerDeathOrKill(minecraftPlayerDeathMessage); err != nil {
-		fmt.Println(err, " error saving death and or kills")
-		c.sendErrorMessage(message.Client_id, "Error saving minecraft player death message to database")
-		return
+		c.Logger.Error(fmt.Sprintf("%v error saving death and or kills", err))
+		return databaseError("Error saving minecraft player death message to database")
 	}
 
-	c.BroadcastMessageToClients(message)
+	c.dedupe.remember(dedupeKey)
+
+	c.BroadcastMessageToClients(minecraftPlayerDeathMessage.Mc_server, message)
+
+	return nil
 }
 
 /*
 * Handling minecraft server lists, and users playtime update
+* Playtime is added for every player in the list, so a nack for a partly saved list
+* is not retryable, sending the list again would add playtime twice.
  */
-func (c *Controller) handleUpdatePlayerList(message WebsocketEvent) {
+func (c *Controller) handleUpdatePlayerList(message WebsocketEvent) error {
 	dataMap, ok := message.Data.(map[string]interface{})
 	if !ok {
-		c.sendErrorMessage(message.Client_id, "send_update_player_list")
-		return
+		return invalidPayloadError("The data for send_update_player_list must be an object")
 	}
 
 	// Extract the "players" array from the map
 	playersArray, ok := dataMap["players"].([]interface{})
 	if !ok {
-		c.Logger.Error("Expected 'players' field to be a []interface{}")
-		return
+		return &EventError{Code: codeInvalidPayload, Field: "players", Message: "Expected 'players' field to be an array for send_update_player_list"}
 	}
 
 	// Directly decode []interface{} into []types.Player
 	var minecraftPlayerListArray []types.Player
 
 	if err := mapstructure.Decode(playersArray, &minecraftPlayerListArray); err != nil {
-		c.sendErrorMessage(message.Client_id, "send_update_player_list")
-		return
+		return &EventError{Code: codeInvalidPayload, Field: "players", Message: "Invalid player structure in 'players' for send_update_player_list"}
+	}
+
+	// Every player in the list has to be for a server the key is scoped to.
+	for _, player := range minecraftPlayerListArray {
+		if err := c.serverScopeError(message.Client_id, player.Server); err != nil {
+			return err
+		}
+	}
+
+	// The first list after the server had no bot, fixing up who left or stayed while it was gone.
+	// only a bot client sees its whole server, other clients can not empty or reconcile its list.
+	c.Mutex.Lock()
+	var mcServer string
+	if client, ok := c.Clients[message.Client_id]; ok && client.IsMcClient {
+		mcServer = client.Mc_server
+	}
+	c.Mutex.Unlock()
+
+	if mcServer != "" {
+		c.reconcilePlayerList(mcServer, minecraftPlayerListArray)
 	}
 
-	// Update player playtime and add to player list
+	// Update player playtime, grouping the players by server for their lists.
+	// the bots own server is always in there, an empty list means nobody is online.
+	playersByServer := map[string][]types.Player{}
+	if mcServer != "" {
+		playersByServer[mcServer] = []types.Player{}
+	}
+
+	failed := 0
 	for _, player := range minecraftPlayerListArray {
 		if err := c.Database.UpdatePlayerPlaytime(player.Uuid, player.Server); err != nil {
-			c.sendErrorMessage(message.Client_id, "Error updating player playtime in database")
-			continue
+			c.Logger.Error(err.Error())
+			failed++
 		}
 
 		player.Head_url = head_url + player.Username + "/16"
+		player.Status = ""
 
-		c.addUserToPlayerList(player.Server, player)
+		server := player.Server
+		for existing := range playersByServer {
+			if strings.EqualFold(existing, server) {
+				server = existing
+			}
+		}
+		playersByServer[server] = append(playersByServer[server], player)
 	}
+
+	// The list is everyone online, so anyone who joined or left without us
+	// getting the event is caught here.
+	for server, players := range playersByServer {
+		diff := c.Presence.Replace(server, players)
+		if diff.Initial || (len(diff.Joined) == 0 && len(diff.Left) == 0) {
+			continue
+		}
+
+		c.Logger.WebsocketInfo(fmt.Sprintf("Player list for %s changed without events, %d joined, %d left", server, len(diff.Joined), len(diff.Left)))
+		c.BroadcastMessageToClients(server, WebsocketEvent{
+			Client_id: message.Client_id,
+			Action:    "player_list_diff",
+			Data:      diff,
+		})
+	}
+
+	if failed > 0 {
+		return &EventError{
+			Code:    codeDatabaseError,
+			Message: fmt.Sprintf("Error updating player playtime in database for %d of %d players", failed, len(minecraftPlayerListArray)),
+		}
+	}
+
+	return nil
 }
@@ -0,0 +1,206 @@
+package controllers
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mitchellh/mapstructure"
+)
+
+/******
+
+Event sequence numbers and resumable sessions.
+Every broadcast gets a sequence number and is kept in a ring buffer for its mc server,
+a client that reconnects sends "resume" with the last sequence it saw and gets
+everything it missed replayed, as long as we still have it.
+
+Sequence numbers start at the time the server started (in microseconds), so they keep
+going up across restarts, and a client resuming from before a restart is told to resync
+instead of silently missing events.
+
+******/
+
+// One broadcast we kept for replaying.
+type historyEntry struct {
+	server string
+	event  WebsocketEvent
+}
+
+// A fixed size ring buffer of broadcasts for one mc server.
+type eventRing struct {
+	entries []historyEntry
+	start   int
+	count   int
+
+	//the highest sequence that was pushed out of the buffer.
+	evictedUpTo uint64
+}
+
+func (r *eventRing) push(entry historyEntry) {
+	if len(r.entries) == 0 {
+		r.evictedUpTo = entry.event.Seq
+		return
+	}
+
+	if r.count == len(r.entries) {
+		r.evictedUpTo = r.entries[r.start].event.Seq
+		r.entries[r.start] = entry
+		r.start = (r.start + 1) % len(r.entries)
+		return
+	}
+
+	r.entries[(r.start+r.count)%len(r.entries)] = entry
+	r.count++
+}
+
+// Every entry after a sequence, oldest first.
+func (r *eventRing) since(seq uint64) []historyEntry {
+	var entries []historyEntry
+	for i := 0; i < r.count; i++ {
+		entry := r.entries[(r.start+i)%len(r.entries)]
+		if entry.event.Seq > seq {
+			entries = append(entries, entry)
+		}
+	}
+
+	return entries
+}
+
+// Broadcast history for every mc server.
+type eventHistory struct {
+	//the last sequence number given out.
+	seq uint64
+
+	//the first sequence number this process gave out.
+	firstSeq uint64
+
+	//ring buffers by lowercase server name, "" is for events without a server.
+	rings map[string]*eventRing
+	size  int
+
+	//held while assigning a sequence and enqueuing the broadcast,
+	//so every client gets events in sequence order.
+	mu *sync.Mutex
+}
+
+func newEventHistory(size int) *eventHistory {
+	start := uint64(time.Now().UnixNano() / int64(time.Microsecond))
+
+	return &eventHistory{
+		seq:      start,
+		firstSeq: start + 1,
+		rings:    make(map[string]*eventRing),
+		size:     size,
+		mu:       &sync.Mutex{},
+	}
+}
+
+// Giving a broadcast its sequence number and saving it.
+// must be called while holding the history lock.
+func (h *eventHistory) record(mcServer string, event WebsocketEvent) WebsocketEvent {
+	h.seq++
+	event.Seq = h.seq
+
+	key := strings.ToLower(mcServer)
+	ring, ok := h.rings[key]
+	if !ok {
+		ring = &eventRing{entries: make([]historyEntry, h.size)}
+		h.rings[key] = ring
+	}
+
+	ring.push(historyEntry{server: mcServer, event: event})
+
+	return event
+}
+
+// The body for the resume action.
+type ResumeRequest struct {
+	//the last sequence number the client saw.
+	Seq uint64 `json:"seq"`
+}
+
+// Sent after the missed events are replayed.
+type ResumeResult struct {
+	From     uint64 `json:"from"`
+	To       uint64 `json:"to"`
+	Replayed int    `json:"replayed"`
+}
+
+/*
+* Handling resume, replaying the broadcasts a client missed since a sequence number.
+* Only events matching the clients current subscriptions are replayed, so a client
+* should send its subscriptions before resuming.
+ */
+func (c *Controller) handleResume(message WebsocketEvent) error {
+	var req ResumeRequest
+	if err := mapstructure.Decode(message.Data, &req); err != nil {
+		return invalidPayloadError("Invalid message structure for resume")
+	}
+
+	h := c.history
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	c.Mutex.Lock()
+	client, ok := c.Clients[message.Client_id]
+	c.Mutex.Unlock()
+
+	if !ok {
+		return nil
+	}
+
+	// from before a restart, or a sequence we never gave out.
+	if req.Seq+1 < h.firstSeq || req.Seq > h.seq {
+		return resyncRequiredError("Your sequence is from before a server restart, resync your state.")
+	}
+
+	c.Mutex.Lock()
+	var missed []historyEntry
+	gap := false
+	for server, ring := range h.rings {
+		// events the client could want were already pushed out of the buffer.
+		if ring.evictedUpTo > req.Seq && client.Subscriptions.MatchesServer(server) {
+			gap = true
+			break
+		}
+
+		for _, entry := range ring.since(req.Seq) {
+			if client.Subscriptions.Matches(entry.server, entry.event.Action) {
+				missed = append(missed, entry)
+			}
+		}
+	}
+	c.Mutex.Unlock()
+
+	if gap {
+		return resyncRequiredError("Too many events were missed to replay them, resync your state.")
+	}
+
+	if free := cap(client.Egress) - len(client.Egress); len(missed) >= free {
+		return resyncRequiredError(fmt.Sprintf("%d missed events is more than we can queue for you, resync your state.", len(missed)))
+	}
+
+	sort.Slice(missed, func(i, j int) bool {
+		return missed[i].event.Seq < missed[j].event.Seq
+	})
+
+	for _, entry := range missed {
+		client.enqueue(entry.event)
+	}
+
+	client.enqueue(WebsocketEvent{
+		Client_id: message.Client_id,
+		Action:    "resumed",
+		Data:      ResumeResult{From: req.Seq, To: h.seq, Replayed: len(missed)},
+	})
+
+	return nil
+}
+
+// Telling a client we can not replay what it missed.
+func resyncRequiredError(reason string) *EventError {
+	return &EventError{Code: "resync_required", Message: reason, structured: true}
+}
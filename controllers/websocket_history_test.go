@@ -0,0 +1,193 @@
+package controllers
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func ringSeqs(entries []historyEntry) []uint64 {
+	seqs := []uint64{}
+	for _, entry := range entries {
+		seqs = append(seqs, entry.event.Seq)
+	}
+	return seqs
+}
+
+func TestEventRingEviction(t *testing.T) {
+	ring := &eventRing{entries: make([]historyEntry, 3)}
+
+	for seq := uint64(1); seq <= 5; seq++ {
+		ring.push(historyEntry{event: WebsocketEvent{Seq: seq}})
+	}
+
+	if got := ringSeqs(ring.since(0)); !reflect.DeepEqual(got, []uint64{3, 4, 5}) {
+		t.Errorf("since(0) = %v, want the last 3 events", got)
+	}
+	if got := ringSeqs(ring.since(4)); !reflect.DeepEqual(got, []uint64{5}) {
+		t.Errorf("since(4) = %v, want [5]", got)
+	}
+	if ring.evictedUpTo != 2 {
+		t.Errorf("evictedUpTo = %d, want 2", ring.evictedUpTo)
+	}
+}
+
+func TestEventRingWithoutRoom(t *testing.T) {
+	// WEBSOCKET_HISTORY_SIZE=0 keeps nothing, every event counts as evicted.
+	ring := &eventRing{}
+	ring.push(historyEntry{event: WebsocketEvent{Seq: 7}})
+
+	if got := ring.since(0); len(got) != 0 {
+		t.Errorf("since(0) = %v, want nothing", ringSeqs(got))
+	}
+	if ring.evictedUpTo != 7 {
+		t.Errorf("evictedUpTo = %d, want 7", ring.evictedUpTo)
+	}
+}
+
+// A controller with just the history and one client, enough for handleResume.
+func newResumeTestController(historySize int, egressSize int) (*Controller, *WebsocketClient) {
+	c := &Controller{
+		Mutex:       &sync.Mutex{},
+		Clients:     make(map[string]*WebsocketClient),
+		history:     newEventHistory(historySize),
+		egressStats: &EgressStats{},
+	}
+
+	client := &WebsocketClient{
+		ClientID:      "client",
+		Egress:        make(chan *outboundMessage, egressSize),
+		Subscriptions: NewSubscriptions(),
+		Controller:    c,
+	}
+	c.Clients[client.ClientID] = client
+
+	return c, client
+}
+
+func recordTestEvent(c *Controller, server string, action string) uint64 {
+	return c.history.record(server, WebsocketEvent{Action: action}).Seq
+}
+
+func resumeFrom(c *Controller, seq uint64) error {
+	return c.handleResume(WebsocketEvent{Client_id: "client", Action: "resume", Data: map[string]interface{}{"seq": seq}})
+}
+
+func drainEgress(client *WebsocketClient) []WebsocketEvent {
+	var events []WebsocketEvent
+	for len(client.Egress) > 0 {
+		events = append(events, (<-client.Egress).event)
+	}
+	return events
+}
+
+func isResyncRequired(err error) bool {
+	var eventErr *EventError
+	return errors.As(err, &eventErr) && eventErr.Code == "resync_required"
+}
+
+func TestResumeReplaysInOrder(t *testing.T) {
+	c, client := newResumeTestController(10, 16)
+
+	seen := recordTestEvent(c, "a", "inbound_minecraft_chat")
+	first := recordTestEvent(c, "b", "inbound_minecraft_chat")
+	second := recordTestEvent(c, "A", "minecraft_player_join")
+	third := recordTestEvent(c, "", "inbound_discord_chat")
+
+	if err := resumeFrom(c, seen); err != nil {
+		t.Fatalf("resume = %v", err)
+	}
+
+	events := drainEgress(client)
+	if len(events) != 4 {
+		t.Fatalf("got %d events, want 3 replayed and resumed", len(events))
+	}
+
+	got := []uint64{events[0].Seq, events[1].Seq, events[2].Seq}
+	if !reflect.DeepEqual(got, []uint64{first, second, third}) {
+		t.Errorf("replayed %v, want %v in order", got, []uint64{first, second, third})
+	}
+
+	result, ok := events[3].Data.(ResumeResult)
+	if events[3].Action != "resumed" || !ok || result.Replayed != 3 || result.From != seen || result.To != third {
+		t.Errorf("last event = %+v, want resumed from %d to %d with 3 replayed", events[3], seen, third)
+	}
+}
+
+func TestResumeOnlySubscribed(t *testing.T) {
+	c, client := newResumeTestController(2, 16)
+	client.Subscriptions.Subscribe(SubscriptionRequest{Servers: []string{"a"}})
+
+	seen := recordTestEvent(c, "a", "inbound_minecraft_chat")
+
+	// server b overflows its buffer, the client does not care about it.
+	for i := 0; i < 5; i++ {
+		recordTestEvent(c, "b", "inbound_minecraft_chat")
+	}
+	missed := recordTestEvent(c, "a", "inbound_minecraft_chat")
+
+	if err := resumeFrom(c, seen); err != nil {
+		t.Fatalf("resume = %v, want no resync for a server the client is not subscribed to", err)
+	}
+
+	events := drainEgress(client)
+	if len(events) != 2 || events[0].Seq != missed || events[1].Action != "resumed" {
+		t.Errorf("got %+v, want only the missed event for server a then resumed", events)
+	}
+}
+
+func TestResumeResyncRequired(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(c *Controller) uint64
+	}{
+		{"events were evicted", func(c *Controller) uint64 {
+			seen := recordTestEvent(c, "a", "inbound_minecraft_chat")
+			for i := 0; i < 4; i++ {
+				recordTestEvent(c, "a", "inbound_minecraft_chat")
+			}
+			return seen
+		}},
+		{"sequence from before a restart", func(c *Controller) uint64 {
+			recordTestEvent(c, "a", "inbound_minecraft_chat")
+			return c.history.firstSeq - 2
+		}},
+		{"sequence never given out", func(c *Controller) uint64 {
+			return recordTestEvent(c, "a", "inbound_minecraft_chat") + 1
+		}},
+		{"more than the egress queue holds", func(c *Controller) uint64 {
+			seen := recordTestEvent(c, "a", "inbound_minecraft_chat")
+			recordTestEvent(c, "a", "inbound_minecraft_chat")
+			recordTestEvent(c, "b", "inbound_minecraft_chat")
+			return seen
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c, client := newResumeTestController(3, 2)
+
+			if err := resumeFrom(c, test.setup(c)); !isResyncRequired(err) {
+				t.Errorf("resume = %v, want resync_required", err)
+			}
+			if events := drainEgress(client); len(events) != 0 {
+				t.Errorf("got %d events, want nothing replayed", len(events))
+			}
+		})
+	}
+}
+
+func TestResumeNothingMissed(t *testing.T) {
+	c, client := newResumeTestController(3, 2)
+	seen := recordTestEvent(c, "a", "inbound_minecraft_chat")
+
+	if err := resumeFrom(c, seen); err != nil {
+		t.Fatalf("resume = %v", err)
+	}
+
+	events := drainEgress(client)
+	if len(events) != 1 || events[0].Action != "resumed" {
+		t.Errorf("got %+v, want just resumed", events)
+	}
+}
@@ -0,0 +1,145 @@
+package controllers
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/febzey/ForestBot-Mainframe/types"
+)
+
+/******
+
+Player lists while a server has no bot.
+When the active bot for a server disconnects (and no standby takes over) we can not see
+who is online anymore, so every player on that servers list is marked "unknown".
+
+If the bot does not come back within WEBSOCKET_PLAYER_LIST_GRACE_SECONDS the list is removed
+and every player on it gets a logout in playerActivity, flagged as inferred, at the time the bot left.
+
+When a bot is back for the server, its first send_update_player_list is compared with the list we had:
+- back within the grace period: players missing from the new list get an inferred logout.
+- back after the list expired: players still online get an inferred login, they never left.
+
+******/
+
+// A servers player list while its bot is gone.
+type stalePlayerList struct {
+	//milliseconds, when the bot disconnected.
+	since int64
+
+	//removes the list once the grace period is over.
+	timer *time.Timer
+
+	//true once the list was removed and the players were logged out.
+	expired bool
+
+	//the players that were logged out when the list expired.
+	loggedOut []types.Player
+}
+
+/*
+Marking every player on a servers list as unknown, called when its bot disconnects
+without a standby to take over. must be called while holding the controllers mutex,
+so it always happens before the next bot for the server can send its list.
+*/
+func (c *Controller) markPlayerListUnknown(server string) {
+	key := strings.ToLower(server)
+	if stale, ok := c.stalePlayerLists[key]; ok && stale.timer != nil {
+		stale.timer.Stop()
+	}
+
+	stale := &stalePlayerList{since: time.Now().UnixMilli()}
+	c.stalePlayerLists[key] = stale
+
+	if count := c.Presence.MarkUnknown(server); count > 0 {
+		c.Logger.WebsocketInfo(fmt.Sprintf("Bot for %s is gone, %d players marked unknown", server, count))
+	}
+
+	stale.timer = time.AfterFunc(c.Config.PlayerListGrace, func() {
+		c.expireStalePlayerList(server, stale)
+	})
+}
+
+// Removing a stale player list once the grace period is over, and logging everyone on it out.
+func (c *Controller) expireStalePlayerList(server string, stale *stalePlayerList) {
+	c.Mutex.Lock()
+
+	// the bot came back, or disconnected again and started a new grace period.
+	if c.stalePlayerLists[strings.ToLower(server)] != stale || stale.expired {
+		c.Mutex.Unlock()
+		return
+	}
+
+	stale.expired = true
+	stale.loggedOut = c.Presence.RemoveServer(server)
+	players := stale.loggedOut
+
+	c.Mutex.Unlock()
+
+	if len(players) == 0 {
+		return
+	}
+
+	c.Logger.WebsocketInfo(fmt.Sprintf("Bot for %s did not come back, %d players logged out", server, len(players)))
+
+	if err := c.Database.SaveInferredActivity(players, "logout", stale.since); err != nil {
+		c.Logger.Error(err.Error())
+	}
+}
+
+/*
+Comparing the first player list a bot sends after its server had no bot,
+with the list we had before. Does nothing if the server was not stale.
+*/
+func (c *Controller) reconcilePlayerList(server string, players []types.Player) {
+	key := strings.ToLower(server)
+
+	c.Mutex.Lock()
+
+	stale, ok := c.stalePlayerLists[key]
+	if !ok {
+		c.Mutex.Unlock()
+		return
+	}
+
+	delete(c.stalePlayerLists, key)
+	stale.timer.Stop()
+
+	current := map[string]bool{}
+	for _, player := range players {
+		current[player.Uuid] = true
+	}
+
+	// players that left while the bot was gone, and players that never left.
+	var left, stayed []types.Player
+
+	if !stale.expired {
+		left = c.Presence.Retain(server, func(player types.Player) bool {
+			return current[player.Uuid]
+		})
+	} else {
+		for _, player := range stale.loggedOut {
+			if current[player.Uuid] {
+				player.Status = ""
+				stayed = append(stayed, player)
+			}
+		}
+	}
+
+	c.Mutex.Unlock()
+
+	c.Logger.WebsocketInfo(fmt.Sprintf("Player list for %s reconciled, %d players left while the bot was gone, %d were still online", server, len(left), len(stayed)))
+
+	if len(left) > 0 {
+		if err := c.Database.SaveInferredActivity(left, "logout", stale.since); err != nil {
+			c.Logger.Error(err.Error())
+		}
+	}
+
+	if len(stayed) > 0 {
+		if err := c.Database.SaveInferredActivity(stayed, "login", time.Now().UnixMilli()); err != nil {
+			c.Logger.Error(err.Error())
+		}
+	}
+}
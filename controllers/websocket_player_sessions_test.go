@@ -0,0 +1,244 @@
+package controllers
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/febzey/ForestBot-Mainframe/database"
+	"github.com/febzey/ForestBot-Mainframe/types"
+)
+
+/*
+A database driver that keeps every statement executed instead of running it,
+so we can check what would have been saved without a MySQL server.
+*/
+type recordingDriver struct {
+	mu   sync.Mutex
+	logs map[string]*execLog
+}
+
+type execLog struct {
+	mu    sync.Mutex
+	execs [][]driver.Value
+}
+
+var testDriver = &recordingDriver{logs: make(map[string]*execLog)}
+
+func init() {
+	sql.Register("forestbot-recording", testDriver)
+}
+
+func (d *recordingDriver) Open(name string) (driver.Conn, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return &recordingConn{log: d.logs[name]}, nil
+}
+
+type recordingConn struct{ log *execLog }
+
+func (c *recordingConn) Prepare(query string) (driver.Stmt, error) { return &recordingStmt{c.log}, nil }
+func (c *recordingConn) Close() error                              { return nil }
+func (c *recordingConn) Begin() (driver.Tx, error)                 { return nil, errors.New("not supported") }
+
+type recordingStmt struct{ log *execLog }
+
+func (s *recordingStmt) Close() error  { return nil }
+func (s *recordingStmt) NumInput() int { return -1 }
+
+func (s *recordingStmt) Exec(args []driver.Value) (driver.Result, error) {
+	s.log.mu.Lock()
+	defer s.log.mu.Unlock()
+
+	s.log.execs = append(s.log.execs, args)
+	return driver.RowsAffected(1), nil
+}
+
+func (s *recordingStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return nil, errors.New("not supported")
+}
+
+// A database that records what it is asked to save, one per test.
+func newRecordingDatabase(t *testing.T) (*database.Database, *execLog) {
+	log := &execLog{}
+
+	testDriver.mu.Lock()
+	testDriver.logs[t.Name()] = log
+	testDriver.mu.Unlock()
+
+	pool, err := sql.Open("forestbot-recording", t.Name())
+	if err != nil {
+		t.Fatalf("sql.Open: %v", err)
+	}
+	t.Cleanup(func() { pool.Close() })
+
+	return &database.Database{Pool: pool}, log
+}
+
+// The inferred activity saved so far, as "username type" pairs.
+func (l *execLog) inferredActivity() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	activity := []string{}
+	for _, args := range l.execs {
+		activity = append(activity, args[1].(string)+" "+args[3].(string))
+	}
+	return activity
+}
+
+func (l *execLog) dates() []int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var dates []int64
+	for _, args := range l.execs {
+		dates = append(dates, args[2].(int64))
+	}
+	return dates
+}
+
+func newPlayerListTestController(t *testing.T, grace time.Duration) (*Controller, *execLog) {
+	c := newTestController(t, WebsocketConfig{EgressQueueSize: 1, PlayerListGrace: grace})
+	db, log := newRecordingDatabase(t)
+	c.Database = db
+
+	c.Presence.Replace("SimplyVanilla", []types.Player{
+		{Username: "a", Uuid: "1", Server: "SimplyVanilla"},
+		{Username: "b", Uuid: "2", Server: "SimplyVanilla"},
+		{Username: "c", Uuid: "3", Server: "SimplyVanilla"},
+	})
+
+	return c, log
+}
+
+// What removeWebSocketClient does when the last bot for a server leaves.
+func markUnknown(c *Controller, server string) {
+	c.Mutex.Lock()
+	defer c.Mutex.Unlock()
+
+	c.markPlayerListUnknown(server)
+}
+
+func playerNames(players []types.Player) []string {
+	names := []string{}
+	for _, player := range players {
+		names = append(names, player.Username+":"+player.Status)
+	}
+	return names
+}
+
+func TestPlayerListUnknownWhileBotIsGone(t *testing.T) {
+	c, log := newPlayerListTestController(t, time.Hour)
+
+	markUnknown(c, "simplyvanilla")
+
+	players, _ := c.Presence.List("simplyvanilla")
+	got := playerNames(players)
+
+	if !reflect.DeepEqual(got, []string{"a:unknown", "b:unknown", "c:unknown"}) {
+		t.Errorf("players = %v, want every player unknown", got)
+	}
+
+	// we do not know who left, so nothing is saved until the bot is back or the list expires.
+	if activity := log.inferredActivity(); len(activity) != 0 {
+		t.Errorf("saved %v while the list is unknown, want nothing", activity)
+	}
+}
+
+func TestReconcileAfterReconnect(t *testing.T) {
+	c, log := newPlayerListTestController(t, time.Hour)
+
+	markUnknown(c, "simplyvanilla")
+	c.Mutex.Lock()
+	since := c.stalePlayerLists["simplyvanilla"].since
+	c.Mutex.Unlock()
+
+	// the bot is back, b left while it was gone.
+	c.reconcilePlayerList("simplyvanilla", []types.Player{{Username: "a", Uuid: "1"}, {Username: "c", Uuid: "3"}})
+
+	if activity := log.inferredActivity(); !reflect.DeepEqual(activity, []string{"b logout"}) {
+		t.Errorf("saved %v, want an inferred logout for b", activity)
+	}
+	if dates := log.dates(); len(dates) != 1 || dates[0] != since {
+		t.Errorf("logout dates = %v, want when the bot left (%d)", dates, since)
+	}
+
+	players, _ := c.Presence.List("simplyvanilla")
+	got := playerNames(players)
+
+	c.Mutex.Lock()
+	_, stale := c.stalePlayerLists["simplyvanilla"]
+	c.Mutex.Unlock()
+
+	if !reflect.DeepEqual(got, []string{"a:unknown", "c:unknown"}) {
+		t.Errorf("players = %v, want a and c until the new list is saved", got)
+	}
+	if stale {
+		t.Error("list is still stale after reconciling")
+	}
+
+	// only the first list after the bot is back is compared.
+	c.reconcilePlayerList("simplyvanilla", nil)
+	if activity := log.inferredActivity(); len(activity) != 1 {
+		t.Errorf("saved %v, want nothing more for a server that is not stale", activity)
+	}
+}
+
+func TestStalePlayerListExpires(t *testing.T) {
+	c, log := newPlayerListTestController(t, 10*time.Millisecond)
+
+	markUnknown(c, "simplyvanilla")
+
+	deadline := time.Now().Add(time.Second)
+	for len(log.inferredActivity()) < 3 {
+		if time.Now().After(deadline) {
+			t.Fatalf("saved %v, want every player logged out once the grace period is over", log.inferredActivity())
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if activity := log.inferredActivity(); !reflect.DeepEqual(activity, []string{"a logout", "b logout", "c logout"}) {
+		t.Errorf("saved %v, want a logout for every player", activity)
+	}
+
+	_, ok := c.Presence.List("simplyvanilla")
+	if ok {
+		t.Error("expired player list was not removed")
+	}
+
+	// back after the list expired, a never left.
+	c.reconcilePlayerList("simplyvanilla", []types.Player{{Username: "a", Uuid: "1"}})
+
+	if activity := log.inferredActivity(); !reflect.DeepEqual(activity, []string{"a logout", "b logout", "c logout", "a login"}) {
+		t.Errorf("saved %v, want an inferred login for a", activity)
+	}
+}
+
+func TestStalePlayerListGraceRestarts(t *testing.T) {
+	c, log := newPlayerListTestController(t, time.Hour)
+
+	markUnknown(c, "simplyvanilla")
+	c.Mutex.Lock()
+	first := c.stalePlayerLists["simplyvanilla"]
+	c.Mutex.Unlock()
+
+	// a bot connected and left again before sending its list, the grace period starts over
+	// and the first timer firing late does nothing.
+	markUnknown(c, "simplyvanilla")
+	c.expireStalePlayerList("simplyvanilla", first)
+
+	if activity := log.inferredActivity(); len(activity) != 0 {
+		t.Errorf("saved %v, want nothing before the second grace period is over", activity)
+	}
+
+	_, ok := c.Presence.List("simplyvanilla")
+	if !ok {
+		t.Error("player list was removed by the first grace period")
+	}
+}
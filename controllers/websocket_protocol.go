@@ -0,0 +1,323 @@
+package controllers
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+/******
+
+Websocket protocol versions and schemas for each action.
+A client picks its protocol version with the "protocol" url query when connecting,
+clients that do not send one are on version 1, the protocol every bot used before versions existed.
+
+Version 1: payloads are decoded loosely, some errors are plain strings.
+Version 2: every payload is checked against the schema for its action before it is handled,
+and every error is structured: { code, action, field, message }.
+
+We keep accepting every version from minProtocolVersion so bots can upgrade when they are ready.
+
+******/
+
+const (
+	//the oldest protocol version we still accept.
+	minProtocolVersion = 1
+
+	//the newest protocol version, clients should use this one.
+	currentProtocolVersion = 2
+)
+
+// The data for the "protocol" event, sent to clients on version 2 and up after their id.
+type ProtocolData struct {
+	Version   int   `json:"version"`
+	Supported []int `json:"supported"`
+}
+
+// Getting the protocol version from the "protocol" url query.
+func parseProtocolVersion(value string) (int, error) {
+	if value == "" {
+		return minProtocolVersion, nil
+	}
+
+	version, err := strconv.Atoi(strings.TrimPrefix(strings.ToLower(value), "v"))
+	if err != nil || version < minProtocolVersion || version > currentProtocolVersion {
+		return 0, fmt.Errorf("unsupported protocol version '%s', supported versions are %d to %d", value, minProtocolVersion, currentProtocolVersion)
+	}
+
+	return version, nil
+}
+
+func supportedProtocolVersions() []int {
+	versions := []int{}
+	for version := minProtocolVersion; version <= currentProtocolVersion; version++ {
+		versions = append(versions, version)
+	}
+
+	return versions
+}
+
+// The json types a field can have.
+type fieldKind string
+
+const (
+	kindString fieldKind = "string"
+	kindNumber fieldKind = "number"
+	kindBool   fieldKind = "boolean"
+	kindArray  fieldKind = "array"
+	kindObject fieldKind = "object"
+
+	//anything, including null.
+	kindAny fieldKind = "any"
+)
+
+// One field in an actions data.
+type schemaField struct {
+	name     string
+	kind     fieldKind
+	required bool
+
+	//for arrays of objects, the fields of every item.
+	items []schemaField
+}
+
+// What the data for an action must look like.
+type actionSchema struct {
+	//the type of the data itself, objects are checked against fields.
+	kind fieldKind
+
+	fields []schemaField
+}
+
+// Checking data against a schema, returns an invalid_payload error naming the bad field.
+// Field names are matched without case, the same way mapstructure decodes them.
+// Fields that are not in the schema are allowed, so clients can send extra data.
+func (s *actionSchema) validate(action string, data interface{}) *EventError {
+	if !matchesKind(data, s.kind) {
+		return schemaError("", fmt.Sprintf("The data for %s must be %s", action, describeKind(s.kind)))
+	}
+
+	if s.kind != kindObject {
+		return nil
+	}
+
+	return validateFields(action, "", data.(map[string]interface{}), s.fields)
+}
+
+func validateFields(action string, prefix string, data map[string]interface{}, fields []schemaField) *EventError {
+	for _, field := range fields {
+		path := prefix + field.name
+		value, ok := lookupField(data, field.name)
+
+		if !ok || value == nil {
+			if field.required {
+				return schemaError(path, fmt.Sprintf("The '%s' field is required for %s", path, action))
+			}
+			continue
+		}
+
+		if !matchesKind(value, field.kind) {
+			return schemaError(path, fmt.Sprintf("The '%s' field must be %s for %s", path, describeKind(field.kind), action))
+		}
+
+		if field.kind != kindArray || field.items == nil {
+			continue
+		}
+
+		for i, item := range value.([]interface{}) {
+			itemPath := fmt.Sprintf("%s[%d]", path, i)
+
+			itemMap, ok := item.(map[string]interface{})
+			if !ok {
+				return schemaError(itemPath, fmt.Sprintf("The '%s' field must be an object for %s", itemPath, action))
+			}
+
+			if err := validateFields(action, itemPath+".", itemMap, field.items); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func lookupField(data map[string]interface{}, name string) (interface{}, bool) {
+	if value, ok := data[name]; ok {
+		return value, true
+	}
+
+	for key, value := range data {
+		if strings.EqualFold(key, name) {
+			return value, true
+		}
+	}
+
+	return nil, false
+}
+
+// Checking a value decoded from json is the right type.
+func matchesKind(value interface{}, kind fieldKind) bool {
+	switch kind {
+	case kindString:
+		_, ok := value.(string)
+		return ok
+	case kindNumber:
+		// json numbers are float64, msgpack and cbor also have integers.
+		switch value.(type) {
+		case float64, float32, int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+			return true
+		}
+		return false
+	case kindBool:
+		_, ok := value.(bool)
+		return ok
+	case kindArray:
+		_, ok := value.([]interface{})
+		return ok
+	case kindObject:
+		_, ok := value.(map[string]interface{})
+		return ok
+	default:
+		return true
+	}
+}
+
+// The kind with "a" or "an" in front of it, for error messages.
+func describeKind(kind fieldKind) string {
+	switch kind {
+	case kindArray:
+		return "an array"
+	case kindObject:
+		return "an object"
+	default:
+		return "a " + string(kind)
+	}
+}
+
+func schemaError(field string, message string) *EventError {
+	return &EventError{Code: codeInvalidPayload, Message: message, Field: field, structured: true}
+}
+
+/*
+The schema for every action clients can send.
+*/
+var actionSchemas = map[string]*actionSchema{
+	"inbound_discord_chat": {
+		kind: kindObject,
+		fields: []schemaField{
+			{name: "message", kind: kindString, required: true},
+			{name: "username", kind: kindString, required: true},
+			{name: "timestamp", kind: kindAny},
+			{name: "server", kind: kindString},
+			{name: "channel_id", kind: kindString},
+			{name: "guild_id", kind: kindString},
+			{name: "guild_name", kind: kindString},
+		},
+	},
+	"inbound_minecraft_chat": {
+		kind: kindObject,
+		fields: []schemaField{
+			{name: "name", kind: kindString, required: true},
+			{name: "message", kind: kindString, required: true},
+			{name: "mc_server", kind: kindString, required: true},
+			{name: "uuid", kind: kindString},
+			{name: "date", kind: kindAny},
+		},
+	},
+	"minecraft_advancement": {
+		kind: kindObject,
+		fields: []schemaField{
+			{name: "username", kind: kindString, required: true},
+			{name: "advancement", kind: kindString, required: true},
+			{name: "time", kind: kindNumber, required: true},
+			{name: "mc_server", kind: kindString, required: true},
+			{name: "uuid", kind: kindString},
+		},
+	},
+	"minecraft_player_join": {
+		kind: kindObject,
+		fields: []schemaField{
+			{name: "username", kind: kindString, required: true},
+			{name: "uuid", kind: kindString, required: true},
+			{name: "server", kind: kindString, required: true},
+			{name: "timestamp", kind: kindString},
+			{name: "latency", kind: kindNumber},
+		},
+	},
+	"minecraft_player_leave": {
+		kind: kindObject,
+		fields: []schemaField{
+			{name: "username", kind: kindString, required: true},
+			{name: "uuid", kind: kindString, required: true},
+			{name: "server", kind: kindString, required: true},
+			{name: "timestamp", kind: kindString},
+		},
+	},
+	"minecraft_player_death": {
+		kind: kindObject,
+		fields: []schemaField{
+			{name: "victim", kind: kindString, required: true},
+			{name: "death_message", kind: kindString, required: true},
+			{name: "time", kind: kindNumber, required: true},
+			{name: "type", kind: kindString, required: true},
+			{name: "mc_server", kind: kindString, required: true},
+			{name: "victimUUID", kind: kindString},
+			{name: "murderer", kind: kindAny},
+			{name: "murdererUUID", kind: kindAny},
+		},
+	},
+	"send_update_player_list": {
+		kind: kindObject,
+		fields: []schemaField{
+			{name: "players", kind: kindArray, required: true, items: []schemaField{
+				{name: "username", kind: kindString, required: true},
+				{name: "uuid", kind: kindString, required: true},
+				{name: "server", kind: kindString, required: true},
+				{name: "latency", kind: kindNumber},
+			}},
+		},
+	},
+	"subscribe": {
+		kind: kindObject,
+		fields: []schemaField{
+			{name: "servers", kind: kindArray},
+			{name: "actions", kind: kindArray},
+		},
+	},
+	"unsubscribe": {
+		kind: kindObject,
+		fields: []schemaField{
+			{name: "servers", kind: kindArray},
+			{name: "actions", kind: kindArray},
+		},
+	},
+	"list_subscriptions": {
+		kind: kindAny,
+	},
+	"resume": {
+		kind: kindObject,
+		fields: []schemaField{
+			{name: "seq", kind: kindNumber, required: true},
+		},
+	},
+	"query": {
+		kind: kindObject,
+		fields: []schemaField{
+			{name: "id", kind: kindString, required: true},
+			{name: "query", kind: kindString, required: true},
+			{name: "params", kind: kindObject},
+		},
+	},
+	"bot_command_result": {
+		kind: kindObject,
+		fields: []schemaField{
+			{name: "id", kind: kindString, required: true},
+			{name: "ok", kind: kindBool, required: true},
+			{name: "result", kind: kindAny},
+			{name: "error", kind: kindString},
+		},
+	},
+	"x-api-key": {
+		kind: kindString,
+	},
+}
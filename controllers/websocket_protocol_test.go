@@ -0,0 +1,163 @@
+package controllers
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/febzey/ForestBot-Mainframe/keyservice"
+)
+
+func TestParseProtocolVersion(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    int
+		wantErr bool
+	}{
+		{"", 1, false},
+		{"1", 1, false},
+		{"2", 2, false},
+		{"v2", 2, false},
+		{"V2", 2, false},
+		{"0", 0, true},
+		{"3", 0, true},
+		{"two", 0, true},
+	}
+
+	for _, test := range tests {
+		version, err := parseProtocolVersion(test.value)
+		if version != test.want || (err != nil) != test.wantErr {
+			t.Errorf("parseProtocolVersion(%q) = %d, %v, want %d (error %v)", test.value, version, err, test.want, test.wantErr)
+		}
+	}
+}
+
+func TestActionSchemaValidate(t *testing.T) {
+	chat := func(fields map[string]interface{}) map[string]interface{} {
+		data := map[string]interface{}{"name": "febzey", "message": "hi", "mc_server": "simplyvanilla"}
+		for name, value := range fields {
+			if value == nil {
+				delete(data, name)
+				continue
+			}
+			data[name] = value
+		}
+		return data
+	}
+
+	players := func(items ...interface{}) map[string]interface{} {
+		return map[string]interface{}{"players": items}
+	}
+	player := map[string]interface{}{"username": "febzey", "uuid": "1", "server": "simplyvanilla"}
+
+	tests := []struct {
+		name      string
+		action    string
+		data      interface{}
+		wantField string
+		wantErr   bool
+	}{
+		{"valid", "inbound_minecraft_chat", chat(nil), "", false},
+		{"extra fields are allowed", "inbound_minecraft_chat", chat(map[string]interface{}{"rank": "admin"}), "", false},
+		{"field names without case", "inbound_minecraft_chat", map[string]interface{}{"Name": "febzey", "MESSAGE": "hi", "Mc_Server": "simplyvanilla"}, "", false},
+		{"missing required field", "inbound_minecraft_chat", chat(map[string]interface{}{"message": nil}), "message", true},
+		{"null required field", "inbound_minecraft_chat", map[string]interface{}{"name": "febzey", "message": nil, "mc_server": "simplyvanilla"}, "message", true},
+		{"wrong type", "inbound_minecraft_chat", chat(map[string]interface{}{"name": float64(5)}), "name", true},
+		{"wrong optional type", "inbound_minecraft_chat", chat(map[string]interface{}{"uuid": true}), "uuid", true},
+		{"data is not an object", "inbound_minecraft_chat", "hi", "", true},
+		{"number", "resume", map[string]interface{}{"seq": "5"}, "seq", true},
+		{"array items", "send_update_player_list", players(player, player), "", false},
+		{"array item missing a field", "send_update_player_list", players(player, map[string]interface{}{"username": "a", "server": "b"}), "players[1].uuid", true},
+		{"array item not an object", "send_update_player_list", players("febzey"), "players[0]", true},
+		{"string data", "x-api-key", "key", "", false},
+		{"any data", "list_subscriptions", nil, "", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := actionSchemas[test.action].validate(test.action, test.data)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("validate = %v, want error %v", err, test.wantErr)
+			}
+			if err == nil {
+				return
+			}
+
+			if err.Code != codeInvalidPayload || err.Field != test.wantField || !err.structured {
+				t.Errorf("validate = %+v, want a structured invalid_payload for field %q", err, test.wantField)
+			}
+		})
+	}
+}
+
+// Sending one event through the event pipeline as a client on a protocol version,
+// returning the data of the error event it got back, as the client would decode it.
+func sendTestEvent(t *testing.T, protocol int, message WebsocketEvent) interface{} {
+	t.Helper()
+
+	c := newTestController(t, WebsocketConfig{EgressQueueSize: 8})
+	c.setupWebsocketEventHandlers()
+	go ProcessWebsocketEvent(c)
+
+	client := newTestClient(c, "client")
+	client.Protocol = protocol
+	client.Key = &keyservice.APIkey{Key: "key", Permissions: keyservice.APIPermissions{Read: true}}
+
+	message.Client_id = "client"
+	c.MessageChan <- MessageChannel{ClientID: "client", Message: message}
+
+	var response *outboundMessage
+	select {
+	case response = <-client.Egress:
+	case <-time.After(time.Second):
+		t.Fatal("no response was queued for the client")
+	}
+	if response.event.Action != "error" || !response.private {
+		t.Fatalf("got %+v, want an error for this client only", response)
+	}
+
+	encoded, err := json.Marshal(response.event.Data)
+	if err != nil {
+		t.Fatalf("encoding the error: %v", err)
+	}
+
+	var data interface{}
+	json.Unmarshal(encoded, &data)
+	return data
+}
+
+func TestProtocolInvalidPayload(t *testing.T) {
+	tests := []struct {
+		name    string
+		message WebsocketEvent
+		wantV1  string
+		wantV2  map[string]interface{}
+	}{
+		{
+			"wrong type",
+			WebsocketEvent{Action: "resume", Data: map[string]interface{}{"seq": "abc"}},
+			"Invalid message structure for resume",
+			map[string]interface{}{"code": "invalid_payload", "action": "resume", "field": "seq", "message": "The 'seq' field must be a number for resume"},
+		},
+		{
+			"missing required field",
+			WebsocketEvent{Action: "query", Data: map[string]interface{}{"query": "player"}},
+			"Invalid message structure for query, 'id' and 'query' are required",
+			map[string]interface{}{"code": "invalid_payload", "action": "query", "field": "id", "message": "The 'id' field is required for query"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// protocol 1 clients still get the plain string from the handler.
+			if got := sendTestEvent(t, 1, test.message); got != test.wantV1 {
+				t.Errorf("protocol 1 error = %#v, want %q", got, test.wantV1)
+			}
+
+			if got := sendTestEvent(t, 2, test.message); !reflect.DeepEqual(got, test.wantV2) {
+				t.Errorf("protocol 2 error = %#v, want %#v", got, test.wantV2)
+			}
+		})
+	}
+}
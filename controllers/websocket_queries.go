@@ -0,0 +1,281 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/febzey/ForestBot-Mainframe/database"
+	"github.com/febzey/ForestBot-Mainframe/types"
+	"github.com/mitchellh/mapstructure"
+)
+
+/******
+
+Queries over the websocket.
+Clients can look up the same data as our http routes (/playername, /quote, /top-statistic...)
+without a seperate http request, by sending the "query" action with an id they generate:
+
+{ "action": "query", "data": { "id": "1", "query": "quote", "params": { "name": "febzey", "server": "simplyvanilla" } } }
+
+the answer is a "query_result" event with the same id.
+Queries run in their own go routine so a slow query never holds up other events,
+at most WEBSOCKET_MAX_CONCURRENT_QUERIES run at the same time, queries over that get a "busy" error.
+
+******/
+
+// The data for the query action.
+type QueryRequest struct {
+	//id the client generates, sent back with the result.
+	ID string `json:"id"`
+
+	//the name of the query, example: playername
+	Query string `json:"query"`
+
+	//parameters for the query, same names as the http queries.
+	//numbers and bools are accepted and turned into strings.
+	Params map[string]string `json:"params"`
+}
+
+// The data for the query_result event.
+type QueryResult struct {
+	ID     string      `json:"id"`
+	Query  string      `json:"query"`
+	Ok     bool        `json:"ok"`
+	Result interface{} `json:"result,omitempty"`
+	Error  *QueryError `json:"error,omitempty"`
+}
+
+type QueryError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// The result for the player_list query.
+type PlayerListResult struct {
+	//the presence version, changes every time any player list changes.
+	Version uint64 `json:"version"`
+
+	Players []types.Player `json:"players"`
+}
+
+// A named query clients can run.
+type queryHandler struct {
+	//parameters that must be given.
+	required []string
+
+	run func(params map[string]string) (interface{}, error)
+}
+
+// Errors a query returns when its parameters are wrong, sent to the client as invalid_params.
+type invalidQueryParamsError struct {
+	message string
+}
+
+func (e *invalidQueryParamsError) Error() string {
+	return e.message
+}
+
+/*
+Every query a client can run, these use the same database functions as the http routes.
+*/
+func (c *Controller) queryHandlers() map[string]queryHandler {
+	return map[string]queryHandler{
+		"all_servers": {
+			run: func(params map[string]string) (interface{}, error) {
+				return c.Database.UniqueServers()
+			},
+		},
+		"playername": {
+			required: []string{"name", "server"},
+			run: func(params map[string]string) (interface{}, error) {
+				return c.Database.GetUserByName(params["name"], params["server"])
+			},
+		},
+		"playeruuid": {
+			required: []string{"uuid", "server"},
+			run: func(params map[string]string) (interface{}, error) {
+				return c.Database.GetUserByUUID(params["uuid"], params["server"])
+			},
+		},
+		"all_player_stats": {
+			required: []string{"username"},
+			run: func(params map[string]string) (interface{}, error) {
+				uuid, err := c.Database.ConvertUsernameToUUID(params["username"])
+				if err != nil {
+					return nil, err
+				}
+
+				if uuid == nil || !uuid.UUID.Valid || uuid.UUID.String == "" {
+					return nil, &invalidQueryParamsError{"Cant find the uuid."}
+				}
+
+				return c.Database.GetAllPlayerStatisticsByUUID(uuid.UUID.String)
+			},
+		},
+		"convert_username_to_uuid": {
+			required: []string{"username"},
+			run: func(params map[string]string) (interface{}, error) {
+				return c.Database.ConvertUsernameToUUID(params["username"])
+			},
+		},
+		"quote": {
+			required: []string{"name", "server"},
+			run: func(params map[string]string) (interface{}, error) {
+				return c.Database.GetRandomQuote(params["name"], params["server"])
+			},
+		},
+		"top_statistic": {
+			required: []string{"server", "statistic", "limit"},
+			run: func(params map[string]string) (interface{}, error) {
+				limit, err := strconv.Atoi(params["limit"])
+				if err != nil {
+					return nil, &invalidQueryParamsError{"Invalid 'limit' parameter"}
+				}
+
+				topStatistics, err := c.Database.GetTopStatistic(params["server"], params["statistic"], limit)
+				if errors.Is(err, database.ErrInvalidStatistic) {
+					return nil, &invalidQueryParamsError{err.Error()}
+				}
+
+				return topStatistics, err
+			},
+		},
+		"messagecount": {
+			required: []string{"username", "server"},
+			run: func(params map[string]string) (interface{}, error) {
+				return c.Database.GetMessageCount(params["username"], params["server"])
+			},
+		},
+		"wordcount": {
+			required: []string{"username", "server", "word"},
+			run: func(params map[string]string) (interface{}, error) {
+				return c.Database.GetWordOccurence(params["username"], params["server"], params["word"])
+			},
+		},
+		"namesearch": {
+			required: []string{"username", "server"},
+			run: func(params map[string]string) (interface{}, error) {
+				return c.Database.SearchUsernames(params["username"], params["server"])
+			},
+		},
+		"whois": {
+			required: []string{"username"},
+			run: func(params map[string]string) (interface{}, error) {
+				return c.Database.GetWhoisDescriptions(params["username"])
+			},
+		},
+		"online": {
+			required: []string{"username"},
+			run: func(params map[string]string) (interface{}, error) {
+				return c.onlineStatus(params["username"]), nil
+			},
+		},
+		"player_list": {
+			required: []string{"server"},
+			run: func(params map[string]string) (interface{}, error) {
+				// one snapshot, so the players and version always match.
+				snapshot := c.Presence.Snapshot()
+
+				for server, players := range snapshot.Servers {
+					if strings.EqualFold(server, params["server"]) {
+						return PlayerListResult{Version: snapshot.Version, Players: players}, nil
+					}
+				}
+
+				return nil, &invalidQueryParamsError{fmt.Sprintf("Server '%s' does not have an active player list", params["server"])}
+			},
+		},
+	}
+}
+
+/*
+* Handling query, running a named query and answering with query_result.
+ */
+func (c *Controller) handleQuery(message WebsocketEvent) error {
+	// params are strings like the http queries, numbers and bools are turned into strings
+	// so { "limit": 5 } works the same as { "limit": "5" }.
+	var req QueryRequest
+	decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{WeaklyTypedInput: true, Result: &req})
+	if err != nil {
+		return err
+	}
+
+	if err := decoder.Decode(message.Data); err != nil {
+		return invalidPayloadError("Invalid message structure for query, 'params' must be an object of strings or numbers")
+	}
+
+	if req.ID == "" || req.Query == "" {
+		return invalidPayloadError("Invalid message structure for query, 'id' and 'query' are required")
+	}
+
+	query, ok := c.queries[req.Query]
+	if !ok {
+		names := []string{}
+		for name := range c.queries {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		c.sendQueryError(message.Client_id, req, "unknown_query", fmt.Sprintf("Unknown query '%s', must be one of: %s", req.Query, strings.Join(names, ", ")))
+		return nil
+	}
+
+	for _, param := range query.required {
+		if strings.TrimSpace(req.Params[param]) == "" {
+			c.sendQueryError(message.Client_id, req, "invalid_params", fmt.Sprintf("The '%s' parameter is required for the '%s' query", param, req.Query))
+			return nil
+		}
+	}
+
+	// taking a slot before starting the go routine, so there are never more
+	// than WEBSOCKET_MAX_CONCURRENT_QUERIES of them. the rest are turned away.
+	select {
+	case c.querySlots <- struct{}{}:
+		go c.runQuery(message.Client_id, req, query)
+	default:
+		c.sendQueryError(message.Client_id, req, "busy", fmt.Sprintf("Too many queries are running, at most %d run at the same time. try again shortly.", cap(c.querySlots)))
+	}
+
+	return nil
+}
+
+// Running a query and sending the result, called as a go routine holding a query slot.
+func (c *Controller) runQuery(clientID string, req QueryRequest, query queryHandler) {
+	result, err := query.run(req.Params)
+	<-c.querySlots
+
+	if err != nil {
+		var paramsErr *invalidQueryParamsError
+		if errors.As(err, &paramsErr) {
+			c.sendQueryError(clientID, req, "invalid_params", paramsErr.message)
+			return
+		}
+
+		c.Logger.Error(err.Error())
+		c.sendQueryError(clientID, req, codeDatabaseError, "Internal Database Error")
+		return
+	}
+
+	c.sendQueryResult(clientID, QueryResult{ID: req.ID, Query: req.Query, Ok: true, Result: result})
+}
+
+func (c *Controller) sendQueryError(clientID string, req QueryRequest, code string, message string) {
+	c.sendQueryResult(clientID, QueryResult{
+		ID:    req.ID,
+		Query: req.Query,
+		Error: &QueryError{Code: code, Message: message},
+	})
+}
+
+func (c *Controller) sendQueryResult(clientID string, result QueryResult) {
+	if err := c.sendMessageByStructure(clientID, WebsocketEvent{
+		Client_id: clientID,
+		Action:    "query_result",
+		Data:      result,
+	}); err != nil {
+		c.Logger.WebsocketError(err.Error())
+	}
+}
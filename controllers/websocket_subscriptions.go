@@ -0,0 +1,317 @@
+package controllers
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/mitchellh/mapstructure"
+)
+
+/******
+
+Websocket subscriptions.
+A client picks which minecraft servers and which actions it wants broadcasted to it,
+either with the "servers" and "actions" url queries when connecting, or later
+with the "subscribe" and "unsubscribe" actions.
+
+A new client is subscribed to everything.
+The first time a client subscribes to specific servers (or actions), it only gets those,
+subscribing to "*" goes back to everything.
+
+******/
+
+// Every action we broadcast to clients, clients can only subscribe to these.
+var broadcastActions = []string{
+	"inbound_discord_chat",
+	"inbound_minecraft_chat",
+	"minecraft_advancement",
+	"minecraft_player_join",
+	"minecraft_player_leave",
+	"minecraft_player_death",
+	"new_name",
+	"new_user",
+	"bot_online",
+	"bot_offline",
+	"player_list_diff",
+}
+
+// Subscribing to this means every server or every action.
+const subscribeAll = "*"
+
+// What a client wants broadcasted to it.
+// must only be used while holding the controllers mutex.
+type Subscriptions struct {
+	//mc servers, lowercase. ignored when allServers is true.
+	servers    map[string]bool
+	allServers bool
+
+	//actions. ignored when allActions is true.
+	actions    map[string]bool
+	allActions bool
+}
+
+// The body for subscribe and unsubscribe, and what we send back to the client.
+type SubscriptionRequest struct {
+	Servers []string `json:"servers"`
+	Actions []string `json:"actions"`
+}
+
+func NewSubscriptions() *Subscriptions {
+	return &Subscriptions{
+		servers:    make(map[string]bool),
+		allServers: true,
+		actions:    make(map[string]bool),
+		allActions: true,
+	}
+}
+
+// Checking if a broadcast for a server and action should be sent to the client.
+// Events without a server (discord chat not meant for a server) only check the action.
+func (s *Subscriptions) Matches(mcServer string, action string) bool {
+	if !s.allActions && !s.actions[action] {
+		return false
+	}
+
+	if mcServer == "" || s.allServers {
+		return true
+	}
+
+	return s.servers[strings.ToLower(mcServer)]
+}
+
+// Checking if the client wants any events for a server.
+func (s *Subscriptions) MatchesServer(mcServer string) bool {
+	return mcServer == "" || s.allServers || s.servers[strings.ToLower(mcServer)]
+}
+
+// Adding servers and actions, "*" subscribes to all of them.
+func (s *Subscriptions) Subscribe(req SubscriptionRequest) {
+	for _, server := range cleanSubscriptionValues(req.Servers) {
+		if server == subscribeAll {
+			s.allServers = true
+			s.servers = make(map[string]bool)
+			continue
+		}
+
+		// the first specific server replaces "all servers".
+		if s.allServers {
+			s.allServers = false
+		}
+		s.servers[strings.ToLower(server)] = true
+	}
+
+	for _, action := range cleanSubscriptionValues(req.Actions) {
+		if action == subscribeAll {
+			s.allActions = true
+			s.actions = make(map[string]bool)
+			continue
+		}
+
+		if s.allActions {
+			s.allActions = false
+		}
+		s.actions[action] = true
+	}
+}
+
+// Removing servers and actions, "*" unsubscribes from all of them.
+// Removing one server while subscribed to every server is an error,
+// we do not keep a list of servers to exclude.
+func (s *Subscriptions) Unsubscribe(req SubscriptionRequest) error {
+	servers, actions := cleanSubscriptionValues(req.Servers), cleanSubscriptionValues(req.Actions)
+
+	for _, server := range servers {
+		if server != subscribeAll && s.allServers {
+			return fmt.Errorf("you are subscribed to every server, subscribe to the servers you want instead of unsubscribing from '%s'", server)
+		}
+	}
+
+	for _, action := range actions {
+		if action != subscribeAll && s.allActions {
+			return fmt.Errorf("you are subscribed to every action, subscribe to the actions you want instead of unsubscribing from '%s'", action)
+		}
+	}
+
+	for _, server := range servers {
+		if server == subscribeAll {
+			s.allServers = false
+			s.servers = make(map[string]bool)
+			continue
+		}
+		delete(s.servers, strings.ToLower(server))
+	}
+
+	for _, action := range actions {
+		if action == subscribeAll {
+			s.allActions = false
+			s.actions = make(map[string]bool)
+			continue
+		}
+		delete(s.actions, action)
+	}
+
+	return nil
+}
+
+// Listing the current subscriptions, "*" means everything.
+func (s *Subscriptions) List() SubscriptionRequest {
+	list := SubscriptionRequest{Servers: []string{}, Actions: []string{}}
+
+	if s.allServers {
+		list.Servers = append(list.Servers, subscribeAll)
+	} else {
+		for server := range s.servers {
+			list.Servers = append(list.Servers, server)
+		}
+		sort.Strings(list.Servers)
+	}
+
+	if s.allActions {
+		list.Actions = append(list.Actions, subscribeAll)
+	} else {
+		for action := range s.actions {
+			list.Actions = append(list.Actions, action)
+		}
+		sort.Strings(list.Actions)
+	}
+
+	return list
+}
+
+// Checking every action in a request is one we broadcast.
+func validateSubscriptionActions(actions []string) error {
+	for _, action := range cleanSubscriptionValues(actions) {
+		if action == subscribeAll {
+			continue
+		}
+
+		known := false
+		for _, broadcastAction := range broadcastActions {
+			if action == broadcastAction {
+				known = true
+				break
+			}
+		}
+
+		if !known {
+			return fmt.Errorf("unknown action: %s", action)
+		}
+	}
+
+	return nil
+}
+
+// Trimming whitespace and removing empty entries.
+func cleanSubscriptionValues(values []string) []string {
+	cleaned := []string{}
+	for _, value := range values {
+		if value = strings.TrimSpace(value); value != "" {
+			cleaned = append(cleaned, value)
+		}
+	}
+
+	return cleaned
+}
+
+// Splitting a comma seperated url query, example: "servers=simplyvanilla,2b2t"
+func splitSubscriptionQuery(value string) []string {
+	if value == "" {
+		return nil
+	}
+
+	return cleanSubscriptionValues(strings.Split(value, ","))
+}
+
+func invalidSubscriptionError(err error) *EventError {
+	return &EventError{Code: "invalid_subscription", Message: err.Error(), structured: true}
+}
+
+/*
+* Handling subscribe, adding servers and actions the client wants broadcasted to it.
+ */
+func (c *Controller) handleSubscribe(message WebsocketEvent) error {
+	var req SubscriptionRequest
+	if err := mapstructure.Decode(message.Data, &req); err != nil {
+		return invalidPayloadError("Invalid message structure for subscribe")
+	}
+
+	if err := validateSubscriptionActions(req.Actions); err != nil {
+		return invalidSubscriptionError(err)
+	}
+
+	c.Mutex.Lock()
+	client, ok := c.Clients[message.Client_id]
+	if ok {
+		client.Subscriptions.Subscribe(req)
+	}
+	c.Mutex.Unlock()
+
+	if ok {
+		c.sendSubscriptions(message.Client_id)
+	}
+
+	return nil
+}
+
+/*
+* Handling unsubscribe, removing servers and actions from the clients subscriptions.
+ */
+func (c *Controller) handleUnsubscribe(message WebsocketEvent) error {
+	var req SubscriptionRequest
+	if err := mapstructure.Decode(message.Data, &req); err != nil {
+		return invalidPayloadError("Invalid message structure for unsubscribe")
+	}
+
+	c.Mutex.Lock()
+	client, ok := c.Clients[message.Client_id]
+	var err error
+	if ok {
+		err = client.Subscriptions.Unsubscribe(req)
+	}
+	c.Mutex.Unlock()
+
+	if !ok {
+		return nil
+	}
+
+	if err != nil {
+		return invalidSubscriptionError(err)
+	}
+
+	c.sendSubscriptions(message.Client_id)
+
+	return nil
+}
+
+/*
+* Handling list_subscriptions, sending the client its current subscriptions.
+ */
+func (c *Controller) handleListSubscriptions(message WebsocketEvent) error {
+	c.sendSubscriptions(message.Client_id)
+
+	return nil
+}
+
+// Sending a client its subscriptions with the "subscriptions" action.
+func (c *Controller) sendSubscriptions(clientID string) {
+	c.Mutex.Lock()
+	client, ok := c.Clients[clientID]
+	var list SubscriptionRequest
+	if ok {
+		list = client.Subscriptions.List()
+	}
+	c.Mutex.Unlock()
+
+	if !ok {
+		return
+	}
+
+	if err := c.sendMessageByStructure(clientID, WebsocketEvent{
+		Client_id: clientID,
+		Action:    "subscriptions",
+		Data:      list,
+	}); err != nil {
+		c.Logger.WebsocketError(err.Error())
+	}
+}
@@ -22,7 +22,24 @@ type databaseOptions struct {
 type ControllerInterface interface {
 }
 
+// Opening the connection pool and checking the database is reachable.
 func Connect() (*Database, error) {
+	instance, err := Open()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := instance.Pool.Ping(); err != nil {
+		instance.Pool.Close()
+		return nil, err
+	}
+
+	return instance, nil
+}
+
+// Opening the connection pool without checking the database is reachable,
+// queries return an error until it is.
+func Open() (*Database, error) {
 
 	databaseOptions := databaseOptions{
 		User:     os.Getenv("DATABASE_USER"),
@@ -37,11 +54,6 @@ func Connect() (*Database, error) {
 		return nil, err
 	}
 
-	err = db.Ping()
-	if err != nil {
-		return nil, err
-	}
-
 	instance := &Database{
 		Pool: db,
 	}
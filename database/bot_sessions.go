@@ -0,0 +1,158 @@
+package database
+
+import (
+	"sort"
+	"strings"
+)
+
+// One stretch of time a bot was the active bot for a server.
+type BotSession struct {
+	Server    string `json:"server"`
+	ClientID  string `json:"client_id"`
+	StartedAt int64  `json:"started_at"`
+
+	//0 while the session is still going.
+	EndedAt int64 `json:"ended_at"`
+}
+
+// How much of a time window each server had an active bot collecting data.
+type BotUptime struct {
+	Server        string  `json:"server"`
+	UptimePercent float64 `json:"uptime_percent"`
+	OnlineSeconds int64   `json:"online_seconds"`
+	WindowSeconds int64   `json:"window_seconds"`
+	Sessions      int     `json:"sessions"`
+	Online        bool    `json:"online"`
+	LastOnlineAt  int64   `json:"last_online_at"`
+}
+
+func (d *Database) StartBotSession(server string, clientID string, startedAt int64) error {
+	_, err := d.Execute("INSERT INTO bot_sessions(mc_server, client_id, started_at, last_seen) VALUES (?,?,?,?)", server, clientID, startedAt, startedAt)
+	return err
+}
+
+func (d *Database) EndBotSession(clientID string, endedAt int64) error {
+	_, err := d.Execute("UPDATE bot_sessions SET ended_at = ?, last_seen = ? WHERE client_id = ? AND ended_at IS NULL", endedAt, endedAt, clientID)
+	return err
+}
+
+// Marking every open session as still going, so a session left open by a crash
+// can be ended close to when the mainframe actually stopped.
+func (d *Database) TouchBotSessions(now int64) error {
+	_, err := d.Execute("UPDATE bot_sessions SET last_seen = ? WHERE ended_at IS NULL", now)
+	return err
+}
+
+// Ending sessions left open when the mainframe stopped without closing them,
+// at the last time they were seen.
+func (d *Database) CloseStaleBotSessions() error {
+	_, err := d.Execute("UPDATE bot_sessions SET ended_at = last_seen WHERE ended_at IS NULL")
+	return err
+}
+
+// Getting the sessions that overlap a time window, for every server if server is "".
+func (d *Database) GetBotSessions(server string, since int64, until int64) ([]BotSession, error) {
+	query := "SELECT mc_server, client_id, started_at, COALESCE(ended_at, 0) FROM bot_sessions WHERE started_at < ? AND (ended_at IS NULL OR ended_at > ?)"
+	args := []interface{}{until, since}
+
+	if server != "" {
+		query += " AND mc_server = ?"
+		args = append(args, server)
+	}
+
+	rows, err := d.Query(query+" ORDER BY started_at", args...)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	sessions := []BotSession{}
+
+	for rows.Next() {
+		var session BotSession
+		if err := rows.Scan(&session.Server, &session.ClientID, &session.StartedAt, &session.EndedAt); err != nil {
+			return nil, err
+		}
+
+		sessions = append(sessions, session)
+	}
+
+	return sessions, rows.Err()
+}
+
+// Getting how much of the window between since and until (milliseconds) each server had a bot.
+// Overlapping sessions (a standby taking over) are only counted once.
+func (d *Database) GetBotUptime(server string, since int64, until int64) ([]BotUptime, error) {
+	sessions, err := d.GetBotSessions(server, since, until)
+	if err != nil {
+		return nil, err
+	}
+
+	return calculateBotUptime(sessions, since, until), nil
+}
+
+// Working out uptime from sessions, they must be sorted by when they started.
+func calculateBotUptime(sessions []BotSession, since int64, until int64) []BotUptime {
+	type serverUptime struct {
+		uptime BotUptime
+
+		//online time so far, and the end of the time counted so far.
+		onlineMs   int64
+		coveredEnd int64
+	}
+
+	servers := map[string]*serverUptime{}
+
+	for _, session := range sessions {
+		key := strings.ToLower(session.Server)
+		s, ok := servers[key]
+		if !ok {
+			s = &serverUptime{uptime: BotUptime{Server: session.Server}, coveredEnd: since}
+			servers[key] = s
+		}
+
+		end := session.EndedAt
+		if end == 0 {
+			end = until
+			s.uptime.Online = true
+		}
+
+		s.uptime.Sessions++
+		if end > s.uptime.LastOnlineAt {
+			s.uptime.LastOnlineAt = end
+		}
+
+		start := session.StartedAt
+		if start < s.coveredEnd {
+			start = s.coveredEnd
+		}
+		if end > until {
+			end = until
+		}
+
+		if end > start {
+			s.onlineMs += end - start
+			s.coveredEnd = end
+		}
+	}
+
+	window := until - since
+	uptimes := []BotUptime{}
+
+	for _, s := range servers {
+		s.uptime.OnlineSeconds = s.onlineMs / 1000
+		s.uptime.WindowSeconds = window / 1000
+		if window > 0 {
+			s.uptime.UptimePercent = float64(int64(float64(s.onlineMs)/float64(window)*10000)) / 100
+		}
+
+		uptimes = append(uptimes, s.uptime)
+	}
+
+	sort.Slice(uptimes, func(i, j int) bool {
+		return uptimes[i].Server < uptimes[j].Server
+	})
+
+	return uptimes
+}
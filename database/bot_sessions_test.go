@@ -0,0 +1,87 @@
+package database
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCalculateBotUptime(t *testing.T) {
+	// a 100 second window.
+	const since, until = int64(1_000_000), int64(1_100_000)
+
+	session := func(startSeconds int64, endSeconds int64) BotSession {
+		s := BotSession{Server: "simplyvanilla", StartedAt: since + startSeconds*1000}
+		if endSeconds >= 0 {
+			s.EndedAt = since + endSeconds*1000
+		}
+		return s
+	}
+
+	tests := []struct {
+		name     string
+		sessions []BotSession
+		want     BotUptime
+	}{
+		{"one session", []BotSession{session(10, 40)}, BotUptime{
+			UptimePercent: 30, OnlineSeconds: 30, Sessions: 1, LastOnlineAt: since + 40_000,
+		}},
+		{"overlapping sessions", []BotSession{session(10, 40), session(30, 60)}, BotUptime{
+			UptimePercent: 50, OnlineSeconds: 50, Sessions: 2, LastOnlineAt: since + 60_000,
+		}},
+		{"session inside another", []BotSession{session(10, 60), session(20, 30)}, BotUptime{
+			UptimePercent: 50, OnlineSeconds: 50, Sessions: 2, LastOnlineAt: since + 60_000,
+		}},
+		{"standby taking over", []BotSession{session(10, 40), session(40, 70)}, BotUptime{
+			UptimePercent: 60, OnlineSeconds: 60, Sessions: 2, LastOnlineAt: since + 70_000,
+		}},
+		{"started before the window", []BotSession{session(-20, 10)}, BotUptime{
+			UptimePercent: 10, OnlineSeconds: 10, Sessions: 1, LastOnlineAt: since + 10_000,
+		}},
+		{"ended after the window", []BotSession{session(90, 120)}, BotUptime{
+			UptimePercent: 10, OnlineSeconds: 10, Sessions: 1, LastOnlineAt: since + 120_000,
+		}},
+		{"still online", []BotSession{session(80, -1)}, BotUptime{
+			UptimePercent: 20, OnlineSeconds: 20, Sessions: 1, Online: true, LastOnlineAt: until,
+		}},
+		{"percent is cut to two decimals", []BotSession{{Server: "simplyvanilla", StartedAt: since, EndedAt: since + 66_666}}, BotUptime{
+			UptimePercent: 66.66, OnlineSeconds: 66, Sessions: 1, LastOnlineAt: since + 66_666,
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.want.Server = "simplyvanilla"
+			test.want.WindowSeconds = 100
+
+			got := calculateBotUptime(test.sessions, since, until)
+			if len(got) != 1 || !reflect.DeepEqual(got[0], test.want) {
+				t.Errorf("calculateBotUptime = %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestCalculateBotUptimeServers(t *testing.T) {
+	sessions := []BotSession{
+		{Server: "SimplyVanilla", StartedAt: 0, EndedAt: 50_000},
+		{Server: "2b2t", StartedAt: 10_000, EndedAt: 20_000},
+		{Server: "simplyvanilla", StartedAt: 60_000, EndedAt: 70_000},
+	}
+
+	got := calculateBotUptime(sessions, 0, 100_000)
+	if len(got) != 2 {
+		t.Fatalf("got %d servers, want 2: %+v", len(got), got)
+	}
+
+	// sorted by server, names matched without case.
+	if got[0].Server != "2b2t" || got[0].OnlineSeconds != 10 {
+		t.Errorf("first = %+v, want 2b2t with 10 seconds", got[0])
+	}
+	if got[1].Server != "SimplyVanilla" || got[1].OnlineSeconds != 60 || got[1].Sessions != 2 {
+		t.Errorf("second = %+v, want SimplyVanilla with 60 seconds over 2 sessions", got[1])
+	}
+
+	if got := calculateBotUptime(nil, 0, 100_000); len(got) != 0 {
+		t.Errorf("calculateBotUptime(no sessions) = %+v, want none", got)
+	}
+}
@@ -0,0 +1,27 @@
+package database
+
+import (
+	"github.com/febzey/ForestBot-Mainframe/types"
+)
+
+// Saving logins or logouts we did not see happen, flagged as inferred.
+// Used when a servers bot disconnects with players online, and when it comes back.
+func (d *Database) SaveInferredActivity(players []types.Player, activityType string, date int64) error {
+	for _, player := range players {
+		activity := types.PlayerActivity{
+			UUID:      player.Uuid,
+			Username:  player.Username,
+			Date:      date,
+			Type:      activityType,
+			Mc_server: player.Server,
+			Inferred:  true,
+		}
+
+		_, err := d.Execute("INSERT INTO playerActivity(uuid, username, date, type, mc_server, inferred) VALUES (?,?,?,?,?,?)", activity.UUID, activity.Username, activity.Date, activity.Type, activity.Mc_server, activity.Inferred)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
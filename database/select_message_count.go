@@ -0,0 +1,27 @@
+package database
+
+type MessageCount struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+// Counting how many messages a user sent on a server.
+func (d *Database) GetMessageCount(username string, server string) (MessageCount, error) {
+	messageCount := MessageCount{}
+
+	SELECT_MESSAGE_COUNT_QUERY := "SELECT name,COUNT(name) AS cnt FROM messages WHERE name=? AND mc_server = ? HAVING cnt > 1"
+	rows, err := d.Query(SELECT_MESSAGE_COUNT_QUERY, username, server)
+	if err != nil {
+		return messageCount, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		if err := rows.Scan(&messageCount.Name, &messageCount.Count); err != nil {
+			return messageCount, err
+		}
+	}
+
+	return messageCount, nil
+}
@@ -0,0 +1,25 @@
+package database
+
+// Finding players on a server by part of their username,
+// closest length first, returns at most 6 usernames.
+// useful for finding players that have a lot of characters in their name.
+func (d *Database) SearchUsernames(username string, server string) ([]string, error) {
+	rows, err := d.Query("SELECT username FROM users WHERE username LIKE ? AND mc_server = ? ORDER BY ABS(CHAR_LENGTH(username) - CHAR_LENGTH(?)), lastseen DESC LIMIT 6", "%"+username+"%", server, username)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var usernames []string
+
+	for rows.Next() {
+		var username string
+		if err := rows.Scan(&username); err != nil {
+			return nil, err
+		}
+		usernames = append(usernames, username)
+	}
+
+	return usernames, nil
+}
@@ -0,0 +1,33 @@
+package database
+
+import (
+	"github.com/febzey/ForestBot-Mainframe/types"
+)
+
+// Getting a random message (longer than 10 characters) a user sent on a server.
+// returns an empty message if the user has none.
+func (d *Database) GetRandomQuote(name string, server string) (types.MinecraftChatMessage, error) {
+	var message types.MinecraftChatMessage
+
+	rows, err := d.Query("SELECT name,message,date,mc_server,uuid FROM messages WHERE mc_server = ? AND name = ? AND LENGTH(message) > 10 ORDER BY RAND() LIMIT 1", server, name)
+	if err != nil {
+		return message, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		err := rows.Scan(
+			&message.Name,
+			&message.Message,
+			&message.Date,
+			&message.Mc_server,
+			&message.Uuid,
+		)
+		if err != nil {
+			return message, err
+		}
+	}
+
+	return message, nil
+}
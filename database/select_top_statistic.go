@@ -0,0 +1,47 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+)
+
+// The statistics we can get the top players for,
+// these are column names in the users table.
+var TopStatistics = map[string]bool{"playtime": true, "joins": true, "kills": true, "deaths": true}
+
+var ErrInvalidStatistic = errors.New("invalid statistic, must be playtime, joins, kills or deaths")
+
+type TopStatistic struct {
+	Username  string `json:"username"`
+	Statistic int64  `json:"statistic"`
+}
+
+// Getting the players with the highest playtime, joins, kills or deaths on a server.
+func (d *Database) GetTopStatistic(server string, statistic string, limit int) ([]TopStatistic, error) {
+	// Ensure the statistic is a valid column name to prevent SQL injection
+	if !TopStatistics[statistic] {
+		return nil, ErrInvalidStatistic
+	}
+
+	SELECT_TOP_STATISTICS_QUERY := fmt.Sprintf("SELECT username, %s FROM users WHERE mc_server = ? ORDER BY %s DESC LIMIT ?", statistic, statistic)
+
+	rows, err := d.Query(SELECT_TOP_STATISTICS_QUERY, server, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var topStatistics []TopStatistic
+
+	for rows.Next() {
+		var ts TopStatistic
+		if err := rows.Scan(&ts.Username, &ts.Statistic); err != nil {
+			return nil, err
+		}
+
+		topStatistics = append(topStatistics, ts)
+	}
+
+	return topStatistics, nil
+}
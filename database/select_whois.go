@@ -0,0 +1,23 @@
+package database
+
+// Getting the whois descriptions set for a username.
+func (d *Database) GetWhoisDescriptions(username string) ([]string, error) {
+	rows, err := d.Query("SELECT description FROM whois WHERE username=?", username)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var descriptions []string
+
+	for rows.Next() {
+		var description string
+		if err := rows.Scan(&description); err != nil {
+			return nil, err
+		}
+		descriptions = append(descriptions, description)
+	}
+
+	return descriptions, nil
+}
@@ -0,0 +1,28 @@
+package database
+
+type WordCount struct {
+	Name    string `json:"name"`
+	Count   int    `json:"count"`
+	Message string `json:"message"`
+}
+
+// Counting the messages a user sent on a server that contain a word.
+func (d *Database) GetWordOccurence(username string, server string, word string) (WordCount, error) {
+	wordCount := WordCount{}
+
+	SELECT_WORD_COUNT_QUERY := "SELECT name, message, COUNT(message) AS cnt FROM messages WHERE name=? AND mc_server = ? AND message LIKE ? GROUP BY name"
+	rows, err := d.Query(SELECT_WORD_COUNT_QUERY, username, server, "%"+word+"%")
+	if err != nil {
+		return wordCount, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		if err := rows.Scan(&wordCount.Name, &wordCount.Message, &wordCount.Count); err != nil {
+			return wordCount, err
+		}
+	}
+
+	return wordCount, nil
+}
@@ -0,0 +1,55 @@
+package database
+
+import "fmt"
+
+// Creating the tables the mainframe adds itself, if they do not exist yet,
+// and adding the columns it needs to tables created by the bot (users, messages, playerActivity...).
+func (d *Database) Setup() error {
+	botSessionsQuery := `
+	CREATE TABLE IF NOT EXISTS bot_sessions (
+		id BIGINT NOT NULL AUTO_INCREMENT,
+		mc_server VARCHAR(255) NOT NULL,
+		client_id VARCHAR(64) NOT NULL,
+		started_at BIGINT NOT NULL,
+		ended_at BIGINT NULL,
+		last_seen BIGINT NOT NULL,
+		PRIMARY KEY (id),
+		INDEX bot_sessions_server (mc_server, started_at)
+	  );
+	`
+
+	if _, err := d.Execute(botSessionsQuery); err != nil {
+		return fmt.Errorf("error checking/creating bot_sessions table: %w", err)
+	}
+
+	// logins and logouts we wrote ourselves because the bot was not there to see them.
+	if err := d.addColumnIfMissing("playerActivity", "inferred", "TINYINT NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// MySQL has no ADD COLUMN IF NOT EXISTS, so we check information_schema first.
+func (d *Database) addColumnIfMissing(table string, column string, definition string) error {
+	var count int
+
+	query := `
+	SELECT COUNT(*) FROM information_schema.COLUMNS
+	WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ? AND COLUMN_NAME = ?;
+	`
+
+	if err := d.Pool.QueryRow(query, table, column).Scan(&count); err != nil {
+		return fmt.Errorf("error checking column %s.%s: %w", table, column, err)
+	}
+
+	if count > 0 {
+		return nil
+	}
+
+	if _, err := d.Execute(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition)); err != nil {
+		return fmt.Errorf("error adding column %s.%s: %w", table, column, err)
+	}
+
+	return nil
+}
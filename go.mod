@@ -5,8 +5,10 @@ go 1.18
 require (
 	github.com/fatih/color v1.16.0
 	github.com/fogleman/gg v1.3.0
+	github.com/fxamacker/cbor/v2 v2.5.0
 	github.com/mitchellh/mapstructure v1.5.0
 	github.com/nfnt/resize v0.0.0-20180221191011-83c6a9932646
+	github.com/vmihailenco/msgpack/v5 v5.3.5
 	golang.org/x/image v0.15.0
 )
 
@@ -14,6 +16,8 @@ require (
 	github.com/felixge/httpsnoop v1.0.3 // indirect
 	github.com/mattn/go-colorable v0.1.13 // indirect
 	github.com/mattn/go-isatty v0.0.20 // indirect
+	github.com/vmihailenco/tagparser/v2 v2.0.0 // indirect
+	github.com/x448/float16 v0.8.4 // indirect
 	golang.org/x/net v0.17.0 // indirect
 	golang.org/x/sys v0.14.0 // indirect
 )
@@ -0,0 +1,236 @@
+package keyservice
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+/******
+
+Brute force protection for key verification.
+Failed attempts are tracked per identity (an ip address, a websocket connection),
+once an identity fails too many times it is banned for a while, and every
+ban after that doubles in length.
+We also remember recently rejected key hashes, so a client retrying the same
+wrong key does not cost us a store lookup every time.
+
+******/
+
+// Returned when a key does not exist, is expired, or was recently rejected.
+var ErrInvalidKey = errors.New("invalid api key")
+
+// Returned when the identity verifying a key is temporarily banned.
+type BannedError struct {
+	RetryAfter time.Duration
+}
+
+func (e *BannedError) Error() string {
+	return fmt.Sprintf("too many failed attempts, try again in %s", e.RetryAfter.Round(time.Second))
+}
+
+// Settings for the auth guard.
+type GuardConfig struct {
+	//failed attempts allowed before the first ban.
+	MaxFailures int
+
+	//how long the first ban lasts, each ban after doubles.
+	BaseBan time.Duration
+
+	//the longest a ban can last.
+	MaxBan time.Duration
+
+	//failures are forgotten once an identity has not failed for this long.
+	FailureWindow time.Duration
+
+	//how long a rejected key hash is remembered.
+	NegativeCacheTTL time.Duration
+}
+
+func DefaultGuardConfig() GuardConfig {
+	return GuardConfig{
+		MaxFailures:      5,
+		BaseBan:          30 * time.Second,
+		MaxBan:           time.Hour,
+		FailureWindow:    15 * time.Minute,
+		NegativeCacheTTL: time.Minute,
+	}
+}
+
+// Failed attempts for one identity.
+type failureRecord struct {
+	count       int
+	bans        int
+	lastFailure time.Time
+	bannedUntil time.Time
+}
+
+type authGuard struct {
+	config GuardConfig
+
+	//failed attempts, key is the identity (example: "ip:127.0.0.1")
+	failures map[string]*failureRecord
+
+	//recently rejected key hashes and when they were rejected.
+	rejected map[string]time.Time
+
+	//last time we cleaned up old records.
+	lastPrune time.Time
+
+	//called with a message when an identity gets banned.
+	onSecurityEvent func(msg string)
+
+	mu *sync.Mutex
+}
+
+func newAuthGuard(config GuardConfig) *authGuard {
+	return &authGuard{
+		config:    config,
+		failures:  make(map[string]*failureRecord),
+		rejected:  make(map[string]time.Time),
+		lastPrune: time.Now(),
+		mu:        &sync.Mutex{},
+	}
+}
+
+// Checking if any of the identities are banned, returns the longest remaining ban.
+func (g *authGuard) checkBanned(identities []string) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := time.Now()
+	var retryAfter time.Duration
+
+	for _, identity := range identities {
+		if record, ok := g.failures[identity]; ok && now.Before(record.bannedUntil) {
+			if remaining := record.bannedUntil.Sub(now); remaining > retryAfter {
+				retryAfter = remaining
+			}
+		}
+	}
+
+	if retryAfter > 0 {
+		return &BannedError{RetryAfter: retryAfter}
+	}
+
+	return nil
+}
+
+// Checking if a key hash was rejected recently.
+func (g *authGuard) isRejected(encryptedKey string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	rejectedAt, ok := g.rejected[encryptedKey]
+	return ok && time.Since(rejectedAt) < g.config.NegativeCacheTTL
+}
+
+// Forgetting a rejected hash, used when a key with that hash is created.
+func (g *authGuard) forgetRejected(encryptedKey string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	delete(g.rejected, encryptedKey)
+}
+
+// Recording a failed attempt for a key hash and every identity.
+// If an identity goes over the limit it is banned, and we return the ban.
+func (g *authGuard) recordFailure(encryptedKey string, identities []string) error {
+	g.mu.Lock()
+
+	now := time.Now()
+	g.prune(now)
+	g.rejected[encryptedKey] = now
+
+	var banned *BannedError
+	var messages []string
+
+	for _, identity := range identities {
+		record, ok := g.failures[identity]
+		if !ok || now.Sub(record.lastFailure) > g.config.FailureWindow {
+			record = &failureRecord{}
+			g.failures[identity] = record
+		}
+
+		record.count++
+		record.lastFailure = now
+
+		if record.count < g.config.MaxFailures {
+			continue
+		}
+
+		// exponential backoff, every ban doubles up to MaxBan.
+		ban := g.config.BaseBan << record.bans
+		if ban > g.config.MaxBan || ban <= 0 {
+			ban = g.config.MaxBan
+		}
+
+		record.bans++
+		record.bannedUntil = now.Add(ban)
+
+		if banned == nil || ban > banned.RetryAfter {
+			banned = &BannedError{RetryAfter: ban}
+		}
+
+		messages = append(messages, fmt.Sprintf("Banned %s for %s after %d failed api key attempts", identity, ban, record.count))
+	}
+
+	hook := g.onSecurityEvent
+	g.mu.Unlock()
+
+	if hook != nil {
+		for _, msg := range messages {
+			hook(msg)
+		}
+	}
+
+	if banned != nil {
+		return banned
+	}
+
+	return nil
+}
+
+// Clearing failures for identities after a successful attempt.
+// Bans are kept, only the failure count resets.
+func (g *authGuard) recordSuccess(identities []string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	for _, identity := range identities {
+		if record, ok := g.failures[identity]; ok {
+			record.count = 0
+		}
+	}
+}
+
+// Removing old records so the maps do not grow forever.
+// Runs at most once a minute, must be called while holding the lock.
+func (g *authGuard) prune(now time.Time) {
+	if now.Sub(g.lastPrune) < time.Minute {
+		return
+	}
+
+	for identity, record := range g.failures {
+		if now.Sub(record.lastFailure) > g.config.FailureWindow && now.After(record.bannedUntil) {
+			delete(g.failures, identity)
+		}
+	}
+
+	for encryptedKey, rejectedAt := range g.rejected {
+		if now.Sub(rejectedAt) >= g.config.NegativeCacheTTL {
+			delete(g.rejected, encryptedKey)
+		}
+	}
+
+	g.lastPrune = now
+}
+
+// Registering a function to be called with security events (identities getting banned).
+func (s *APIKeyService) OnSecurityEvent(hook func(msg string)) {
+	s.guard.mu.Lock()
+	defer s.guard.mu.Unlock()
+
+	s.guard.onSecurityEvent = hook
+}
@@ -0,0 +1,130 @@
+package keyservice
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func newTestGuard() *authGuard {
+	return newAuthGuard(GuardConfig{
+		MaxFailures:      2,
+		BaseBan:          10 * time.Second,
+		MaxBan:           35 * time.Second,
+		FailureWindow:    time.Minute,
+		NegativeCacheTTL: 30 * time.Millisecond,
+	})
+}
+
+func TestGuardBanDoubling(t *testing.T) {
+	guard := newTestGuard()
+	identities := []string{"ip:127.0.0.1"}
+
+	var events []string
+	guard.onSecurityEvent = func(msg string) { events = append(events, msg) }
+
+	if err := guard.recordFailure("hash", identities); err != nil {
+		t.Fatalf("first failure = %v, want no ban before MaxFailures", err)
+	}
+	if err := guard.checkBanned(identities); err != nil {
+		t.Fatalf("checkBanned before any ban = %v", err)
+	}
+
+	// every failure from here on bans again, doubling up to MaxBan.
+	for i, want := range []time.Duration{10 * time.Second, 20 * time.Second, 35 * time.Second, 35 * time.Second} {
+		var banned *BannedError
+		if err := guard.recordFailure("hash", identities); !errors.As(err, &banned) || banned.RetryAfter != want {
+			t.Fatalf("ban %d = %v, want %s", i+1, err, want)
+		}
+	}
+
+	var banned *BannedError
+	if err := guard.checkBanned(identities); !errors.As(err, &banned) || banned.RetryAfter <= 30*time.Second || banned.RetryAfter > 35*time.Second {
+		t.Errorf("checkBanned = %v, want about 35s left", err)
+	}
+
+	if len(events) != 4 {
+		t.Errorf("security events = %d, want one per ban (4)", len(events))
+	}
+
+	// other identities are not banned.
+	if err := guard.checkBanned([]string{"ip:10.0.0.1"}); err != nil {
+		t.Errorf("checkBanned(other ip) = %v, want no ban", err)
+	}
+}
+
+func TestGuardLongestBanWins(t *testing.T) {
+	guard := newTestGuard()
+
+	// the connection was banned twice, the ip only once.
+	for i := 0; i < 3; i++ {
+		guard.recordFailure("hash", []string{"conn:a"})
+	}
+	guard.recordFailure("hash", []string{"ip:127.0.0.1"})
+	guard.recordFailure("hash", []string{"ip:127.0.0.1"})
+
+	var banned *BannedError
+	if err := guard.checkBanned([]string{"ip:127.0.0.1", "conn:a"}); !errors.As(err, &banned) || banned.RetryAfter <= 10*time.Second {
+		t.Errorf("checkBanned = %v, want the connections longer ban", err)
+	}
+}
+
+func TestGuardSuccessResetsFailures(t *testing.T) {
+	guard := newTestGuard()
+	identities := []string{"ip:127.0.0.1"}
+
+	guard.recordFailure("hash", identities)
+	guard.recordSuccess(identities)
+
+	if err := guard.recordFailure("hash", identities); err != nil {
+		t.Errorf("failure after a success = %v, want the count to have reset", err)
+	}
+}
+
+func TestGuardNegativeCache(t *testing.T) {
+	guard := newTestGuard()
+
+	guard.recordFailure("hash", nil)
+	if !guard.isRejected("hash") {
+		t.Fatal("rejected hash was not remembered")
+	}
+	if guard.isRejected("other") {
+		t.Error("a hash that was never rejected is remembered")
+	}
+
+	time.Sleep(40 * time.Millisecond)
+	if guard.isRejected("hash") {
+		t.Error("rejected hash is still remembered after NegativeCacheTTL")
+	}
+
+	// a key created with a rejected hash works right away.
+	guard.recordFailure("created", nil)
+	guard.forgetRejected("created")
+	if guard.isRejected("created") {
+		t.Error("forgotten hash is still rejected")
+	}
+}
+
+func TestVerifyAPIKeyBanned(t *testing.T) {
+	service := newTestService(t)
+	plainTextKey, _ := newTestKey(t, service, APIPermissions{Read: true})
+
+	var err error
+	for i := 0; i < DefaultGuardConfig().MaxFailures; i++ {
+		_, err = service.VerifyAPIKey("wrong-key", "ip:127.0.0.1")
+	}
+
+	var banned *BannedError
+	if !errors.As(err, &banned) {
+		t.Fatalf("VerifyAPIKey after %d failures = %v, want a ban", DefaultGuardConfig().MaxFailures, err)
+	}
+
+	// while banned even the right key is not checked.
+	if _, err := service.VerifyAPIKey(plainTextKey, "ip:127.0.0.1"); !errors.As(err, &banned) {
+		t.Errorf("VerifyAPIKey(right key while banned) = %v, want a ban", err)
+	}
+
+	if _, err := service.VerifyAPIKey(plainTextKey, "ip:10.0.0.1"); err != nil {
+		t.Errorf("VerifyAPIKey(other ip) = %v, want no error", err)
+	}
+}
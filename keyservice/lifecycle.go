@@ -0,0 +1,111 @@
+package keyservice
+
+import (
+	"errors"
+	"time"
+)
+
+/******
+
+Managing keys after they are created.
+Listing keys, revoking them, rotating the secret and setting expiry times.
+Keys are always referenced by their encrypted (sha256) value, we never
+store or return the plaintext key after it is created.
+
+******/
+
+// Returned when the key we are looking for does not exist in the key store.
+var ErrKeyNotFound = errors.New("key not found")
+
+// Registering a function to be called when a key is revoked or rotated.
+// The function gets the encrypted key that stopped working.
+func (s *APIKeyService) OnKeyRevoked(hook func(encryptedKey string)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.revokeHooks = append(s.revokeHooks, hook)
+}
+
+// Registering a function to be called when a keys expiry is set, changed or removed.
+// The function gets the encrypted key and its new expiry, 0 means never.
+func (s *APIKeyService) OnKeyExpiryChanged(hook func(encryptedKey string, expiresAt int64)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.expiryHooks = append(s.expiryHooks, hook)
+}
+
+// Listing every key for an owner email.
+// if ownerEmail is empty, every key is returned.
+func (s *APIKeyService) ListKeys(ownerEmail string) ([]APIkey, error) {
+	return s.store.ListKeys(ownerEmail)
+}
+
+// Revoking a key, the key is deleted from the store and our cache
+// and anything using the key is notified through the revoke hooks.
+func (s *APIKeyService) RevokeKey(encryptedKey string) error {
+	if err := s.store.DeleteKey(encryptedKey); err != nil {
+		return err
+	}
+
+	s.invalidateKey(encryptedKey)
+
+	return nil
+}
+
+// Rotating a key gives it a new secret while keeping the owner, permissions,
+// rate limit and expiry. The old secret stops working right away.
+// The new plaintext key is returned, along with its encrypted value.
+func (s *APIKeyService) RotateKey(encryptedKey string) (string, string, error) {
+	plainTextKey := generateRandomKey()
+	newEncryptedKey, err := s.EncryptAPIKey(plainTextKey)
+	if err != nil {
+		return "", "", err
+	}
+
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+
+	if err := s.store.ReplaceKeyHash(encryptedKey, newEncryptedKey, now); err != nil {
+		return "", "", err
+	}
+
+	s.invalidateKey(encryptedKey)
+	s.guard.forgetRejected(newEncryptedKey)
+
+	return plainTextKey, newEncryptedKey, nil
+}
+
+// Setting when a key expires, as a millisecond timestamp.
+// 0 removes the expiry.
+func (s *APIKeyService) SetKeyExpiry(encryptedKey string, expiresAt int64) error {
+	if err := s.store.SetExpiry(encryptedKey, expiresAt); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	delete(s.keyArr, encryptedKey)
+	hooks := append([]func(string, int64){}, s.expiryHooks...)
+	s.mu.Unlock()
+
+	// an expired key may have been rejected recently, it should work again right away.
+	s.guard.forgetRejected(encryptedKey)
+
+	// anything already using the key picks up the new expiry.
+	for _, hook := range hooks {
+		hook(encryptedKey, expiresAt)
+	}
+
+	return nil
+}
+
+// Removing a key from our cache and calling the revoke hooks.
+func (s *APIKeyService) invalidateKey(encryptedKey string) {
+	s.mu.Lock()
+	delete(s.keyArr, encryptedKey)
+	hooks := append([]func(string){}, s.revokeHooks...)
+	s.mu.Unlock()
+
+	for _, hook := range hooks {
+		hook(encryptedKey)
+	}
+}
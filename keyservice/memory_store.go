@@ -0,0 +1,201 @@
+package keyservice
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+)
+
+/******
+
+An in memory key store, optionally backed by a json file.
+Used to run the mainframe locally or in tests without MySQL.
+If a file path is given, keys are loaded from it on Setup and the
+whole file is rewritten after every change.
+
+******/
+
+type MemoryKeyStore struct {
+	//every key, key is the encrypted api key.
+	keys map[string]APIkey
+
+	//json file to persist keys to, empty keeps keys in memory only.
+	path string
+
+	mu *sync.Mutex
+}
+
+func NewMemoryKeyStore(path string) *MemoryKeyStore {
+	return &MemoryKeyStore{
+		keys: make(map[string]APIkey),
+		path: path,
+		mu:   &sync.Mutex{},
+	}
+}
+
+// Loading keys from the json file if there is one.
+func (m *MemoryKeyStore) Setup() error {
+	if m.path == "" {
+		return nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	data, err := os.ReadFile(m.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error reading key file: %w", err)
+	}
+
+	var keys []APIkey
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return fmt.Errorf("error parsing key file: %w", err)
+	}
+
+	for _, key := range keys {
+		m.keys[key.Key] = key
+	}
+
+	return nil
+}
+
+func (m *MemoryKeyStore) InsertKey(key APIkey) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.keys[key.Key]; ok {
+		return errors.New("error inserting API key: key already exists")
+	}
+
+	m.keys[key.Key] = key
+
+	return m.save()
+}
+
+func (m *MemoryKeyStore) GetKey(encryptedKey string) (APIkey, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key, ok := m.keys[encryptedKey]
+	if !ok {
+		return APIkey{}, ErrKeyNotFound
+	}
+
+	return key, nil
+}
+
+func (m *MemoryKeyStore) ListKeys(ownerEmail string) ([]APIkey, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	keys := []APIkey{}
+	for _, key := range m.keys {
+		if ownerEmail == "" || key.OwnerEmail == ownerEmail {
+			keys = append(keys, key)
+		}
+	}
+
+	sort.Slice(keys, func(i, j int) bool { return keys[i].CreatedAt < keys[j].CreatedAt })
+
+	return keys, nil
+}
+
+func (m *MemoryKeyStore) DeleteKey(encryptedKey string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.keys[encryptedKey]; !ok {
+		return ErrKeyNotFound
+	}
+
+	delete(m.keys, encryptedKey)
+
+	return m.save()
+}
+
+func (m *MemoryKeyStore) ReplaceKeyHash(oldEncryptedKey string, newEncryptedKey string, updatedAt int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key, ok := m.keys[oldEncryptedKey]
+	if !ok {
+		return ErrKeyNotFound
+	}
+
+	delete(m.keys, oldEncryptedKey)
+	key.Key = newEncryptedKey
+	key.UpdatedAt = updatedAt
+	m.keys[newEncryptedKey] = key
+
+	return m.save()
+}
+
+func (m *MemoryKeyStore) SetExpiry(encryptedKey string, expiresAt int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key, ok := m.keys[encryptedKey]
+	if !ok {
+		return ErrKeyNotFound
+	}
+
+	key.ExpiresAt = expiresAt
+	m.keys[encryptedKey] = key
+
+	return m.save()
+}
+
+func (m *MemoryKeyStore) AddUsage(encryptedKey string, lastUsed int64, eventsWritten int64, eventsRead int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key, ok := m.keys[encryptedKey]
+	if !ok {
+		// same as MySQL, usage for unknown keys (the admin key) is dropped.
+		return nil
+	}
+
+	if lastUsed > key.UpdatedAt {
+		key.UpdatedAt = lastUsed
+	}
+	key.EventsWritten += eventsWritten
+	key.EventsRead += eventsRead
+	m.keys[encryptedKey] = key
+
+	return m.save()
+}
+
+// Writing every key to the json file, must be called while holding the lock.
+// Written to a temp file first so a crash never leaves a half written file.
+func (m *MemoryKeyStore) save() error {
+	if m.path == "" {
+		return nil
+	}
+
+	keys := make([]APIkey, 0, len(m.keys))
+	for _, key := range m.keys {
+		keys = append(keys, key)
+	}
+
+	data, err := json.MarshalIndent(keys, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding key file: %w", err)
+	}
+
+	tmpPath := m.path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0600); err != nil {
+		return fmt.Errorf("error writing key file: %w", err)
+	}
+
+	if err := os.Rename(tmpPath, m.path); err != nil {
+		return fmt.Errorf("error writing key file: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,291 @@
+package keyservice
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+/******
+
+The MySQL key store, keys are saved in the api_keys table.
+This is what the mainframe uses in production.
+
+******/
+
+type MySQLKeyStore struct {
+	// a struct to our database
+	Db *sql.DB
+}
+
+func NewMySQLKeyStore(db *sql.DB) *MySQLKeyStore {
+	return &MySQLKeyStore{Db: db}
+}
+
+// Creating the api_keys table if it does not exist yet,
+// and adding any columns that older tables are missing.
+func (m *MySQLKeyStore) Setup() error {
+	tableQuery := `
+	CREATE TABLE IF NOT EXISTS api_keys (
+		Api_key VARCHAR(255) NOT NULL,
+		OwnerEmail VARCHAR(255) NOT NULL,
+		CreatedAt BIGINT NOT NULL,
+		UpdatedAt BIGINT NOT NULL,
+		ReadPermission TINYINT NOT NULL,
+		WritePermission TINYINT NOT NULL,
+		AdminPermission TINYINT NOT NULL DEFAULT 0,
+		RateLimit INT NOT NULL,
+		TokenType VARCHAR(255) NOT NULL,
+		ExpiresAt BIGINT NOT NULL DEFAULT 0,
+		Servers VARCHAR(1024) NOT NULL DEFAULT '',
+		Scopes VARCHAR(1024) NOT NULL DEFAULT '',
+		EventsWritten BIGINT NOT NULL DEFAULT 0,
+		EventsRead BIGINT NOT NULL DEFAULT 0,
+		PRIMARY KEY (Api_key)
+	  );
+	`
+
+	if _, err := m.Db.Exec(tableQuery); err != nil {
+		return fmt.Errorf("error checking/creating table: %w", err)
+	}
+
+	//columns added after the table was first created.
+	columns := []struct {
+		name       string
+		definition string
+	}{
+		{"AdminPermission", "TINYINT NOT NULL DEFAULT 0"},
+		{"ExpiresAt", "BIGINT NOT NULL DEFAULT 0"},
+		{"Servers", "VARCHAR(1024) NOT NULL DEFAULT ''"},
+		{"Scopes", "VARCHAR(1024) NOT NULL DEFAULT ''"},
+		{"EventsWritten", "BIGINT NOT NULL DEFAULT 0"},
+		{"EventsRead", "BIGINT NOT NULL DEFAULT 0"},
+	}
+
+	for _, column := range columns {
+		if err := m.addColumnIfMissing(column.name, column.definition); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// MySQL has no ADD COLUMN IF NOT EXISTS, so we check information_schema first.
+func (m *MySQLKeyStore) addColumnIfMissing(column string, definition string) error {
+	var count int
+
+	query := `
+	SELECT COUNT(*) FROM information_schema.COLUMNS
+	WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = 'api_keys' AND COLUMN_NAME = ?;
+	`
+
+	if err := m.Db.QueryRow(query, column).Scan(&count); err != nil {
+		return fmt.Errorf("error checking column %s: %w", column, err)
+	}
+
+	if count > 0 {
+		return nil
+	}
+
+	if _, err := m.Db.Exec(fmt.Sprintf("ALTER TABLE api_keys ADD COLUMN %s %s", column, definition)); err != nil {
+		return fmt.Errorf("error adding column %s: %w", column, err)
+	}
+
+	return nil
+}
+
+// A function to save a newly created key to the database
+func (m *MySQLKeyStore) InsertKey(key APIkey) error {
+
+	insertQuery := `
+	INSERT INTO api_keys (Api_key, OwnerEmail, CreatedAt, UpdatedAt, ReadPermission, WritePermission, AdminPermission, RateLimit, TokenType, Servers, Scopes)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?);
+	`
+
+	if _, err := m.Db.Exec(insertQuery, key.Key, key.OwnerEmail, key.CreatedAt, key.UpdatedAt, key.Permissions.Read, key.Permissions.Write, key.Permissions.Admin, key.RateLimit, key.TokenType, strings.Join(key.Servers, ","), joinScopes(key.Scopes)); err != nil {
+		return fmt.Errorf("error inserting API key: %w", err)
+	}
+
+	return nil
+}
+
+// The columns we select for an api key, in the order scanAPIKey expects.
+const keyColumns = "Api_key, OwnerEmail, CreatedAt, UpdatedAt, ReadPermission, WritePermission, AdminPermission, RateLimit, TokenType, ExpiresAt, Servers, Scopes, EventsWritten, EventsRead"
+
+// A function to get a key from the database using the encrypted key.
+func (m *MySQLKeyStore) GetKey(encryptedKey string) (APIkey, error) {
+
+	query := "SELECT " + keyColumns + " FROM api_keys WHERE Api_key = ?;"
+
+	key, err := scanAPIKey(m.Db.QueryRow(query, encryptedKey))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return APIkey{}, ErrKeyNotFound
+		}
+
+		return APIkey{}, fmt.Errorf("error getting key: %w", err)
+	}
+
+	return key, nil
+}
+
+// Listing every key for an owner email, or every key if ownerEmail is empty.
+func (m *MySQLKeyStore) ListKeys(ownerEmail string) ([]APIkey, error) {
+	query := "SELECT " + keyColumns + " FROM api_keys"
+	args := []interface{}{}
+
+	if ownerEmail != "" {
+		query += " WHERE OwnerEmail = ?"
+		args = append(args, ownerEmail)
+	}
+
+	rows, err := m.Db.Query(query+" ORDER BY CreatedAt;", args...)
+	if err != nil {
+		return nil, fmt.Errorf("error listing keys: %w", err)
+	}
+
+	defer rows.Close()
+
+	keys := []APIkey{}
+	for rows.Next() {
+		key, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, fmt.Errorf("error listing keys: %w", err)
+		}
+		keys = append(keys, key)
+	}
+
+	return keys, rows.Err()
+}
+
+func (m *MySQLKeyStore) DeleteKey(encryptedKey string) error {
+	result, err := m.Db.Exec("DELETE FROM api_keys WHERE Api_key = ?;", encryptedKey)
+	if err != nil {
+		return fmt.Errorf("error revoking key: %w", err)
+	}
+
+	if affected, err := result.RowsAffected(); err == nil && affected == 0 {
+		return ErrKeyNotFound
+	}
+
+	return nil
+}
+
+func (m *MySQLKeyStore) ReplaceKeyHash(oldEncryptedKey string, newEncryptedKey string, updatedAt int64) error {
+	result, err := m.Db.Exec("UPDATE api_keys SET Api_key = ?, UpdatedAt = ? WHERE Api_key = ?;", newEncryptedKey, updatedAt, oldEncryptedKey)
+	if err != nil {
+		return fmt.Errorf("error rotating key: %w", err)
+	}
+
+	if affected, err := result.RowsAffected(); err == nil && affected == 0 {
+		return ErrKeyNotFound
+	}
+
+	return nil
+}
+
+func (m *MySQLKeyStore) SetExpiry(encryptedKey string, expiresAt int64) error {
+	result, err := m.Db.Exec("UPDATE api_keys SET ExpiresAt = ? WHERE Api_key = ?;", expiresAt, encryptedKey)
+	if err != nil {
+		return fmt.Errorf("error setting key expiry: %w", err)
+	}
+
+	if affected, err := result.RowsAffected(); err == nil && affected == 0 {
+		// MySQL reports 0 affected rows when the value did not change,
+		// so double check the key actually exists.
+		if _, err := m.GetKey(encryptedKey); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (m *MySQLKeyStore) AddUsage(encryptedKey string, lastUsed int64, eventsWritten int64, eventsRead int64) error {
+	query := `
+	UPDATE api_keys
+	SET UpdatedAt = GREATEST(UpdatedAt, ?), EventsWritten = EventsWritten + ?, EventsRead = EventsRead + ?
+	WHERE Api_key = ?;
+	`
+
+	if _, err := m.Db.Exec(query, lastUsed, eventsWritten, eventsRead, encryptedKey); err != nil {
+		return fmt.Errorf("error saving key usage: %w", err)
+	}
+
+	return nil
+}
+
+// Anything we can scan a row from, *sql.Row and *sql.Rows both work.
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// Scanning a row selected with keyColumns into an APIkey.
+func scanAPIKey(row rowScanner) (APIkey, error) {
+	var apiKey struct {
+		Api_key         string `json:"Api_key"`
+		OwnerEmail      string `json:"OwnerEmail"`
+		CreatedAt       int64  `json:"CreatedAt"`
+		UpdatedAt       int64  `json:"UpdatedAt"`
+		ReadPermission  int    `json:"ReadPermission"`
+		WritePermission int    `json:"WritePermission"`
+		AdminPermission int    `json:"AdminPermission"`
+		RateLimit       int    `json:"RateLimit"`
+		TokenType       string `json:"TokenType"`
+		ExpiresAt       int64  `json:"ExpiresAt"`
+		Servers         string `json:"Servers"`
+		Scopes          string `json:"Scopes"`
+		EventsWritten   int64  `json:"EventsWritten"`
+		EventsRead      int64  `json:"EventsRead"`
+	}
+
+	err := row.Scan(
+		&apiKey.Api_key,
+		&apiKey.OwnerEmail,
+		&apiKey.CreatedAt,
+		&apiKey.UpdatedAt,
+		&apiKey.ReadPermission,
+		&apiKey.WritePermission,
+		&apiKey.AdminPermission,
+		&apiKey.RateLimit,
+		&apiKey.TokenType,
+		&apiKey.ExpiresAt,
+		&apiKey.Servers,
+		&apiKey.Scopes,
+		&apiKey.EventsWritten,
+		&apiKey.EventsRead,
+	)
+	if err != nil {
+		return APIkey{}, err
+	}
+
+	builtApiKey := APIkey{
+		Key:        apiKey.Api_key,
+		OwnerEmail: apiKey.OwnerEmail,
+		CreatedAt:  apiKey.CreatedAt,
+		UpdatedAt:  apiKey.UpdatedAt,
+		Permissions: APIPermissions{
+			Read:  apiKey.ReadPermission == 1,
+			Write: apiKey.WritePermission == 1,
+			Admin: apiKey.AdminPermission == 1,
+		},
+		RateLimit: apiKey.RateLimit,
+		TokenType: apiKey.TokenType,
+		ExpiresAt: apiKey.ExpiresAt,
+		Servers:   cleanServerList(strings.Split(apiKey.Servers, ",")),
+
+		EventsWritten: apiKey.EventsWritten,
+		EventsRead:    apiKey.EventsRead,
+	}
+
+	// Scopes were validated when the key was saved, so unknown
+	// scopes can only come from a manual edit and are ignored.
+	for _, scope := range strings.Split(apiKey.Scopes, ",") {
+		if scope = strings.TrimSpace(scope); isKnownScope(Scope(scope)) {
+			builtApiKey.Scopes = append(builtApiKey.Scopes, Scope(scope))
+		}
+	}
+
+	return builtApiKey, nil
+}
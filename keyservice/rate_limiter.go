@@ -0,0 +1,103 @@
+package keyservice
+
+import (
+	"sync"
+	"time"
+)
+
+/******
+
+Rate limiting for api keys.
+Every key gets a fixed window (one hour by default) and can use up to
+APIkey.RateLimit events inside of that window.
+Counters are kept per encrypted key, not per connection, so a client opening
+multiple websocket connections or making http requests with the same key
+shares the same counter.
+
+******/
+
+// A single counting window for one api key.
+type rateWindow struct {
+	//when the current window started.
+	start time.Time
+
+	//how many events were used in the current window.
+	count int
+}
+
+// Counts api key usage and decides if a key is over its limit.
+type RateLimiter struct {
+	//current windows, key is the encrypted api key (or the id for AllowID).
+	windows map[string]*rateWindow
+
+	//how long a window lasts before the count resets.
+	window time.Duration
+
+	//last time we cleaned up expired windows.
+	lastPrune time.Time
+
+	//mutex to keep us in sync
+	mu *sync.Mutex
+}
+
+// a new rate limiter, window is how long each counting window lasts.
+func NewRateLimiter(window time.Duration) *RateLimiter {
+	return &RateLimiter{
+		windows:   make(map[string]*rateWindow),
+		window:    window,
+		lastPrune: time.Now(),
+		mu:        &sync.Mutex{},
+	}
+}
+
+// Allow records one event for the key.
+// If the key is over its limit, the event is not counted and we return false
+// along with how long until the window resets.
+// Keys with a RateLimit of 0 or less are never limited.
+func (l *RateLimiter) Allow(key APIkey) (bool, time.Duration) {
+	return l.AllowID(key.Key, key.RateLimit)
+}
+
+// AllowID is like Allow, for limiting anything by an id (a discord guild, an ip)
+// instead of an api key. A limit of 0 or less is never limited.
+func (l *RateLimiter) AllowID(id string, limit int) (bool, time.Duration) {
+	if limit <= 0 {
+		return true, 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.prune(now)
+
+	w, ok := l.windows[id]
+	if !ok || now.Sub(w.start) >= l.window {
+		w = &rateWindow{start: now}
+		l.windows[id] = w
+	}
+
+	if w.count >= limit {
+		return false, w.start.Add(l.window).Sub(now)
+	}
+
+	w.count++
+
+	return true, 0
+}
+
+// Removing windows that have already expired so the map does not grow forever.
+// Only runs once per window, must be called while holding the lock.
+func (l *RateLimiter) prune(now time.Time) {
+	if now.Sub(l.lastPrune) < l.window {
+		return
+	}
+
+	for key, w := range l.windows {
+		if now.Sub(w.start) >= l.window {
+			delete(l.windows, key)
+		}
+	}
+
+	l.lastPrune = now
+}
@@ -0,0 +1,104 @@
+package keyservice
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiterAllow(t *testing.T) {
+	limiter := NewRateLimiter(time.Hour)
+	key := APIkey{Key: "a", RateLimit: 3}
+
+	for i := 0; i < 3; i++ {
+		if allowed, _ := limiter.Allow(key); !allowed {
+			t.Fatalf("event %d was limited, want allowed", i+1)
+		}
+	}
+
+	allowed, retryAfter := limiter.Allow(key)
+	if allowed {
+		t.Fatal("event over the limit was allowed")
+	}
+	if retryAfter <= 0 || retryAfter > time.Hour {
+		t.Errorf("retryAfter = %s, want until the end of the hour window", retryAfter)
+	}
+
+	// every key has its own counter.
+	if allowed, _ := limiter.Allow(APIkey{Key: "b", RateLimit: 3}); !allowed {
+		t.Error("another key was limited by the first keys counter")
+	}
+}
+
+func TestRateLimiterUnlimited(t *testing.T) {
+	limiter := NewRateLimiter(time.Hour)
+
+	for _, limit := range []int{0, -1} {
+		for i := 0; i < 100; i++ {
+			if allowed, _ := limiter.Allow(APIkey{Key: "unlimited", RateLimit: limit}); !allowed {
+				t.Fatalf("limit %d: event %d was limited, want never limited", limit, i+1)
+			}
+		}
+	}
+}
+
+func TestRateLimiterAllowID(t *testing.T) {
+	limiter := NewRateLimiter(time.Hour)
+
+	if allowed, _ := limiter.AllowID("guild", 1); !allowed {
+		t.Fatal("first event was limited")
+	}
+	if allowed, retryAfter := limiter.AllowID("guild", 1); allowed || retryAfter <= 0 {
+		t.Errorf("AllowID over the limit = %v, %s, want limited with a retryAfter", allowed, retryAfter)
+	}
+
+	// every id has its own counter.
+	if allowed, _ := limiter.AllowID("other-guild", 1); !allowed {
+		t.Error("another id was limited by the first ids counter")
+	}
+	if allowed, _ := limiter.AllowID("unlimited", 0); !allowed {
+		t.Error("a limit of 0 was limited")
+	}
+}
+
+func TestRateLimiterWindowReset(t *testing.T) {
+	window := 50 * time.Millisecond
+	limiter := NewRateLimiter(window)
+	key := APIkey{Key: "a", RateLimit: 1}
+
+	if allowed, _ := limiter.Allow(key); !allowed {
+		t.Fatal("first event was limited")
+	}
+
+	allowed, retryAfter := limiter.Allow(key)
+	if allowed {
+		t.Fatal("second event in the window was allowed")
+	}
+	if retryAfter <= 0 || retryAfter > window {
+		t.Errorf("retryAfter = %s, want between 0 and %s", retryAfter, window)
+	}
+
+	time.Sleep(retryAfter + 10*time.Millisecond)
+
+	if allowed, _ := limiter.Allow(key); !allowed {
+		t.Error("event after the window reset was limited")
+	}
+}
+
+func TestRateLimiterPrune(t *testing.T) {
+	window := 20 * time.Millisecond
+	limiter := NewRateLimiter(window)
+
+	limiter.Allow(APIkey{Key: "old", RateLimit: 1})
+	time.Sleep(2 * window)
+	limiter.Allow(APIkey{Key: "new", RateLimit: 1})
+
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+
+	if _, ok := limiter.windows["old"]; ok {
+		t.Error("expired window was not pruned")
+	}
+	if _, ok := limiter.windows["new"]; !ok {
+		t.Error("current window was pruned")
+	}
+}
@@ -0,0 +1,160 @@
+package keyservice
+
+import (
+	"fmt"
+	"strings"
+)
+
+/******
+
+Scopes are fine grained permissions for api keys.
+Each websocket action and protected http route group needs a scope,
+so a key that only relays discord chat can not write deaths or joins.
+
+Keys created before scopes existed have no scopes saved, for those keys
+we map their read/write/admin permissions to the equivalent scopes.
+
+******/
+
+type Scope string
+
+const (
+	//writing minecraft chat messages.
+	ScopeMinecraftChatWrite Scope = "minecraft:chat:write"
+
+	//writing player joins, leaves and player lists (playtime).
+	ScopeMinecraftPresenceWrite Scope = "minecraft:presence:write"
+
+	//writing deaths, kills and advancements.
+	ScopeMinecraftEventsWrite Scope = "minecraft:events:write"
+
+	//relaying discord chat to minecraft.
+	ScopeDiscordChatWrite Scope = "discord:chat:write"
+
+	//reading discord guilds and live chat channels.
+	ScopeDiscordRead Scope = "discord:read"
+
+	//adding and removing discord guilds and live chat channels.
+	ScopeDiscordAdmin Scope = "discord:admin"
+
+	//reading saved statistics.
+	ScopeStatsRead Scope = "stats:read"
+
+	//receiving live websocket broadcasts.
+	ScopeEventsRead Scope = "events:read"
+
+	//managing api keys.
+	ScopeKeysAdmin Scope = "keys:admin"
+
+	//viewing websocket server internals (queues, dropped messages).
+	ScopeWebsocketAdmin Scope = "websocket:admin"
+
+	//sending commands to minecraft bots (say, whisper, status).
+	ScopeBotCommand Scope = "bot:command"
+)
+
+// Every scope a key can be given.
+var AllScopes = []Scope{
+	ScopeMinecraftChatWrite,
+	ScopeMinecraftPresenceWrite,
+	ScopeMinecraftEventsWrite,
+	ScopeDiscordChatWrite,
+	ScopeDiscordRead,
+	ScopeDiscordAdmin,
+	ScopeStatsRead,
+	ScopeEventsRead,
+	ScopeKeysAdmin,
+	ScopeWebsocketAdmin,
+	ScopeBotCommand,
+}
+
+// Minecraft write scopes store data for a single server,
+// so a key with any of them must be scoped to exactly one server.
+func (s Scope) isMinecraftWrite() bool {
+	return strings.HasPrefix(string(s), "minecraft:") && strings.HasSuffix(string(s), ":write")
+}
+
+// The scopes equivalent to the old read/write/admin permissions.
+func ScopesForPermissions(permissions APIPermissions) []Scope {
+	scopes := []Scope{}
+
+	if permissions.Read {
+		scopes = append(scopes, ScopeStatsRead, ScopeEventsRead, ScopeDiscordRead)
+	}
+
+	if permissions.Write {
+		scopes = append(scopes,
+			ScopeMinecraftChatWrite,
+			ScopeMinecraftPresenceWrite,
+			ScopeMinecraftEventsWrite,
+			ScopeDiscordChatWrite,
+		)
+	}
+
+	if permissions.Admin {
+		scopes = append(scopes, ScopeKeysAdmin, ScopeWebsocketAdmin, ScopeBotCommand, ScopeDiscordAdmin)
+	}
+
+	return scopes
+}
+
+// The scopes a key actually has, falling back to its permissions
+// if the key was created without scopes.
+func (k APIkey) EffectiveScopes() []Scope {
+	if len(k.Scopes) == 0 {
+		return ScopesForPermissions(k.Permissions)
+	}
+
+	return k.Scopes
+}
+
+// Checking if the key has a scope.
+func (k APIkey) HasScope(scope Scope) bool {
+	for _, s := range k.EffectiveScopes() {
+		if s == scope {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Parsing scopes from strings, returning an error for unknown scopes.
+func ParseScopes(values []string) ([]Scope, error) {
+	scopes := []Scope{}
+
+	for _, value := range values {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			continue
+		}
+
+		if !isKnownScope(Scope(value)) {
+			return nil, fmt.Errorf("unknown scope: %s", value)
+		}
+
+		scopes = append(scopes, Scope(value))
+	}
+
+	return scopes, nil
+}
+
+func isKnownScope(scope Scope) bool {
+	for _, s := range AllScopes {
+		if s == scope {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Joining scopes into the comma seperated form we save in the database.
+func joinScopes(scopes []Scope) string {
+	values := make([]string, len(scopes))
+	for i, scope := range scopes {
+		values[i] = string(scope)
+	}
+
+	return strings.Join(values, ",")
+}
@@ -0,0 +1,63 @@
+package keyservice
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestScopesForPermissions(t *testing.T) {
+	tests := []struct {
+		name        string
+		permissions APIPermissions
+		want        []Scope
+	}{
+		{"none", APIPermissions{}, []Scope{}},
+		{"read", APIPermissions{Read: true}, []Scope{ScopeStatsRead, ScopeEventsRead, ScopeDiscordRead}},
+		{"write", APIPermissions{Write: true}, []Scope{
+			ScopeMinecraftChatWrite, ScopeMinecraftPresenceWrite, ScopeMinecraftEventsWrite, ScopeDiscordChatWrite,
+		}},
+		{"admin", APIPermissions{Admin: true}, []Scope{ScopeKeysAdmin, ScopeWebsocketAdmin, ScopeBotCommand, ScopeDiscordAdmin}},
+		{"read and write", APIPermissions{Read: true, Write: true}, []Scope{
+			ScopeStatsRead, ScopeEventsRead, ScopeDiscordRead,
+			ScopeMinecraftChatWrite, ScopeMinecraftPresenceWrite, ScopeMinecraftEventsWrite, ScopeDiscordChatWrite,
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := ScopesForPermissions(test.permissions); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("ScopesForPermissions(%+v) = %v, want %v", test.permissions, got, test.want)
+			}
+		})
+	}
+}
+
+func TestEffectiveScopes(t *testing.T) {
+	// keys from before scopes existed fall back to their permissions.
+	legacy := APIkey{Permissions: APIPermissions{Write: true}}
+	if !legacy.HasScope(ScopeMinecraftChatWrite) || legacy.HasScope(ScopeStatsRead) {
+		t.Errorf("legacy write key scopes = %v", legacy.EffectiveScopes())
+	}
+
+	// managing discord guilds is for admins, not every bot key.
+	if legacy.HasScope(ScopeDiscordAdmin) {
+		t.Error("legacy write key has discord:admin")
+	}
+
+	// saved scopes replace the permissions.
+	scoped := APIkey{Permissions: APIPermissions{Write: true}, Scopes: []Scope{ScopeDiscordChatWrite}}
+	if !scoped.HasScope(ScopeDiscordChatWrite) || scoped.HasScope(ScopeMinecraftChatWrite) {
+		t.Errorf("scoped key scopes = %v", scoped.EffectiveScopes())
+	}
+}
+
+func TestParseScopes(t *testing.T) {
+	scopes, err := ParseScopes([]string{"stats:read", " events:read "})
+	if err != nil || !reflect.DeepEqual(scopes, []Scope{ScopeStatsRead, ScopeEventsRead}) {
+		t.Errorf("ParseScopes = %v, %v", scopes, err)
+	}
+
+	if _, err := ParseScopes([]string{"stats:write"}); err == nil {
+		t.Error("ParseScopes(unknown scope) = nil error, want an error")
+	}
+}
@@ -3,10 +3,9 @@ package keyservice
 import (
 	"crypto/rand"
 	"crypto/sha256"
-	"database/sql"
 	"encoding/hex"
 	"errors"
-	"fmt"
+	"strings"
 	"sync"
 	"time"
 )
@@ -30,6 +29,10 @@ type APIPermissions struct {
 	//if write permission is true, then our
 	//event proccessor will accept client events.
 	Write bool
+
+	//if admin is true, the key can manage other keys
+	//(generating new keys etc). Admin does not imply read or write.
+	Admin bool
 }
 
 // This is the structure all of our API keys will follow.
@@ -51,11 +54,61 @@ type APIkey struct {
 	//Permissions are created when the key is made, and is a constant
 	Permissions APIPermissions
 
+	//Total events written and read with this key, see usage.go
+	EventsWritten int64
+	EventsRead    int64
+
+	//Fine grained scopes for the key, see scopes.go
+	//if empty, the scopes are derived from Permissions.
+	Scopes []Scope
+
 	// number of messages this api key can write per hour
 	RateLimit int
 
 	//bot-client, client, etc.
 	TokenType string
+
+	//millisecond timestamp of when this key stops working.
+	//0 means the key never expires.
+	ExpiresAt int64
+
+	//The minecraft servers this key may be used for.
+	//Stored comma seperated in the database, empty means every server.
+	//Write keys are limited to a single server.
+	Servers []string
+}
+
+// Checking if the key may be used for a minecraft server.
+func (k APIkey) AllowsServer(server string) bool {
+	if len(k.Servers) == 0 {
+		return true
+	}
+
+	for _, allowed := range k.Servers {
+		if strings.EqualFold(allowed, server) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Checking if the key has passed its expiry time.
+func (k APIkey) IsExpired() bool {
+	return k.ExpiresAt > 0 && time.Now().UnixNano()/int64(time.Millisecond) >= k.ExpiresAt
+}
+
+// Returned when creating a key with minecraft write scopes without exactly one minecraft server.
+var ErrWriteKeyServerScope = errors.New("write keys must be scoped to exactly one minecraft server")
+
+// How long a key stays in our local cache before we check the database again,
+// so keys removed from the database outside of this service stop working.
+const keyCacheTTL = 5 * time.Minute
+
+// A key stored in our local cache along with when it was cached.
+type cachedKey struct {
+	key      APIkey
+	cachedAt time.Time
 }
 
 // A structure for our api key service.
@@ -64,29 +117,70 @@ type APIkey struct {
 // should do it through this service.
 type APIKeyService struct {
 	//Cache for used keys
-	keyArr map[string]APIkey
+	keyArr map[string]cachedKey
 
 	//mutex to keep us in sync
 	mu *sync.Mutex
 
-	// a struct to our database
-	Db *sql.DB
+	// where our keys are saved, MySQL or in memory.
+	store KeyStore
+
+	//Per key rate limiting, shared by websocket and http.
+	Limiter *RateLimiter
+
+	//Per key usage counters, flushed to the database in batches.
+	usage *usageTracker
+
+	//Brute force protection for key verification.
+	guard *authGuard
+
+	//Signs and verifies session tokens, nil until EnableSessionTokens is called.
+	sessions *sessionSigner
+
+	//sha256 of the bootstrap admin key from the environment.
+	//empty if no admin key is configured.
+	adminKeyHash string
+
+	//functions to call when a key is revoked or rotated,
+	//used to disconnect clients that are still using the old key.
+	revokeHooks []func(encryptedKey string)
+
+	//functions to call when a keys expiry is set, changed or removed,
+	//used to close clients at the new expiry instead of the old one.
+	expiryHooks []func(encryptedKey string, expiresAt int64)
 }
 
 // a new service for our api keys and perhaps some more security features in the future?
-func NewAPIKeyService(db *sql.DB) *APIKeyService {
-	return &APIKeyService{
-		keyArr: make(map[string]APIkey),
-		mu:     &sync.Mutex{},
-		Db:     db,
+// store is where keys are saved, see store.go
+// adminKey is an optional plaintext key that always has admin permissions,
+// so the first keys can be generated before any exist in the database.
+func NewAPIKeyService(store KeyStore, adminKey string) (*APIKeyService, error) {
+	s := &APIKeyService{
+		keyArr:  make(map[string]cachedKey),
+		mu:      &sync.Mutex{},
+		store:   store,
+		Limiter: NewRateLimiter(time.Hour),
+		usage:   newUsageTracker(),
+		guard:   newAuthGuard(DefaultGuardConfig()),
+	}
+
+	if adminKey != "" {
+		s.adminKeyHash, _ = s.EncryptAPIKey(adminKey)
 	}
+
+	if err := store.Setup(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
 }
 
 // Func to generate our api keys
-// when the key is generated, it will be automatically saved to the database
+// when the key is generated, it will be automatically saved to the key store
 // we return the api key in plaintext to give to the client. after that its always encrypted.
-func (s *APIKeyService) NewApiKey(read, write bool, ownerEmail string, rateLimit int, TokenType string) (string, error) {
-
+// servers is the list of minecraft servers the key may be used for, a key with minecraft write scopes must have exactly one.
+// scopes may be empty, the key then gets the scopes equivalent to its permissions.
+func (s *APIKeyService) NewApiKey(permissions APIPermissions, ownerEmail string, rateLimit int, TokenType string, servers []string, scopes []Scope) (string, error) {
 	key := generateRandomKey()
 	keyEncryped, _ := s.EncryptAPIKey(key)
 	createdAt := time.Now().UnixNano() / int64(time.Millisecond)
@@ -96,16 +190,26 @@ func (s *APIKeyService) NewApiKey(read, write bool, ownerEmail string, rateLimit
 		OwnerEmail:  ownerEmail,
 		CreatedAt:   createdAt,
 		UpdatedAt:   createdAt,
-		Permissions: APIPermissions{Read: read, Write: write},
+		Permissions: permissions,
 		RateLimit:   rateLimit,
 		TokenType:   TokenType,
+		Servers:     cleanServerList(servers),
+		Scopes:      scopes,
 	}
 
-	err := s.saveKeyToDatabase(apikey)
+	for _, scope := range apikey.EffectiveScopes() {
+		if scope.isMinecraftWrite() && len(apikey.Servers) != 1 {
+			return "", ErrWriteKeyServerScope
+		}
+	}
+
+	err := s.store.InsertKey(apikey)
 	if err != nil {
 		return "", err
 	}
 
+	s.guard.forgetRejected(keyEncryped)
+
 	return key, nil
 }
 
@@ -125,139 +229,99 @@ func (s *APIKeyService) EncryptAPIKey(plainTextKey string) (string, error) {
 }
 
 // A function to verify and get our API key
-// Will check our local key map if not present will search the database.
+// Will check our local key map if not present will search the key store.
 func (s *APIKeyService) GetAndVerifyAPIKey(plainTextKey string) (APIkey, bool) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	key, err := s.VerifyAPIKey(plainTextKey)
+	return key, err == nil
+}
+
+// Verifying a key on behalf of identities (example: "ip:127.0.0.1", "conn:<client_id>").
+// Failed attempts are counted per identity, an identity with too many failures
+// gets a *BannedError until its ban runs out, without the key being checked at all.
+// A key that does not exist or is expired returns ErrInvalidKey.
+// Session tokens are accepted here too, see session_tokens.go
+func (s *APIKeyService) VerifyAPIKey(plainTextKey string, identities ...string) (APIkey, error) {
+	if err := s.guard.checkBanned(identities); err != nil {
+		return APIkey{}, err
+	}
 
 	encryptedKey, err := s.EncryptAPIKey(plainTextKey)
 	if err != nil {
-		return APIkey{}, false
+		return APIkey{}, err
 	}
 
 	var key APIkey
+	if looksLikeSessionToken(plainTextKey) {
+		key, err = s.verifySessionToken(plainTextKey)
+	} else {
+		key, err = s.lookupKey(encryptedKey)
+	}
 
-	cachedKey, ok := s.keyArr[encryptedKey]
-	if !ok {
-		key, err := s.retrieveKeyFromDatabase(encryptedKey)
-		if err != nil {
-			return APIkey{}, false
+	if err != nil {
+		if errors.Is(err, ErrInvalidKey) {
+			if banErr := s.guard.recordFailure(encryptedKey, identities); banErr != nil {
+				return APIkey{}, banErr
+			}
 		}
 
-		s.keyArr[key.Key] = key
-
-		return key, true
+		return APIkey{}, err
 	}
 
-	key = cachedKey
+	s.guard.recordSuccess(identities)
 
-	return key, true
+	return key, nil
 }
 
-// A function to get a key from the database using the encrypted key.
-func (s *APIKeyService) retrieveKeyFromDatabase(encryptedKey string) (APIkey, error) {
-
-	query := `
-        SELECT Api_key, OwnerEmail, CreatedAt, UpdatedAt, ReadPermission, WritePermission, RateLimit, TokenType
-        FROM api_keys
-        WHERE Api_key = ?;
-    `
-
-	var apiKey struct {
-		Api_key         string `json:"Api_key"`
-		OwnerEmail      string `json:"OwnerEmail"`
-		CreatedAt       int64  `json:"CreatedAt"`
-		UpdatedAt       int64  `json:"UpdatedAt"`
-		ReadPermission  int    `json:"ReadPermission"`
-		WritePermission int    `json:"WritePermission"`
-		RateLimit       int    `json:"RateLimit"`
-		TokenType       string `json:"TokenType"`
+// Finding a key by its encrypted value, through the admin key, our cache, then the key store.
+// Recently rejected hashes are rejected again without a store lookup.
+func (s *APIKeyService) lookupKey(encryptedKey string) (APIkey, error) {
+	if s.adminKeyHash != "" && encryptedKey == s.adminKeyHash {
+		return APIkey{
+			Key:         encryptedKey,
+			OwnerEmail:  "admin",
+			Permissions: APIPermissions{Read: true, Write: true, Admin: true},
+			TokenType:   "admin",
+		}, nil
 	}
 
-	err := s.Db.QueryRow(query, encryptedKey).Scan(
-		&apiKey.Api_key,
-		&apiKey.OwnerEmail,
-		&apiKey.CreatedAt,
-		&apiKey.UpdatedAt,
-		&apiKey.ReadPermission,
-		&apiKey.WritePermission,
-		&apiKey.RateLimit,
-		&apiKey.TokenType,
-	)
-	if err != nil {
-		if err == sql.ErrNoRows {
-			return APIkey{}, fmt.Errorf("key not found.")
-		}
-
-		return APIkey{}, fmt.Errorf("error getting key: %w", err)
+	if s.guard.isRejected(encryptedKey) {
+		return APIkey{}, ErrInvalidKey
 	}
 
-	var read bool = false
-	var write bool = false
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	if apiKey.ReadPermission == 1 {
-		read = true
-	}
-	if apiKey.WritePermission == 1 {
-		write = true
+	cached, ok := s.keyArr[encryptedKey]
+	if !ok || time.Since(cached.cachedAt) > keyCacheTTL {
+		key, err := s.store.GetKey(encryptedKey)
+		if errors.Is(err, ErrKeyNotFound) {
+			delete(s.keyArr, encryptedKey)
+			return APIkey{}, ErrInvalidKey
+		}
+		if err != nil {
+			return APIkey{}, err
+		}
+
+		cached = cachedKey{key: key, cachedAt: time.Now()}
+		s.keyArr[key.Key] = cached
 	}
 
-	builtApiKey := APIkey{
-		Key:        apiKey.Api_key,
-		OwnerEmail: apiKey.OwnerEmail,
-		CreatedAt:  apiKey.CreatedAt,
-		UpdatedAt:  apiKey.UpdatedAt,
-		Permissions: APIPermissions{
-			Read:  read,
-			Write: write,
-		},
-		RateLimit: apiKey.RateLimit,
-		TokenType: apiKey.TokenType,
+	if cached.key.IsExpired() {
+		return APIkey{}, ErrInvalidKey
 	}
 
-	return builtApiKey, nil
+	return cached.key, nil
 }
 
-// Feature Idea:
-// Add which mc server the key will be used for.
-// Allow a client to do all servers by seperating with commands in database.
-// If a client wants Write permissions, then only allow 1 server, not all.
-
-// A function to save a newly created key to the database
-func (s *APIKeyService) saveKeyToDatabase(key APIkey) error {
-	currentTime := time.Now()
-	nanoseconds := currentTime.UnixNano()
-	milliseconds := nanoseconds / int64(time.Millisecond)
-
-	//TODO: move this to when we actually create the key service
-	tableQuery := `
-	CREATE TABLE IF NOT EXISTS api_keys (
-		Api_key VARCHAR(255) NOT NULL,
-		OwnerEmail VARCHAR(255) NOT NULL,
-		CreatedAt BIGINT NOT NULL,
-		UpdatedAt BIGINT NOT NULL,
-		ReadPermission TINYINT NOT NULL,
-		WritePermission TINYINT NOT NULL,
-		RateLimit INT NOT NULL,
-		TokenType VARCHAR(255) NOT NULL,
-		PRIMARY KEY (Api_key)
-	  );
-	`
-
-	insertQuery := `
-	INSERT INTO api_keys (Api_key, OwnerEmail, CreatedAt, UpdatedAt, ReadPermission, WritePermission, RateLimit, TokenType)
-	VALUES (?, ?, ?, ?, ?, ?, ?, ?);
-	`
-
-	if _, err := s.Db.Exec(tableQuery); err != nil {
-		return fmt.Errorf("error checking/creating table: %w", err)
-	}
-
-	if _, err := s.Db.Exec(insertQuery, key.Key, key.OwnerEmail, milliseconds, milliseconds, key.Permissions.Read, key.Permissions.Write, key.RateLimit, key.TokenType); err != nil {
-		return fmt.Errorf("error inserting API key: %w", err)
+// Trimming whitespace and removing empty entries from a server list.
+func cleanServerList(servers []string) []string {
+	cleaned := []string{}
+	for _, server := range servers {
+		if server = strings.TrimSpace(server); server != "" {
+			cleaned = append(cleaned, server)
+		}
 	}
-
-	return nil
+	return cleaned
 }
 
 // Generate the api key.
@@ -268,8 +332,3 @@ func generateRandomKey() string {
 	}
 	return hex.EncodeToString(bytes)
 }
-
-func (s *APIKeyService) setupKeyTable() error {
-
-	return nil
-}
@@ -0,0 +1,186 @@
+package keyservice
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestService(t *testing.T) *APIKeyService {
+	t.Helper()
+
+	service, err := NewAPIKeyService(NewMemoryKeyStore(""), "")
+	if err != nil {
+		t.Fatalf("NewAPIKeyService: %v", err)
+	}
+
+	return service
+}
+
+func newTestKey(t *testing.T, service *APIKeyService, permissions APIPermissions, servers ...string) (string, string) {
+	t.Helper()
+
+	plainTextKey, err := service.NewApiKey(permissions, "owner@example.com", 100, "client", servers, nil)
+	if err != nil {
+		t.Fatalf("NewApiKey: %v", err)
+	}
+
+	encryptedKey, _ := service.EncryptAPIKey(plainTextKey)
+	return plainTextKey, encryptedKey
+}
+
+func TestNewApiKeyAndVerify(t *testing.T) {
+	service := newTestService(t)
+	plainTextKey, encryptedKey := newTestKey(t, service, APIPermissions{Read: true, Write: true}, "simplyvanilla")
+
+	key, err := service.VerifyAPIKey(plainTextKey)
+	if err != nil {
+		t.Fatalf("VerifyAPIKey: %v", err)
+	}
+
+	if key.Key != encryptedKey {
+		t.Errorf("key.Key = %q, want the encrypted key %q", key.Key, encryptedKey)
+	}
+	if !key.Permissions.Read || !key.Permissions.Write || key.Permissions.Admin {
+		t.Errorf("permissions = %+v, want read and write", key.Permissions)
+	}
+	if key.OwnerEmail != "owner@example.com" || key.RateLimit != 100 {
+		t.Errorf("key = %+v, owner or rate limit not saved", key)
+	}
+	if !key.AllowsServer("SimplyVanilla") || key.AllowsServer("2b2t") {
+		t.Errorf("servers = %v, want only simplyvanilla", key.Servers)
+	}
+
+	if _, err := service.VerifyAPIKey("not-a-key"); !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("VerifyAPIKey(wrong key) = %v, want ErrInvalidKey", err)
+	}
+}
+
+func TestNewApiKeyWriteNeedsOneServer(t *testing.T) {
+	service := newTestService(t)
+
+	for _, servers := range [][]string{nil, {"a", "b"}} {
+		_, err := service.NewApiKey(APIPermissions{Write: true}, "owner@example.com", 0, "bot", servers, nil)
+		if !errors.Is(err, ErrWriteKeyServerScope) {
+			t.Errorf("NewApiKey(write, servers %v) = %v, want ErrWriteKeyServerScope", servers, err)
+		}
+	}
+
+	if _, err := service.NewApiKey(APIPermissions{Read: true}, "owner@example.com", 0, "client", []string{"a", "b"}, nil); err != nil {
+		t.Errorf("NewApiKey(read, two servers) = %v, want no error", err)
+	}
+}
+
+func TestRevokeKey(t *testing.T) {
+	service := newTestService(t)
+	plainTextKey, encryptedKey := newTestKey(t, service, APIPermissions{Read: true})
+
+	// cached by verifying, revoking has to drop it from the cache too.
+	if _, err := service.VerifyAPIKey(plainTextKey); err != nil {
+		t.Fatalf("VerifyAPIKey: %v", err)
+	}
+
+	var revoked []string
+	service.OnKeyRevoked(func(key string) { revoked = append(revoked, key) })
+
+	if err := service.RevokeKey(encryptedKey); err != nil {
+		t.Fatalf("RevokeKey: %v", err)
+	}
+
+	if _, err := service.VerifyAPIKey(plainTextKey); !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("VerifyAPIKey(revoked key) = %v, want ErrInvalidKey", err)
+	}
+	if len(revoked) != 1 || revoked[0] != encryptedKey {
+		t.Errorf("revoke hooks got %v, want [%s]", revoked, encryptedKey)
+	}
+
+	if err := service.RevokeKey(encryptedKey); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("RevokeKey(revoked key) = %v, want ErrKeyNotFound", err)
+	}
+}
+
+func TestRotateKey(t *testing.T) {
+	service := newTestService(t)
+	oldKey, oldEncryptedKey := newTestKey(t, service, APIPermissions{Read: true})
+
+	if _, err := service.VerifyAPIKey(oldKey); err != nil {
+		t.Fatalf("VerifyAPIKey: %v", err)
+	}
+
+	newKey, newEncryptedKey, err := service.RotateKey(oldEncryptedKey)
+	if err != nil {
+		t.Fatalf("RotateKey: %v", err)
+	}
+
+	if _, err := service.VerifyAPIKey(oldKey); !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("VerifyAPIKey(old key) = %v, want ErrInvalidKey", err)
+	}
+
+	key, err := service.VerifyAPIKey(newKey)
+	if err != nil {
+		t.Fatalf("VerifyAPIKey(new key): %v", err)
+	}
+	if key.Key != newEncryptedKey || key.OwnerEmail != "owner@example.com" || key.RateLimit != 100 {
+		t.Errorf("rotated key = %+v, want the same owner and rate limit", key)
+	}
+
+	if _, _, err := service.RotateKey(oldEncryptedKey); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("RotateKey(old key) = %v, want ErrKeyNotFound", err)
+	}
+}
+
+func TestSetKeyExpiry(t *testing.T) {
+	service := newTestService(t)
+	plainTextKey, encryptedKey := newTestKey(t, service, APIPermissions{Read: true})
+
+	var changes []int64
+	service.OnKeyExpiryChanged(func(key string, expiresAt int64) {
+		if key == encryptedKey {
+			changes = append(changes, expiresAt)
+		}
+	})
+
+	past := time.Now().Add(-time.Minute).UnixMilli()
+	if err := service.SetKeyExpiry(encryptedKey, past); err != nil {
+		t.Fatalf("SetKeyExpiry: %v", err)
+	}
+	if _, err := service.VerifyAPIKey(plainTextKey); !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("VerifyAPIKey(expired key) = %v, want ErrInvalidKey", err)
+	}
+
+	// removing the expiry makes the key work again right away, even though it was just rejected.
+	if err := service.SetKeyExpiry(encryptedKey, 0); err != nil {
+		t.Fatalf("SetKeyExpiry: %v", err)
+	}
+	if _, err := service.VerifyAPIKey(plainTextKey); err != nil {
+		t.Errorf("VerifyAPIKey(key without expiry) = %v, want no error", err)
+	}
+
+	if len(changes) != 2 || changes[0] != past || changes[1] != 0 {
+		t.Errorf("expiry hooks got %v, want [%d 0]", changes, past)
+	}
+
+	if err := service.SetKeyExpiry("missing", 0); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("SetKeyExpiry(missing key) = %v, want ErrKeyNotFound", err)
+	}
+}
+
+func TestMemoryKeyStoreFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.json")
+
+	service, err := NewAPIKeyService(NewMemoryKeyStore(path), "")
+	if err != nil {
+		t.Fatalf("NewAPIKeyService: %v", err)
+	}
+	plainTextKey, _ := newTestKey(t, service, APIPermissions{Read: true})
+
+	// a new store reading the same file has the key.
+	reloaded, err := NewAPIKeyService(NewMemoryKeyStore(path), "")
+	if err != nil {
+		t.Fatalf("NewAPIKeyService: %v", err)
+	}
+	if _, err := reloaded.VerifyAPIKey(plainTextKey); err != nil {
+		t.Errorf("VerifyAPIKey after reloading the file = %v, want no error", err)
+	}
+}
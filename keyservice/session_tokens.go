@@ -0,0 +1,326 @@
+package keyservice
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+/******
+
+Short lived session tokens.
+Dashboards and browsers should never hold a real api key, instead they trade
+a key for a session token (an HMAC signed JWT) carrying the key's scopes.
+Tokens are verified with the signing secret only, no key store lookup.
+
+Secrets have an id (the "kid" in the token header), the first secret signs new
+tokens and every secret verifies them. To rotate, put the new secret first and
+keep the old one until the tokens it signed have expired.
+
+Revoking or rotating a key stops its tokens from working right away,
+we remember revocations in memory for as long as a token could live.
+
+******/
+
+// The token type for keys built from a session token.
+const SessionTokenType = "session"
+
+// Returned when session tokens are used but no signing secrets are set.
+var ErrSessionTokensDisabled = errors.New("session tokens are not enabled")
+
+// Returned when a session token was valid but has expired.
+var ErrSessionTokenExpired = errors.New("session token expired")
+
+// Returned when the key a session token was issued for was revoked or rotated.
+var ErrSessionTokenRevoked = errors.New("session token revoked")
+
+// A secret used to sign session tokens.
+type SessionSecret struct {
+	ID     string
+	Secret []byte
+}
+
+// The claims we put in a session token.
+type SessionClaims struct {
+	//the encrypted key the token was issued for.
+	Subject string `json:"sub"`
+
+	OwnerEmail string   `json:"email"`
+	Scopes     []Scope  `json:"scopes"`
+	Servers    []string `json:"servers,omitempty"`
+	RateLimit  int      `json:"rate_limit"`
+
+	//unix timestamps in seconds.
+	IssuedAt  int64 `json:"iat"`
+	ExpiresAt int64 `json:"exp"`
+}
+
+type sessionHeader struct {
+	Algorithm string `json:"alg"`
+	Type      string `json:"typ"`
+	KeyID     string `json:"kid"`
+}
+
+type sessionSigner struct {
+	//secrets by id, current is the id we sign with.
+	secrets map[string][]byte
+	current string
+
+	//the longest a token can live.
+	maxTTL time.Duration
+
+	//when each key was revoked, key is the encrypted api key.
+	revoked map[string]time.Time
+
+	mu *sync.Mutex
+}
+
+// Parsing signing secrets from the "id:secret,id:secret" format.
+// The first secret is the one new tokens are signed with.
+func ParseSessionSecrets(value string) ([]SessionSecret, error) {
+	secrets := []SessionSecret{}
+
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		id, secret, ok := strings.Cut(entry, ":")
+		if !ok || id == "" {
+			return nil, fmt.Errorf("session secret must be in the form id:secret")
+		}
+
+		if len(secret) < 32 {
+			return nil, fmt.Errorf("session secret %s must be at least 32 characters", id)
+		}
+
+		secrets = append(secrets, SessionSecret{ID: id, Secret: []byte(secret)})
+	}
+
+	return secrets, nil
+}
+
+// Enabling session tokens, signed with the first secret.
+// maxTTL is the longest a token can live.
+func (s *APIKeyService) EnableSessionTokens(secrets []SessionSecret, maxTTL time.Duration) error {
+	if len(secrets) == 0 {
+		return ErrSessionTokensDisabled
+	}
+
+	if maxTTL <= 0 {
+		return fmt.Errorf("session token ttl must be positive")
+	}
+
+	signer := &sessionSigner{
+		secrets: make(map[string][]byte),
+		current: secrets[0].ID,
+		maxTTL:  maxTTL,
+		revoked: make(map[string]time.Time),
+		mu:      &sync.Mutex{},
+	}
+
+	for _, secret := range secrets {
+		if _, exists := signer.secrets[secret.ID]; exists {
+			return fmt.Errorf("duplicate session secret id: %s", secret.ID)
+		}
+		signer.secrets[secret.ID] = secret.Secret
+	}
+
+	s.mu.Lock()
+	s.sessions = signer
+	s.mu.Unlock()
+
+	s.OnKeyRevoked(signer.revoke)
+
+	return nil
+}
+
+// Issuing a session token for a verified key.
+// scopes narrows the token to some of the key's scopes, empty means all of them.
+// ttl is capped at the max ttl and the key's own expiry.
+// Returns the token and when it expires as a millisecond timestamp.
+func (s *APIKeyService) IssueSessionToken(key APIkey, scopes []Scope, ttl time.Duration) (string, int64, error) {
+	s.mu.Lock()
+	signer := s.sessions
+	s.mu.Unlock()
+
+	if signer == nil {
+		return "", 0, ErrSessionTokensDisabled
+	}
+
+	if key.TokenType == SessionTokenType {
+		return "", 0, fmt.Errorf("session tokens can not be exchanged for new session tokens")
+	}
+
+	if len(scopes) == 0 {
+		scopes = key.EffectiveScopes()
+	}
+
+	for _, scope := range scopes {
+		if !key.HasScope(scope) {
+			return "", 0, fmt.Errorf("your api key does not have the '%s' scope", scope)
+		}
+	}
+
+	if len(scopes) == 0 {
+		return "", 0, fmt.Errorf("your api key has no scopes to put in a session token")
+	}
+
+	if ttl <= 0 || ttl > signer.maxTTL {
+		ttl = signer.maxTTL
+	}
+
+	now := time.Now()
+	expiresAt := now.Add(ttl)
+	if key.ExpiresAt > 0 && time.UnixMilli(key.ExpiresAt).Before(expiresAt) {
+		expiresAt = time.UnixMilli(key.ExpiresAt)
+	}
+
+	token, err := signer.sign(SessionClaims{
+		Subject:    key.Key,
+		OwnerEmail: key.OwnerEmail,
+		Scopes:     scopes,
+		Servers:    key.Servers,
+		RateLimit:  key.RateLimit,
+		IssuedAt:   now.Unix(),
+		ExpiresAt:  expiresAt.Unix(),
+	})
+	if err != nil {
+		return "", 0, err
+	}
+
+	return token, expiresAt.Unix() * 1000, nil
+}
+
+// Session tokens are JWTs, three base64 parts seperated by dots.
+// our api keys are plain hex so they never contain a dot.
+func looksLikeSessionToken(value string) bool {
+	return strings.Count(value, ".") == 2
+}
+
+// Verifying a session token and building the key it stands for.
+// The key uses the encrypted key the token was issued for, so rate limits and usage
+// are shared with the real key. A forged or malformed token returns ErrInvalidKey.
+func (s *APIKeyService) verifySessionToken(token string) (APIkey, error) {
+	s.mu.Lock()
+	signer := s.sessions
+	s.mu.Unlock()
+
+	if signer == nil {
+		return APIkey{}, ErrInvalidKey
+	}
+
+	claims, err := signer.verify(token)
+	if err != nil {
+		return APIkey{}, err
+	}
+
+	return APIkey{
+		Key:        claims.Subject,
+		OwnerEmail: claims.OwnerEmail,
+		Scopes:     claims.Scopes,
+		Servers:    claims.Servers,
+		RateLimit:  claims.RateLimit,
+		TokenType:  SessionTokenType,
+		CreatedAt:  claims.IssuedAt * 1000,
+		ExpiresAt:  claims.ExpiresAt * 1000,
+	}, nil
+}
+
+func (signer *sessionSigner) sign(claims SessionClaims) (string, error) {
+	header, err := json.Marshal(sessionHeader{Algorithm: "HS256", Type: "JWT", KeyID: signer.current})
+	if err != nil {
+		return "", err
+	}
+
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	return unsigned + "." + signer.signature(signer.secrets[signer.current], unsigned), nil
+}
+
+func (signer *sessionSigner) verify(token string) (SessionClaims, error) {
+	var claims SessionClaims
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return claims, ErrInvalidKey
+	}
+
+	headerBytes, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return claims, ErrInvalidKey
+	}
+
+	var header sessionHeader
+	if err := json.Unmarshal(headerBytes, &header); err != nil || header.Algorithm != "HS256" {
+		return claims, ErrInvalidKey
+	}
+
+	secret, ok := signer.secrets[header.KeyID]
+	if !ok {
+		return claims, ErrInvalidKey
+	}
+
+	expected := signer.signature(secret, parts[0]+"."+parts[1])
+	if !hmac.Equal([]byte(expected), []byte(parts[2])) {
+		return claims, ErrInvalidKey
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return claims, ErrInvalidKey
+	}
+
+	if err := json.Unmarshal(payload, &claims); err != nil || claims.Subject == "" {
+		return claims, ErrInvalidKey
+	}
+
+	now := time.Now()
+	if now.Unix() >= claims.ExpiresAt {
+		return claims, ErrSessionTokenExpired
+	}
+
+	signer.mu.Lock()
+	revokedAt, revoked := signer.revoked[claims.Subject]
+	signer.mu.Unlock()
+
+	if revoked && claims.IssuedAt <= revokedAt.Unix() {
+		return claims, ErrSessionTokenRevoked
+	}
+
+	return claims, nil
+}
+
+func (signer *sessionSigner) signature(secret []byte, unsigned string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(unsigned))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Remembering a revoked key so tokens issued for it stop working.
+// Revocations older than the max ttl are dropped, every token they could affect has expired.
+func (signer *sessionSigner) revoke(encryptedKey string) {
+	signer.mu.Lock()
+	defer signer.mu.Unlock()
+
+	now := time.Now()
+	for key, revokedAt := range signer.revoked {
+		if now.Sub(revokedAt) > signer.maxTTL {
+			delete(signer.revoked, key)
+		}
+	}
+
+	signer.revoked[encryptedKey] = now
+}
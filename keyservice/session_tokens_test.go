@@ -0,0 +1,268 @@
+package keyservice
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+var (
+	testSecretNew = SessionSecret{ID: "new", Secret: []byte("new-secret-that-is-at-least-32-chars")}
+	testSecretOld = SessionSecret{ID: "old", Secret: []byte("old-secret-that-is-at-least-32-chars")}
+)
+
+// A service with session tokens signed by secrets, and a read key to issue them for.
+func newSessionTestService(t *testing.T, maxTTL time.Duration, secrets ...SessionSecret) (*APIKeyService, APIkey) {
+	t.Helper()
+
+	service := newTestService(t)
+	if err := service.EnableSessionTokens(secrets, maxTTL); err != nil {
+		t.Fatalf("EnableSessionTokens: %v", err)
+	}
+
+	plainTextKey, _ := newTestKey(t, service, APIPermissions{Read: true})
+	key, err := service.VerifyAPIKey(plainTextKey)
+	if err != nil {
+		t.Fatalf("VerifyAPIKey: %v", err)
+	}
+
+	return service, key
+}
+
+// Replacing one part of a token, re-encoding it as base64.
+func replaceTokenPart(token string, index int, value interface{}) string {
+	parts := strings.Split(token, ".")
+	encoded, _ := json.Marshal(value)
+	parts[index] = base64.RawURLEncoding.EncodeToString(encoded)
+	return strings.Join(parts, ".")
+}
+
+func TestParseSessionSecrets(t *testing.T) {
+	secrets, err := ParseSessionSecrets("new:new-secret-that-is-at-least-32-chars, old:old-secret-that-is-at-least-32-chars")
+	if err != nil {
+		t.Fatalf("ParseSessionSecrets: %v", err)
+	}
+	if len(secrets) != 2 || secrets[0].ID != "new" || secrets[1].ID != "old" {
+		t.Errorf("secrets = %+v, want new then old", secrets)
+	}
+
+	for _, value := range []string{"no-id-separator", ":missing-id-secret-that-is-32-chars-long", "short:too-short"} {
+		if _, err := ParseSessionSecrets(value); err == nil {
+			t.Errorf("ParseSessionSecrets(%q) = nil error, want an error", value)
+		}
+	}
+}
+
+func TestSessionTokenRoundTrip(t *testing.T) {
+	service, key := newSessionTestService(t, time.Hour, testSecretNew)
+
+	token, expiresAt, err := service.IssueSessionToken(key, []Scope{ScopeEventsRead}, 10*time.Minute)
+	if err != nil {
+		t.Fatalf("IssueSessionToken: %v", err)
+	}
+
+	verified, err := service.VerifyAPIKey(token)
+	if err != nil {
+		t.Fatalf("VerifyAPIKey(token): %v", err)
+	}
+
+	if verified.Key != key.Key || verified.TokenType != SessionTokenType {
+		t.Errorf("token key = %+v, want the key it was issued for as a session", verified)
+	}
+	if !verified.HasScope(ScopeEventsRead) || verified.HasScope(ScopeStatsRead) {
+		t.Errorf("token scopes = %v, want only events:read", verified.Scopes)
+	}
+	if verified.ExpiresAt != expiresAt {
+		t.Errorf("token ExpiresAt = %d, want %d", verified.ExpiresAt, expiresAt)
+	}
+
+	if _, _, err := service.IssueSessionToken(key, []Scope{ScopeKeysAdmin}, 0); err == nil {
+		t.Error("IssueSessionToken(scope the key does not have) = nil error, want an error")
+	}
+}
+
+func TestSessionTokenTTL(t *testing.T) {
+	service, key := newSessionTestService(t, 15*time.Minute, testSecretNew)
+	now := time.Now()
+
+	tests := []struct {
+		name          string
+		ttl           time.Duration
+		keyExpiresAt  time.Time
+		wantExpiresAt time.Time
+	}{
+		{"asked for", 5 * time.Minute, time.Time{}, now.Add(5 * time.Minute)},
+		{"capped at the max ttl", 24 * time.Hour, time.Time{}, now.Add(15 * time.Minute)},
+		{"no ttl gets the max ttl", 0, time.Time{}, now.Add(15 * time.Minute)},
+		{"capped at the key expiry", 10 * time.Minute, now.Add(2 * time.Minute), now.Add(2 * time.Minute)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			key := key
+			if !test.keyExpiresAt.IsZero() {
+				key.ExpiresAt = test.keyExpiresAt.UnixMilli()
+			}
+
+			_, expiresAt, err := service.IssueSessionToken(key, nil, test.ttl)
+			if err != nil {
+				t.Fatalf("IssueSessionToken: %v", err)
+			}
+
+			// tokens are in whole seconds.
+			if diff := time.UnixMilli(expiresAt).Sub(test.wantExpiresAt); diff < -2*time.Second || diff > 2*time.Second {
+				t.Errorf("expiresAt = %s, want about %s", time.UnixMilli(expiresAt), test.wantExpiresAt)
+			}
+		})
+	}
+}
+
+func TestSessionTokenRejected(t *testing.T) {
+	service, key := newSessionTestService(t, time.Hour, testSecretNew, testSecretOld)
+
+	token, _, err := service.IssueSessionToken(key, nil, 0)
+	if err != nil {
+		t.Fatalf("IssueSessionToken: %v", err)
+	}
+
+	parts := strings.Split(token, ".")
+
+	var claims SessionClaims
+	payload, _ := base64.RawURLEncoding.DecodeString(parts[1])
+	json.Unmarshal(payload, &claims)
+
+	// more scopes than the key has, signed with nothing we know.
+	escalated := claims
+	escalated.Scopes = AllScopes
+
+	// signed by a secret that was removed since.
+	removed := &sessionSigner{secrets: map[string][]byte{"gone": []byte("gone-secret-that-is-at-least-32-chars")}, current: "gone"}
+	removedToken, _ := removed.sign(claims)
+
+	// expired, signed with the real secret.
+	expired := claims
+	expired.IssuedAt = time.Now().Add(-2 * time.Hour).Unix()
+	expired.ExpiresAt = time.Now().Add(-time.Hour).Unix()
+	expiredToken, _ := service.sessions.sign(expired)
+
+	tests := []struct {
+		name  string
+		token string
+		want  error
+	}{
+		{"forged signature", parts[0] + "." + parts[1] + "." + base64.RawURLEncoding.EncodeToString([]byte("forged")), ErrInvalidKey},
+		{"changed claims", replaceTokenPart(token, 1, escalated), ErrInvalidKey},
+		{"alg none", replaceTokenPart(token, 0, sessionHeader{Algorithm: "none", Type: "JWT", KeyID: "new"}), ErrInvalidKey},
+		{"alg none without signature", strings.TrimSuffix(replaceTokenPart(token, 0, sessionHeader{Algorithm: "none", Type: "JWT", KeyID: "new"}), parts[2]), ErrInvalidKey},
+		{"kid of the other secret", replaceTokenPart(token, 0, sessionHeader{Algorithm: "HS256", Type: "JWT", KeyID: "old"}), ErrInvalidKey},
+		{"unknown kid", replaceTokenPart(token, 0, sessionHeader{Algorithm: "HS256", Type: "JWT", KeyID: "missing"}), ErrInvalidKey},
+		{"removed secret", removedToken, ErrInvalidKey},
+		{"expired", expiredToken, ErrSessionTokenExpired},
+		{"not base64", "a.b.c", ErrInvalidKey},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := service.VerifyAPIKey(test.token); !errors.Is(err, test.want) {
+				t.Errorf("VerifyAPIKey = %v, want %v", err, test.want)
+			}
+		})
+	}
+
+	// none of that touched the real token.
+	if _, err := service.VerifyAPIKey(token); err != nil {
+		t.Errorf("VerifyAPIKey(real token) = %v, want no error", err)
+	}
+}
+
+func TestSessionTokenSecretRotation(t *testing.T) {
+	// tokens signed with the old secret while it was the current one.
+	oldService, key := newSessionTestService(t, time.Hour, testSecretOld)
+	oldToken, _, err := oldService.IssueSessionToken(key, nil, 0)
+	if err != nil {
+		t.Fatalf("IssueSessionToken: %v", err)
+	}
+
+	// the new secret signs now, the old one still verifies.
+	rotated := newTestService(t)
+	if err := rotated.EnableSessionTokens([]SessionSecret{testSecretNew, testSecretOld}, time.Hour); err != nil {
+		t.Fatalf("EnableSessionTokens: %v", err)
+	}
+	if _, err := rotated.VerifyAPIKey(oldToken); err != nil {
+		t.Errorf("VerifyAPIKey(token signed with old secret) = %v, want no error", err)
+	}
+
+	newToken, _, err := rotated.IssueSessionToken(key, nil, 0)
+	if err != nil {
+		t.Fatalf("IssueSessionToken: %v", err)
+	}
+
+	header, _ := base64.RawURLEncoding.DecodeString(strings.Split(newToken, ".")[0])
+	if !strings.Contains(string(header), `"kid":"new"`) {
+		t.Errorf("new token header = %s, want kid new", header)
+	}
+
+	// once the old secret is removed its tokens stop working.
+	removed := newTestService(t)
+	if err := removed.EnableSessionTokens([]SessionSecret{testSecretNew}, time.Hour); err != nil {
+		t.Fatalf("EnableSessionTokens: %v", err)
+	}
+	if _, err := removed.VerifyAPIKey(oldToken); !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("VerifyAPIKey(token signed with removed secret) = %v, want ErrInvalidKey", err)
+	}
+	if _, err := removed.VerifyAPIKey(newToken); err != nil {
+		t.Errorf("VerifyAPIKey(token signed with new secret) = %v, want no error", err)
+	}
+}
+
+func TestSessionTokenRevoked(t *testing.T) {
+	service, key := newSessionTestService(t, time.Hour, testSecretNew)
+
+	token, _, err := service.IssueSessionToken(key, nil, 0)
+	if err != nil {
+		t.Fatalf("IssueSessionToken: %v", err)
+	}
+
+	if _, _, err := service.RotateKey(key.Key); err != nil {
+		t.Fatalf("RotateKey: %v", err)
+	}
+
+	if _, err := service.VerifyAPIKey(token); !errors.Is(err, ErrSessionTokenRevoked) {
+		t.Errorf("VerifyAPIKey(token for rotated key) = %v, want ErrSessionTokenRevoked", err)
+	}
+}
+
+func TestSessionTokenCanNotBeTraded(t *testing.T) {
+	service, key := newSessionTestService(t, time.Hour, testSecretNew)
+
+	token, _, err := service.IssueSessionToken(key, nil, 0)
+	if err != nil {
+		t.Fatalf("IssueSessionToken: %v", err)
+	}
+
+	sessionKey, err := service.VerifyAPIKey(token)
+	if err != nil {
+		t.Fatalf("VerifyAPIKey(token): %v", err)
+	}
+
+	if _, _, err := service.IssueSessionToken(sessionKey, nil, 0); err == nil {
+		t.Error("IssueSessionToken(session key) = nil error, want an error")
+	}
+}
+
+func TestSessionTokensDisabled(t *testing.T) {
+	service := newTestService(t)
+	plainTextKey, _ := newTestKey(t, service, APIPermissions{Read: true})
+	key, _ := service.VerifyAPIKey(plainTextKey)
+
+	if _, _, err := service.IssueSessionToken(key, nil, 0); !errors.Is(err, ErrSessionTokensDisabled) {
+		t.Errorf("IssueSessionToken without secrets = %v, want ErrSessionTokensDisabled", err)
+	}
+
+	if _, err := service.VerifyAPIKey("a.b.c"); !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("VerifyAPIKey(token without secrets) = %v, want ErrInvalidKey", err)
+	}
+}
@@ -0,0 +1,36 @@
+package keyservice
+
+/******
+
+Where api keys are saved.
+The APIKeyService only talks to a KeyStore, so the mainframe can run with
+MySQL in production and with the in memory / json file store locally and in tests.
+Every key is stored and looked up by its encrypted value.
+
+******/
+
+type KeyStore interface {
+	//Creating tables or files the store needs, called once when the service starts.
+	Setup() error
+
+	//Saving a newly created key.
+	InsertKey(key APIkey) error
+
+	//Getting a key by its encrypted value, returns ErrKeyNotFound if it does not exist.
+	GetKey(encryptedKey string) (APIkey, error)
+
+	//Listing every key for an owner email, or every key if ownerEmail is empty.
+	ListKeys(ownerEmail string) ([]APIkey, error)
+
+	//Deleting a key, returns ErrKeyNotFound if it does not exist.
+	DeleteKey(encryptedKey string) error
+
+	//Giving a key a new encrypted value, keeping everything else.
+	ReplaceKeyHash(oldEncryptedKey string, newEncryptedKey string, updatedAt int64) error
+
+	//Setting when a key expires, 0 means never.
+	SetExpiry(encryptedKey string, expiresAt int64) error
+
+	//Adding usage counters to a key and moving its last used time forward.
+	AddUsage(encryptedKey string, lastUsed int64, eventsWritten int64, eventsRead int64) error
+}
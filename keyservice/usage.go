@@ -0,0 +1,222 @@
+package keyservice
+
+import (
+	"sync"
+	"time"
+)
+
+/******
+
+Tracking how each api key is used.
+Counters are kept in memory and written to the key store in batches by
+the usage flusher, so recording usage never costs a database round trip.
+Active connections are only kept in memory, they reset on restart anyways.
+
+******/
+
+// Usage for one key that has not been written to the database yet.
+type pendingUsage struct {
+	lastUsed      int64
+	eventsWritten int64
+	eventsRead    int64
+}
+
+// In memory usage counters for every key.
+type usageTracker struct {
+	//usage since the last flush, key is the encrypted api key.
+	pending map[string]*pendingUsage
+
+	//open websocket connections per key.
+	connections map[string]int
+
+	mu *sync.Mutex
+}
+
+func newUsageTracker() *usageTracker {
+	return &usageTracker{
+		pending:     make(map[string]*pendingUsage),
+		connections: make(map[string]int),
+		mu:          &sync.Mutex{},
+	}
+}
+
+// Getting the pending usage for a key and marking it as used now.
+// must be called while holding the lock.
+func (t *usageTracker) touch(encryptedKey string) *pendingUsage {
+	usage, ok := t.pending[encryptedKey]
+	if !ok {
+		usage = &pendingUsage{}
+		t.pending[encryptedKey] = usage
+	}
+
+	usage.lastUsed = time.Now().UnixNano() / int64(time.Millisecond)
+
+	return usage
+}
+
+// A usage report for one key, returned by the admin usage endpoint.
+type KeyUsageReport struct {
+	Key               string   `json:"key"`
+	OwnerEmail        string   `json:"ownerEmail"`
+	TokenType         string   `json:"tokenType"`
+	Servers           []string `json:"servers"`
+	LastUsed          int64    `json:"lastUsed"`
+	EventsWritten     int64    `json:"eventsWritten"`
+	EventsRead        int64    `json:"eventsRead"`
+	ActiveConnections int      `json:"activeConnections"`
+}
+
+// Recording events written with a key (websocket events or http writes).
+func (s *APIKeyService) RecordWrite(key APIkey, count int) {
+	if key.Key == "" {
+		return
+	}
+
+	s.usage.mu.Lock()
+	defer s.usage.mu.Unlock()
+
+	s.usage.touch(key.Key).eventsWritten += int64(count)
+}
+
+// Recording events read with a key (websocket broadcasts or http reads).
+func (s *APIKeyService) RecordRead(key APIkey, count int) {
+	if key.Key == "" {
+		return
+	}
+
+	s.usage.mu.Lock()
+	defer s.usage.mu.Unlock()
+
+	s.usage.touch(key.Key).eventsRead += int64(count)
+}
+
+// Recording a websocket connection authenticated with a key.
+func (s *APIKeyService) ConnectionOpened(key APIkey) {
+	if key.Key == "" {
+		return
+	}
+
+	s.usage.mu.Lock()
+	defer s.usage.mu.Unlock()
+
+	s.usage.touch(key.Key)
+	s.usage.connections[key.Key]++
+}
+
+// Recording a websocket connection closing.
+func (s *APIKeyService) ConnectionClosed(key APIkey) {
+	if key.Key == "" {
+		return
+	}
+
+	s.usage.mu.Lock()
+	defer s.usage.mu.Unlock()
+
+	if s.usage.connections[key.Key] <= 1 {
+		delete(s.usage.connections, key.Key)
+		return
+	}
+
+	s.usage.connections[key.Key]--
+}
+
+// Writing pending usage to the key store.
+// Usage that fails to save is kept and retried on the next flush.
+func (s *APIKeyService) FlushUsage() error {
+	s.usage.mu.Lock()
+	pending := s.usage.pending
+	s.usage.pending = make(map[string]*pendingUsage)
+	s.usage.mu.Unlock()
+
+	var firstErr error
+
+	for encryptedKey, usage := range pending {
+		if err := s.store.AddUsage(encryptedKey, usage.lastUsed, usage.eventsWritten, usage.eventsRead); err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+
+			s.usage.mu.Lock()
+			retry := s.usage.touch(encryptedKey)
+			if usage.lastUsed > retry.lastUsed {
+				retry.lastUsed = usage.lastUsed
+			}
+			retry.eventsWritten += usage.eventsWritten
+			retry.eventsRead += usage.eventsRead
+			s.usage.mu.Unlock()
+		}
+	}
+
+	return firstErr
+}
+
+// Starting a go routine that flushes usage to the database every interval.
+// The returned function stops the go routine and does a final flush.
+func (s *APIKeyService) StartUsageFlusher(interval time.Duration, onError func(error)) func() {
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+
+	go func() {
+		defer close(stopped)
+
+		for {
+			select {
+			case <-ticker.C:
+				if err := s.FlushUsage(); err != nil && onError != nil {
+					onError(err)
+				}
+			case <-done:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-stopped
+
+		if err := s.FlushUsage(); err != nil && onError != nil {
+			onError(err)
+		}
+	}
+}
+
+// Building a usage report for every key, or every key for an owner email.
+// Saved totals are combined with usage that has not been flushed yet.
+func (s *APIKeyService) UsageReport(ownerEmail string) ([]KeyUsageReport, error) {
+	keys, err := s.ListKeys(ownerEmail)
+	if err != nil {
+		return nil, err
+	}
+
+	s.usage.mu.Lock()
+	defer s.usage.mu.Unlock()
+
+	reports := make([]KeyUsageReport, 0, len(keys))
+	for _, key := range keys {
+		report := KeyUsageReport{
+			Key:               key.Key,
+			OwnerEmail:        key.OwnerEmail,
+			TokenType:         key.TokenType,
+			Servers:           key.Servers,
+			LastUsed:          key.UpdatedAt,
+			EventsWritten:     key.EventsWritten,
+			EventsRead:        key.EventsRead,
+			ActiveConnections: s.usage.connections[key.Key],
+		}
+
+		if usage, ok := s.usage.pending[key.Key]; ok {
+			if usage.lastUsed > report.LastUsed {
+				report.LastUsed = usage.lastUsed
+			}
+			report.EventsWritten += usage.eventsWritten
+			report.EventsRead += usage.eventsRead
+		}
+
+		reports = append(reports, report)
+	}
+
+	return reports, nil
+}
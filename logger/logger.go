@@ -108,3 +108,13 @@ func (l *Logger) Success(msg string) {
 	l.Logger.SetPrefix(prefix)
 	l.Logger.Printf("%v - %v\n", " "+formattedTime, msg)
 }
+
+func (l *Logger) Security(msg string) {
+	colorCode := color.New(color.FgHiRed).SprintFunc()
+	now := time.Now()
+	formattedTime := now.Format("2006/01/02 15:04:05")
+
+	prefix := fmt.Sprintf("[%s]", colorCode("security"))
+	l.Logger.SetPrefix(prefix)
+	l.Logger.Printf("%v - %v\n", " "+formattedTime, msg)
+}
@@ -6,12 +6,14 @@ import (
 	"log"
 	"os"
 	"os/signal"
+	"time"
 
 	"github.com/febzey/ForestBot-Mainframe/controllers"
 	"github.com/febzey/ForestBot-Mainframe/database"
 	"github.com/febzey/ForestBot-Mainframe/keyservice"
 	"github.com/febzey/ForestBot-Mainframe/logger"
 	"github.com/febzey/ForestBot-Mainframe/middleware"
+	"github.com/febzey/ForestBot-Mainframe/utils"
 	"github.com/gorilla/mux"
 	"github.com/joho/godotenv"
 )
@@ -42,8 +44,17 @@ func main() {
 		Logger: log.New(os.Stdout, "", 0),
 	}
 
+	//KEY_STORE picks where api keys are saved: mysql (default), memory, or file (json at KEY_STORE_FILE).
+	//Without keys in MySQL the mainframe can start without it, to run it locally.
+	keyStoreKind := os.Getenv("KEY_STORE")
+	databaseOptional := keyStoreKind == "memory" || keyStoreKind == "file"
+
 	// Connect to the database
 	db, err := database.Connect()
+	if err != nil && databaseOptional {
+		logger.Warn(fmt.Sprintf("Could not connect to the database, starting without it: %s", err.Error()))
+		db, err = database.Open()
+	}
 	if err != nil {
 		logger.Error(err.Error())
 		log.Fatal("Failed to connect to the database")
@@ -58,14 +69,66 @@ func main() {
 		}
 	}()
 
-	logger.Success("Connected to the database")
+	// Creating the tables and columns the mainframe adds (bot_sessions, playerActivity.inferred).
+	if err := db.Setup(); err != nil {
+		logger.Error(err.Error())
+		if !databaseOptional {
+			log.Fatal("Failed to set up the database")
+		}
+	} else {
+		logger.Success("Connected to the database")
+	}
+
+	//Only trust X-Forwarded-For when running behind a reverse proxy.
+	middleware.TrustProxyHeaders = utils.GetEnvBool("TRUST_PROXY_HEADERS", false)
 
 	// Create a new router
 	r := mux.NewRouter()
 	r.Use(middleware.LoggingMiddleware)
 
 	//api key service for handling api keys.
-	keyService := keyservice.NewAPIKeyService(db.Pool)
+	var keyStore keyservice.KeyStore
+	switch keyStoreKind {
+	case "memory":
+		keyStore = keyservice.NewMemoryKeyStore("")
+	case "file":
+		keyStore = keyservice.NewMemoryKeyStore(os.Getenv("KEY_STORE_FILE"))
+	default:
+		keyStore = keyservice.NewMySQLKeyStore(db.Pool)
+	}
+
+	//ADMIN_KEY is a bootstrap key with admin permissions, used to generate the first keys.
+	keyService, err := keyservice.NewAPIKeyService(keyStore, os.Getenv("ADMIN_KEY"))
+	if err != nil {
+		logger.Error(err.Error())
+		log.Fatal("Failed to start the api key service")
+	}
+
+	//Session tokens are signed with SESSION_TOKEN_SECRETS ("id:secret,id:secret"), the first secret signs.
+	//Without secrets the /key/session endpoint is disabled.
+	if secrets := os.Getenv("SESSION_TOKEN_SECRETS"); secrets != "" {
+		sessionSecrets, err := keyservice.ParseSessionSecrets(secrets)
+		if err != nil {
+			logger.Error(err.Error())
+			log.Fatal("Invalid SESSION_TOKEN_SECRETS")
+		}
+
+		ttl := time.Duration(utils.GetEnvInt("SESSION_TOKEN_TTL_SECONDS", 900)) * time.Second
+		if err := keyService.EnableSessionTokens(sessionSecrets, ttl); err != nil {
+			logger.Error(err.Error())
+			log.Fatal("Failed to enable session tokens")
+		}
+	}
+
+	//Identities getting banned for failed key attempts are logged.
+	keyService.OnSecurityEvent(logger.Security)
+
+	//Key usage is counted in memory and saved to the database in batches.
+	stopUsageFlusher := keyService.StartUsageFlusher(
+		time.Duration(utils.GetEnvInt("KEY_USAGE_FLUSH_SECONDS", 30))*time.Second,
+		func(err error) { logger.Error(err.Error()) },
+	)
+	defer stopUsageFlusher()
 
 	// Create a controller
 	controller := controllers.NewController(db, logger, keyService)
@@ -0,0 +1,95 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/febzey/ForestBot-Mainframe/keyservice"
+)
+
+type contextKey string
+
+// The key the verified api key is stored under in the request context.
+const apiKeyContextKey contextKey = "api-key"
+
+// RequireAPIKey protects a route behind an api key.
+// The key is read from the X-Api-Key header or an "Authorization: Bearer <key>" header,
+// verified through the key service and checked for the scope the route needs.
+// Session tokens are accepted anywhere a key is. An empty scope accepts any valid key.
+// Every accepted request counts towards the key's hourly rate limit.
+// Too many failed attempts from one ip gets that ip temporarily banned.
+func RequireAPIKey(keyService *keyservice.APIKeyService, scope keyservice.Scope) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			plainTextKey := ExtractAPIKey(r)
+			if plainTextKey == "" {
+				http.Error(w, "Missing api key, send it in the 'x-api-key' header", http.StatusUnauthorized)
+				return
+			}
+
+			key, err := keyService.VerifyAPIKey(plainTextKey, "ip:"+ClientIP(r))
+			if err != nil {
+				var banned *keyservice.BannedError
+				if errors.As(err, &banned) {
+					w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(banned.RetryAfter.Seconds()))))
+					http.Error(w, "Too many failed api key attempts, try again later", http.StatusTooManyRequests)
+					return
+				}
+
+				if errors.Is(err, keyservice.ErrSessionTokenExpired) || errors.Is(err, keyservice.ErrSessionTokenRevoked) {
+					http.Error(w, "Your session token has expired, request a new one", http.StatusUnauthorized)
+					return
+				}
+
+				http.Error(w, "Invalid api key", http.StatusUnauthorized)
+				return
+			}
+
+			if scope != "" && !key.HasScope(scope) {
+				http.Error(w, fmt.Sprintf("Your api key is missing the '%s' scope for this route", scope), http.StatusForbidden)
+				return
+			}
+
+			if allowed, retryAfter := keyService.Limiter.Allow(key); !allowed {
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+				http.Error(w, "Rate limit exceeded for your api key", http.StatusTooManyRequests)
+				return
+			}
+
+			if r.Method == http.MethodGet {
+				keyService.RecordRead(key, 1)
+			} else {
+				keyService.RecordWrite(key, 1)
+			}
+
+			ctx := context.WithValue(r.Context(), apiKeyContextKey, key)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// APIKeyFromRequest returns the api key that RequireAPIKey verified for this request.
+func APIKeyFromRequest(r *http.Request) (keyservice.APIkey, bool) {
+	key, ok := r.Context().Value(apiKeyContextKey).(keyservice.APIkey)
+	return key, ok
+}
+
+// ExtractAPIKey gets the plaintext api key from the request headers.
+// X-Api-Key takes priority over a bearer token.
+func ExtractAPIKey(r *http.Request) string {
+	if key := r.Header.Get("X-Api-Key"); key != "" {
+		return strings.TrimSpace(key)
+	}
+
+	auth := r.Header.Get("Authorization")
+	if len(auth) > 7 && strings.EqualFold(auth[:7], "bearer ") {
+		return strings.TrimSpace(auth[7:])
+	}
+
+	return ""
+}
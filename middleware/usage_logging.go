@@ -1,29 +1,41 @@
 package middleware
 
 import (
+	"net"
 	"net/http"
+	"strings"
 )
 
+// Only trust the X-Forwarded-For header when we are running behind a proxy,
+// otherwise anyone can send their own header and pretend to be a different ip.
+// set from TRUST_PROXY_HEADERS in main.
+var TrustProxyHeaders = false
+
 func LoggingMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Log request information
-		//fmt.Printf("[%s] %s from IP: %s at %s\n", r.Method, r.URL.Path, getClientIP(r), time.Now().Format(time.RFC3339))
+		//fmt.Printf("[%s] %s from IP: %s at %s\n", r.Method, r.URL.Path, ClientIP(r), time.Now().Format(time.RFC3339))
 		//we wil put this in log files
 		// Call the next handler in the chain
 		next.ServeHTTP(w, r)
 	})
 }
 
-// getClientIP extracts the original IP address from X-Forwarded-For header
-// func getClientIP(r *http.Request) string {
-// 	ip := r.Header.Get("X-Forwarded-For")
-// 	if ip == "" {
-// 		// If X-Forwarded-For is empty, use RemoteAddr
-// 		ip = r.RemoteAddr
-// 	} else {
-// 		// X-Forwarded-For may contain a list of IPs, take the first one
-// 		ips := strings.Split(ip, ",")
-// 		ip = strings.TrimSpace(ips[0])
-// 	}
-// 	return ip
-// }
+// ClientIP extracts the original IP address for a request.
+// X-Forwarded-For is only used when TrustProxyHeaders is on.
+func ClientIP(r *http.Request) string {
+	if TrustProxyHeaders {
+		if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+			// X-Forwarded-For may contain a list of IPs, take the first one
+			ips := strings.Split(forwarded, ",")
+			return strings.TrimSpace(ips[0])
+		}
+	}
+
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return ip
+}
@@ -0,0 +1,284 @@
+package presence
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/febzey/ForestBot-Mainframe/types"
+)
+
+/******
+
+Who is online on every minecraft server.
+The bots tell us with join and leave events, and send their full player list every so often.
+Everything goes through the Service so it is safe to use from any go routine.
+
+Every change bumps the version, so callers can tell if the lists changed since they last looked.
+Replacing a servers list with the full list from its bot returns who joined and left
+compared to what we had, which catches join and leave events we missed.
+
+******/
+
+// "unknown" while a servers bot is disconnected and we can not tell if the player is still online.
+const StatusUnknown = "unknown"
+
+// The players online on every server.
+type Service struct {
+	//key is the lowercase server name.
+	servers map[string]*serverList
+
+	//bumped on every change.
+	version uint64
+
+	mu sync.RWMutex
+}
+
+type serverList struct {
+	//the server name as the bot sent it.
+	name string
+
+	//in the order they joined, for the tablist.
+	players []types.Player
+}
+
+// The players that joined and left a server, from a full player list.
+type Diff struct {
+	Server  string         `json:"server"`
+	Joined  []types.Player `json:"joined"`
+	Left    []types.Player `json:"left"`
+	Version uint64         `json:"version"`
+
+	//true if we had no list for the server before, everyone is in Joined.
+	Initial bool `json:"-"`
+}
+
+// Every servers player list at one version.
+type Snapshot struct {
+	Version uint64                    `json:"version"`
+	Servers map[string][]types.Player `json:"servers"`
+}
+
+func NewService() *Service {
+	return &Service{servers: make(map[string]*serverList)}
+}
+
+// The same player, by uuid when we have both, otherwise by username.
+func samePlayer(a types.Player, b types.Player) bool {
+	if a.Uuid != "" && b.Uuid != "" {
+		return a.Uuid == b.Uuid
+	}
+
+	return strings.EqualFold(a.Username, b.Username)
+}
+
+// Adding a player to a server, or updating them if they are already on it.
+func (s *Service) Add(server string, player types.Player) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := strings.ToLower(server)
+	list, ok := s.servers[key]
+	if !ok {
+		list = &serverList{name: server}
+		s.servers[key] = list
+	}
+
+	s.version++
+
+	for i, existing := range list.players {
+		if samePlayer(existing, player) {
+			list.players[i] = player
+			return
+		}
+	}
+
+	list.players = append(list.players, player)
+}
+
+// Removing a player from a server by username, false if they were not on it.
+func (s *Service) Remove(server string, username string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	list, ok := s.servers[strings.ToLower(server)]
+	if !ok {
+		return false
+	}
+
+	for i, player := range list.players {
+		if strings.EqualFold(player.Username, username) {
+			list.players = append(list.players[:i:i], list.players[i+1:]...)
+			s.version++
+			return true
+		}
+	}
+
+	return false
+}
+
+/*
+Replacing a servers list with the full list from its bot.
+Returns who joined and left compared to the list we had.
+*/
+func (s *Service) Replace(server string, players []types.Player) Diff {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := strings.ToLower(server)
+	diff := Diff{Server: server, Joined: []types.Player{}, Left: []types.Player{}}
+
+	previous, ok := s.servers[key]
+	if !ok {
+		diff.Initial = true
+		previous = &serverList{name: server}
+	}
+
+	for _, player := range players {
+		if !containsPlayer(previous.players, player) {
+			diff.Joined = append(diff.Joined, player)
+		}
+	}
+
+	for _, player := range previous.players {
+		if !containsPlayer(players, player) {
+			diff.Left = append(diff.Left, player)
+		}
+	}
+
+	s.servers[key] = &serverList{name: server, players: append([]types.Player{}, players...)}
+	s.version++
+	diff.Version = s.version
+
+	return diff
+}
+
+func containsPlayer(players []types.Player, player types.Player) bool {
+	for _, p := range players {
+		if samePlayer(p, player) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Marking every player on a server as unknown, returns how many there are.
+func (s *Service) MarkUnknown(server string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	list, ok := s.servers[strings.ToLower(server)]
+	if !ok {
+		return 0
+	}
+
+	for i := range list.players {
+		list.players[i].Status = StatusUnknown
+	}
+	s.version++
+
+	return len(list.players)
+}
+
+// Removing a servers whole list, returns the players that were on it.
+func (s *Service) RemoveServer(server string) []types.Player {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := strings.ToLower(server)
+	list, ok := s.servers[key]
+	if !ok {
+		return nil
+	}
+
+	delete(s.servers, key)
+	s.version++
+
+	return list.players
+}
+
+// Keeping only the players on a server that keep returns true for, returns the ones removed.
+func (s *Service) Retain(server string, keep func(types.Player) bool) []types.Player {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	list, ok := s.servers[strings.ToLower(server)]
+	if !ok {
+		return nil
+	}
+
+	var kept, removed []types.Player
+	for _, player := range list.players {
+		if keep(player) {
+			kept = append(kept, player)
+		} else {
+			removed = append(removed, player)
+		}
+	}
+
+	if len(removed) > 0 {
+		list.players = kept
+		s.version++
+	}
+
+	return removed
+}
+
+// Finding an online player by uuid, on any server.
+func (s *Service) ByUUID(uuid string) (types.Player, bool) {
+	return s.find(func(player types.Player) bool { return player.Uuid == uuid })
+}
+
+// Finding an online player by username, on any server.
+func (s *Service) ByUsername(username string) (types.Player, bool) {
+	return s.find(func(player types.Player) bool { return strings.EqualFold(player.Username, username) })
+}
+
+func (s *Service) find(match func(types.Player) bool) (types.Player, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, list := range s.servers {
+		for _, player := range list.players {
+			if match(player) {
+				return player, true
+			}
+		}
+	}
+
+	return types.Player{}, false
+}
+
+// A copy of a servers player list, ok is false if we have no list for the server.
+func (s *Service) List(server string) ([]types.Player, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	list, ok := s.servers[strings.ToLower(server)]
+	if !ok {
+		return nil, false
+	}
+
+	return append([]types.Player{}, list.players...), true
+}
+
+// The current version, changes every time any list changes.
+func (s *Service) Version() uint64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.version
+}
+
+// A copy of every servers list, and the version they are at.
+func (s *Service) Snapshot() Snapshot {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	snapshot := Snapshot{Version: s.version, Servers: make(map[string][]types.Player)}
+	for _, list := range s.servers {
+		snapshot.Servers[list.name] = append([]types.Player{}, list.players...)
+	}
+
+	return snapshot
+}
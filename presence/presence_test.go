@@ -0,0 +1,192 @@
+package presence
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/febzey/ForestBot-Mainframe/types"
+)
+
+func player(username string, uuid string) types.Player {
+	return types.Player{Username: username, Uuid: uuid, Server: "simplyvanilla"}
+}
+
+func usernames(players []types.Player) []string {
+	names := []string{}
+	for _, player := range players {
+		names = append(names, player.Username)
+	}
+	return names
+}
+
+func TestReplaceDiff(t *testing.T) {
+	s := NewService()
+
+	first := s.Replace("SimplyVanilla", []types.Player{player("a", "1"), player("b", "2")})
+	if !first.Initial || !reflect.DeepEqual(usernames(first.Joined), []string{"a", "b"}) || len(first.Left) != 0 {
+		t.Errorf("first list diff = %+v, want everyone joined", first)
+	}
+
+	tests := []struct {
+		name       string
+		players    []types.Player
+		wantJoined []string
+		wantLeft   []string
+	}{
+		{"nothing changed", []types.Player{player("a", "1"), player("b", "2")}, []string{}, []string{}},
+		{"joined and left", []types.Player{player("a", "1"), player("c", "3")}, []string{"c"}, []string{"b"}},
+		{"renamed players match by uuid", []types.Player{player("a2", "1"), player("c", "3")}, []string{}, []string{}},
+		{"without a uuid players match by username", []types.Player{player("A2", ""), player("c", "3")}, []string{}, []string{}},
+		{"everyone left", []types.Player{}, []string{}, []string{"A2", "c"}},
+	}
+
+	for _, test := range tests {
+		version := s.Version()
+
+		diff := s.Replace("simplyvanilla", test.players)
+		if diff.Initial {
+			t.Errorf("%s: diff is initial for a server we had a list for", test.name)
+		}
+		if !reflect.DeepEqual(usernames(diff.Joined), test.wantJoined) || !reflect.DeepEqual(usernames(diff.Left), test.wantLeft) {
+			t.Errorf("%s: joined %v left %v, want joined %v left %v", test.name, usernames(diff.Joined), usernames(diff.Left), test.wantJoined, test.wantLeft)
+		}
+		if diff.Version != version+1 || s.Version() != diff.Version {
+			t.Errorf("%s: version %d, want %d", test.name, diff.Version, version+1)
+		}
+	}
+}
+
+func TestReplaceCopiesList(t *testing.T) {
+	s := NewService()
+	players := []types.Player{player("a", "1")}
+	s.Replace("simplyvanilla", players)
+
+	players[0].Username = "changed"
+	list, _ := s.List("simplyvanilla")
+	list[0].Username = "changed too"
+
+	if list, _ := s.List("simplyvanilla"); list[0].Username != "a" {
+		t.Errorf("list = %v, changing the slices passed in or out changed the service", usernames(list))
+	}
+}
+
+func TestStaleList(t *testing.T) {
+	s := NewService()
+	s.Replace("SimplyVanilla", []types.Player{player("a", "1"), player("b", "2"), player("c", "3")})
+
+	// the bot is gone.
+	if count := s.MarkUnknown("simplyvanilla"); count != 3 {
+		t.Errorf("MarkUnknown = %d, want 3", count)
+	}
+	list, _ := s.List("simplyvanilla")
+	for _, player := range list {
+		if player.Status != StatusUnknown {
+			t.Errorf("%s has status %q, want unknown", player.Username, player.Status)
+		}
+	}
+
+	// back in time, b left while it was gone.
+	removed := s.Retain("simplyvanilla", func(player types.Player) bool { return player.Uuid != "2" })
+	if !reflect.DeepEqual(usernames(removed), []string{"b"}) {
+		t.Errorf("Retain removed %v, want b", usernames(removed))
+	}
+	if list, _ := s.List("simplyvanilla"); !reflect.DeepEqual(usernames(list), []string{"a", "c"}) {
+		t.Errorf("list = %v, want a and c", usernames(list))
+	}
+
+	// keeping everyone is not a change.
+	version := s.Version()
+	if removed := s.Retain("simplyvanilla", func(types.Player) bool { return true }); len(removed) != 0 || s.Version() != version {
+		t.Errorf("Retain keeping everyone removed %v and changed the version", usernames(removed))
+	}
+
+	// not back in time, the list is dropped.
+	if removed := s.RemoveServer("SIMPLYVANILLA"); !reflect.DeepEqual(usernames(removed), []string{"a", "c"}) {
+		t.Errorf("RemoveServer = %v, want a and c", usernames(removed))
+	}
+	if _, ok := s.List("simplyvanilla"); ok {
+		t.Error("list still exists after RemoveServer")
+	}
+
+	// servers we have no list for.
+	if s.MarkUnknown("2b2t") != 0 || s.RemoveServer("2b2t") != nil || s.Retain("2b2t", func(types.Player) bool { return false }) != nil {
+		t.Error("changing a server without a list did something")
+	}
+}
+
+func TestAddAndRemove(t *testing.T) {
+	s := NewService()
+
+	s.Add("SimplyVanilla", player("a", "1"))
+	s.Add("simplyvanilla", player("b", "2"))
+
+	// joining again updates the player instead of adding them twice.
+	updated := player("a", "1")
+	updated.Latency = 50
+	s.Add("simplyvanilla", updated)
+
+	list, _ := s.List("simplyvanilla")
+	if !reflect.DeepEqual(usernames(list), []string{"a", "b"}) || list[0].Latency != 50 {
+		t.Errorf("list = %+v, want a (updated) then b", list)
+	}
+
+	if found, ok := s.ByUUID("2"); !ok || found.Username != "b" {
+		t.Errorf("ByUUID(2) = %+v, %v, want b", found, ok)
+	}
+	if found, ok := s.ByUsername("A"); !ok || found.Uuid != "1" {
+		t.Errorf("ByUsername(A) = %+v, %v, want a", found, ok)
+	}
+
+	if !s.Remove("simplyvanilla", "A") {
+		t.Error("Remove(A) = false")
+	}
+	if s.Remove("simplyvanilla", "a") || s.Remove("2b2t", "b") {
+		t.Error("removing a player that is not on the list = true")
+	}
+	if _, ok := s.ByUsername("a"); ok {
+		t.Error("removed player is still found")
+	}
+
+	snapshot := s.Snapshot()
+	if snapshot.Version != s.Version() || !reflect.DeepEqual(usernames(snapshot.Servers["SimplyVanilla"]), []string{"b"}) {
+		t.Errorf("snapshot = %+v, want b on SimplyVanilla", snapshot)
+	}
+}
+
+func TestConcurrentUse(t *testing.T) {
+	s := NewService()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			server := fmt.Sprintf("server-%d", i%2)
+			for j := 0; j < 100; j++ {
+				username := fmt.Sprintf("player-%d-%d", i, j)
+
+				s.Add(server, types.Player{Username: username, Uuid: username})
+				s.Snapshot()
+				s.List(server)
+				s.ByUsername(username)
+				s.Remove(server, username)
+
+				if j%25 == 0 {
+					s.MarkUnknown(server)
+					s.Retain(server, func(types.Player) bool { return true })
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// every player was removed after being added.
+	for server, players := range s.Snapshot().Servers {
+		if len(players) != 0 {
+			t.Errorf("%s still has %v", server, usernames(players))
+		}
+	}
+}
@@ -34,9 +34,9 @@ func ServerConfig(router *mux.Router) *http.Server {
 	serverConnUrl, _ := ConnUrlBuilder("server")
 	readTimeoutSecondsCount, _ := strconv.Atoi(os.Getenv("READ_TIMEOUT_SECONDS_COUNT"))
 
-	headersOk := handlers.AllowedHeaders([]string{"X-Requested-With", "Content-Type"})
+	headersOk := handlers.AllowedHeaders([]string{"X-Requested-With", "Content-Type", "X-Api-Key", "Authorization"})
 	originsOk := handlers.AllowedOrigins([]string{os.Getenv("*")})
-	methodsOk := handlers.AllowedMethods([]string{"GET", "HEAD", "POST", "PUT", "OPTIONS"})
+	methodsOk := handlers.AllowedMethods([]string{"GET", "HEAD", "POST", "PUT", "DELETE", "OPTIONS"})
 
 	return &http.Server{
 		Handler:     handlers.CORS(headersOk, originsOk, methodsOk)(router),
@@ -1,7 +0,0 @@
-package types
-
-// Types for api permissions.
-type APIPermissions struct {
-	Read  bool
-	Write bool
-}
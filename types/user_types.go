@@ -21,6 +21,7 @@ type PlayerActivity struct {
 	Date      int64  // unix timestamp in milliseconds
 	Type      string // join | leave
 	Mc_server string // mc_server
+	Inferred  bool   // written by us because the bot was not there to see it
 }
 
 type User struct {
@@ -44,6 +45,10 @@ type Player struct {
 	Latency  int    `json:"latency"`
 	Server   string `json:"server"`
 	Head_url string `json:"head_url"`
+
+	//"unknown" while the servers bot is disconnected and we can not tell
+	//if the player is still online, empty otherwise.
+	Status string `json:"status,omitempty"`
 }
 
 type DiscordMessage struct {
@@ -0,0 +1,27 @@
+package utils
+
+import (
+	"os"
+	"strconv"
+	"strings"
+)
+
+// GetEnvInt reads an integer environment variable, returning fallback if it is unset or invalid.
+func GetEnvInt(name string, fallback int) int {
+	value, err := strconv.Atoi(strings.TrimSpace(os.Getenv(name)))
+	if err != nil {
+		return fallback
+	}
+
+	return value
+}
+
+// GetEnvBool reads a boolean environment variable, returning fallback if it is unset or invalid.
+func GetEnvBool(name string, fallback bool) bool {
+	value, err := strconv.ParseBool(strings.TrimSpace(os.Getenv(name)))
+	if err != nil {
+		return fallback
+	}
+
+	return value
+}